@@ -0,0 +1,134 @@
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"gipspot"
+
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+var cmdBackup = &command{
+	Name:  "backup",
+	Usage: "[-o file] store.json",
+	Short: "write every association of a store file to a versioned backup document",
+	Flags: flag.NewFlagSet("backup", flag.ExitOnError),
+}
+
+var backupOutput = cmdBackup.Flags.String("o", "", "backup file; standard output if empty")
+
+var cmdRestore = &command{
+	Name:  "restore",
+	Usage: "[-mode merge|replace] [-n] [-diff] [-audit-log file] backup.json store.json",
+	Short: "import a backup document into a store file",
+	Flags: flag.NewFlagSet("restore", flag.ExitOnError),
+}
+
+var (
+	restoreMode = cmdRestore.Flags.String("mode", gipspot.ImportMerge,
+		"merge keeps associations missing from the backup; replace deletes them")
+	restoreDryRun   = cmdRestore.Flags.Bool("n", false, "print the changes without making them")
+	restoreDiff     = cmdRestore.Flags.Bool("diff", false, "print the fields changed in each association")
+	restoreAuditLog = cmdRestore.Flags.String("audit-log", envString("GOPHERPATH_AUDIT_LOG", ""),
+		"audit log file recording the changes ($GOPHERPATH_AUDIT_LOG)")
+)
+
+func init() {
+	cmdBackup.Run = runBackup
+	cmdRestore.Run = runRestore
+	commands = append(commands, cmdBackup, cmdRestore)
+}
+
+func runBackup(cmd *command, args []string) error {
+	if len(args) != 1 {
+		cmd.usage()
+	}
+	store, err := gipspot.OpenFileStore(args[0])
+	if err != nil {
+		return err
+	}
+	ctx := gipspot.LogContext(log.New(os.Stderr, "", 0))
+	b, err := gipspot.ExportBackup(ctx, store)
+	if err != nil {
+		return err
+	}
+	p, err := json.MarshalIndent(b, "", "\t")
+	if err != nil {
+		return err
+	}
+	p = append(p, '\n')
+	if *backupOutput == "" {
+		_, err = os.Stdout.Write(p)
+		return err
+	}
+	return writeFile(*backupOutput, p)
+}
+
+func runRestore(cmd *command, args []string) error {
+	if len(args) != 2 {
+		cmd.usage()
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	b, err := gipspot.ReadBackup(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+	store, err := gipspot.OpenFileStore(args[1])
+	if err != nil {
+		return err
+	}
+	audit, err := openAuditLog(*restoreAuditLog)
+	if err != nil {
+		return err
+	}
+	ctx := gipspot.LogContext(log.New(os.Stderr, "", 0))
+	opts := gipspot.ImportOptions{Mode: *restoreMode, DryRun: *restoreDryRun}
+	changes, err := gipspot.ImportBackup(ctx, gipspot.Audited(store, audit, "restore"), b, opts)
+	printChanges(os.Stdout, changes, *restoreDiff)
+	if err != nil {
+		return err
+	}
+	verb := "made"
+	if *restoreDryRun {
+		verb = "would be made"
+	}
+	fmt.Printf("%d changes %s\n", len(changes), verb)
+	return nil
+}
+
+// printChanges writes a line per change to w, followed by the fields changed
+// if diff is true.
+func printChanges(w io.Writer, changes []gipspot.BackupChange, diff bool) {
+	for _, ch := range changes {
+		fmt.Fprintf(w, "%s %s\n", ch.Action, ch.Path)
+		if !diff {
+			continue
+		}
+		for _, line := range gipspot.DiffAssocs(ch.Before, ch.After) {
+			fmt.Fprintf(w, "\t%s\n", line)
+		}
+	}
+}
+
+// writeFile writes p to the file name, replacing its content.
+func writeFile(name string, p []byte) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(p)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"gipspot"
+
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+var cmdConflicts = &command{
+	Name:  "conflicts",
+	Usage: "[-resolve] [-audit-log file] store.json",
+	Short: "list or merge conflicting associations of a store file",
+	Flags: flag.NewFlagSet("conflicts", flag.ExitOnError),
+}
+
+var (
+	conflictsResolve  = cmdConflicts.Flags.Bool("resolve", false, "merge the associations of each domain where that is safe")
+	conflictsAuditLog = cmdConflicts.Flags.String("audit-log", envString("GOPHERPATH_AUDIT_LOG", ""), "audit log file recording merges ($GOPHERPATH_AUDIT_LOG)")
+)
+
+func init() {
+	cmdConflicts.Run = runConflicts
+	commands = append(commands, cmdConflicts)
+}
+
+func runConflicts(cmd *command, args []string) error {
+	if len(args) != 1 {
+		cmd.usage()
+	}
+	store, err := gipspot.OpenFileStore(args[0])
+	if err != nil {
+		return err
+	}
+	ctx := gipspot.LogContext(log.New(os.Stderr, "", 0))
+	var conflicts []gipspot.Conflict
+	if *conflictsResolve {
+		var audit gipspot.AuditLog
+		audit, err = openAuditLog(*conflictsAuditLog)
+		if err != nil {
+			return err
+		}
+		conflicts, err = gipspot.ResolveConflicts(ctx, gipspot.Audited(store, audit, "conflicts -resolve"))
+	} else {
+		conflicts, err = gipspot.FindConflicts(ctx, store)
+	}
+	if err != nil {
+		return err
+	}
+	// conflicts remain unless they were merged.
+	unresolved := 0
+	for _, c := range conflicts {
+		if !c.Resolved || !*conflictsResolve {
+			unresolved++
+		}
+		keys := strings.Join(c.Keys, ", ")
+		switch {
+		case !c.Resolved:
+			fmt.Printf("%s: %s: resolve by hand: %s\n", c.Domain, keys, c.Reason)
+		case *conflictsResolve:
+			fmt.Printf("%s: %s: merged into %s\n", c.Domain, keys, c.Kept)
+		default:
+			fmt.Printf("%s: %s: can be merged into %s\n", c.Domain, keys, c.Kept)
+		}
+	}
+	if unresolved > 0 {
+		return fmt.Errorf("%d domains have conflicting associations", unresolved)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"gipspot"
+	"importmeta"
+
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+var cmdExport = &command{
+	Name:  "export",
+	Usage: "[-o dir] [-v] [-store store.json | packages.json]",
+	Short: "write static go-get pages for hosting without a server",
+	Flags: flag.NewFlagSet("export", flag.ExitOnError),
+}
+
+var (
+	exportDir     = cmdExport.Flags.String("o", ".", "output directory")
+	exportVerbose = cmdExport.Flags.Bool("v", false, "print the name of each written or removed file")
+	exportStore   = cmdExport.Flags.String("store", envString("GOPHERPATH_STORE", ""), "export the public packages of a store file instead of a package list ($GOPHERPATH_STORE)")
+)
+
+func init() {
+	cmdExport.Run = runExport
+	commands = append(commands, cmdExport)
+}
+
+func runExport(cmd *command, args []string) error {
+	var e importmeta.Enumerator
+	switch {
+	case len(args) == 1:
+		codec, err := readStaticCodec(args[0])
+		if err != nil {
+			return err
+		}
+		e = codec
+	case len(args) == 0 && *exportStore != "":
+		store, err := gipspot.OpenFileStore(*exportStore)
+		if err != nil {
+			return err
+		}
+		e = gipspot.StoreEnumerator{Context: gipspot.LogContext(log.New(os.Stderr, "", 0)), Store: store}
+	default:
+		cmd.usage()
+	}
+	stats, err := importmeta.Export(*exportDir, e)
+	if err != nil {
+		return err
+	}
+	if *exportVerbose {
+		for _, name := range stats.Written {
+			fmt.Println("wrote", name)
+		}
+		for _, name := range stats.Removed {
+			fmt.Println("removed", name)
+		}
+	}
+	fmt.Printf("%d written, %d unchanged, %d removed\n",
+		len(stats.Written), len(stats.Unchanged), len(stats.Removed))
+	return nil
+}
+
+// readStaticCodec reads a JSON array of importmeta.ImportMeta values from
+// filename.
+func readStaticCodec(filename string) (importmeta.StaticCodec, error) {
+	p, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var codec importmeta.StaticCodec
+	err = json.Unmarshal(p, &codec)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return codec, nil
+}
@@ -0,0 +1,148 @@
+//go:build !appengine
+// +build !appengine
+
+// Command gopherpath serves and manages gopherpath import paths outside of
+// App Engine.
+//
+// Usage:
+//
+//	gopherpath <command> [arguments]
+//
+// Run "gopherpath help" for a list of commands.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// command is a gopherpath subcommand.
+type command struct {
+	Name  string
+	Usage string // arguments following the command name
+	Short string // one line description
+	Flags *flag.FlagSet
+	Run   func(cmd *command, args []string) error
+}
+
+func (cmd *command) usage() {
+	fmt.Fprintf(os.Stderr, "usage: gopherpath %s %s\n\n%s.\n\n", cmd.Name, cmd.Usage, cmd.Short)
+	cmd.Flags.PrintDefaults()
+	os.Exit(2)
+}
+
+var commands []*command
+
+func lookupCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gopherpath <command> [arguments]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "\t%-10s %s\n", cmd.Name, cmd.Short)
+	}
+	os.Exit(2)
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("gopherpath: ")
+
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 || args[0] == "help" {
+		if len(args) > 1 {
+			if cmd := lookupCommand(args[1]); cmd != nil {
+				cmd.usage()
+			}
+		}
+		usage()
+	}
+
+	cmd := lookupCommand(args[0])
+	if cmd == nil {
+		log.Printf("unknown command %q", args[0])
+		usage()
+	}
+	cmd.Flags.Usage = cmd.usage
+	cmd.Flags.Parse(args[1:])
+	err := cmd.Run(cmd, cmd.Flags.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// envString returns the value of the environment variable name, or def if it
+// is unset or empty.
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envDuration is like envString for time.Duration values.  Invalid values are
+// fatal.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+	return d
+}
+
+// envFloat is like envString for float64 values.  Invalid values are fatal.
+func envFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+	return f
+}
+
+// envInt is like envString for int values.  Invalid values are fatal.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+	return n
+}
+
+// envBool is like envString for bool values.  Invalid values are fatal.
+func envBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+	return b
+}
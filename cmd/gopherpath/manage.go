@@ -0,0 +1,586 @@
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"gipspot"
+
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The domain and pkg commands manage associations through a backend, either
+// a store file or the admin API of a running server, identifying them by
+// import path (e.g. example.com/go) rather than by key.
+
+var cmdDomain = &command{
+	Name:  "domain",
+	Usage: "add|verify|list|remove [flags] [arguments]",
+	Short: "manage the associations of a store file or server",
+	Flags: flag.NewFlagSet("domain", flag.ExitOnError),
+}
+
+var cmdPkg = &command{
+	Name:  "pkg",
+	Usage: "map|unmap|show [flags] import/path",
+	Short: "manage the package mappings of a store file or server",
+	Flags: flag.NewFlagSet("pkg", flag.ExitOnError),
+}
+
+var cmdResolve = &command{
+	Name:  "resolve",
+	Usage: "[flags] import/path",
+	Short: "print the import metadata served for an import path",
+	Flags: flag.NewFlagSet("resolve", flag.ExitOnError),
+}
+
+// subcommand is a subcommand of the domain and pkg commands.
+type subcommand struct {
+	Name  string
+	Usage string // arguments following the subcommand name
+	Short string
+	Flags *flag.FlagSet
+	Run   func(b backend, args []string) error
+}
+
+var (
+	domainAdd = &subcommand{
+		Name:  "add",
+		Usage: "[-alias-of path] [-provider name] [-verified] domain[/prefix] [login]",
+		Short: "create an association and print its verification challenges",
+		Flags: flag.NewFlagSet("domain add", flag.ExitOnError),
+	}
+	domainVerify = &subcommand{
+		Name:  "verify",
+		Usage: "domain[/prefix]",
+		Short: "check the verification challenges of an association",
+		Flags: flag.NewFlagSet("domain verify", flag.ExitOnError),
+	}
+	domainList = &subcommand{
+		Name:  "list",
+		Usage: "[-login login]",
+		Short: "list associations",
+		Flags: flag.NewFlagSet("domain list", flag.ExitOnError),
+	}
+	domainRemove = &subcommand{
+		Name:  "remove",
+		Usage: "domain[/prefix]",
+		Short: "delete an association and its package mappings",
+		Flags: flag.NewFlagSet("domain remove", flag.ExitOnError),
+	}
+	pkgMap = &subcommand{
+		Name:  "map",
+		Usage: "[-repo repo] [-subdir dir] [-owner owner] [-provider name] [-vcs vcs] [-hidden] [-private] [-disabled] import/path",
+		Short: "create or replace the mapping of a root package",
+		Flags: flag.NewFlagSet("pkg map", flag.ExitOnError),
+	}
+	pkgUnmap = &subcommand{
+		Name:  "unmap",
+		Usage: "import/path",
+		Short: "delete the mapping of a root package",
+		Flags: flag.NewFlagSet("pkg unmap", flag.ExitOnError),
+	}
+	pkgShow = &subcommand{
+		Name:  "show",
+		Usage: "import/path",
+		Short: "print the mapping of a root package, or every mapping of an association",
+		Flags: flag.NewFlagSet("pkg show", flag.ExitOnError),
+	}
+)
+
+var (
+	addAliasOf  = domainAdd.Flags.String("alias-of", "", "import path of the association served by the new alias")
+	addProvider = domainAdd.Flags.String("provider", "", "repository provider; "+gipspot.DefaultProvider+" if empty")
+	addVerified = domainAdd.Flags.Bool("verified", false, "mark the domain verified without a challenge (store files only)")
+	listLogin   = domainList.Flags.String("login", "", "list only the associations of a login")
+
+	mapRepo     = pkgMap.Flags.String("repo", "", "repository name, if it differs from the root, or full repository URL")
+	mapSubdir   = pkgMap.Flags.String("subdir", "", "repository subdirectory containing the package")
+	mapOwner    = pkgMap.Flags.String("owner", "", "repository owner, if it differs from the association's")
+	mapProvider = pkgMap.Flags.String("provider", "", "repository provider, if it differs from the association's")
+	mapVCS      = pkgMap.Flags.String("vcs", "", "version control system, if it differs from the provider's")
+	mapHidden   = pkgMap.Flags.Bool("hidden", false, "leave the package out of the sitemap")
+	mapPrivate  = pkgMap.Flags.Bool("private", false, "serve the package only to authenticated clients")
+	mapDisabled = pkgMap.Flags.Bool("disabled", false, "serve nothing for the package")
+)
+
+var domainCommands = []*subcommand{domainAdd, domainVerify, domainList, domainRemove}
+
+var pkgCommands = []*subcommand{pkgMap, pkgUnmap, pkgShow}
+
+// backend flags, accepted by every subcommand.
+var (
+	backendStore    string
+	backendAPI      string
+	backendToken    string
+	backendAuditLog string
+	outputJSON      bool
+)
+
+func backendFlags(flags *flag.FlagSet) {
+	flags.StringVar(&backendStore, "store", envString("GOPHERPATH_STORE", ""),
+		"association store file ($GOPHERPATH_STORE)")
+	flags.StringVar(&backendAPI, "api", envString("GOPHERPATH_API", ""),
+		"URL of a server whose admin api is used instead of a store file ($GOPHERPATH_API)")
+	flags.StringVar(&backendToken, "token", envString("GOPHERPATH_TOKEN", ""),
+		"bearer token for the admin api ($GOPHERPATH_TOKEN)")
+	flags.StringVar(&backendAuditLog, "audit-log", envString("GOPHERPATH_AUDIT_LOG", ""),
+		"audit log file recording changes of a store file ($GOPHERPATH_AUDIT_LOG)")
+	flags.BoolVar(&outputJSON, "json", false, "print JSON instead of a table")
+}
+
+func init() {
+	cmdDomain.Run = runSubcommand(domainCommands)
+	cmdPkg.Run = runSubcommand(pkgCommands)
+	cmdResolve.Run = runResolve
+	domainAdd.Run = runDomainAdd
+	domainVerify.Run = runDomainVerify
+	domainList.Run = runDomainList
+	domainRemove.Run = runDomainRemove
+	pkgMap.Run = runPkgMap
+	pkgUnmap.Run = runPkgUnmap
+	pkgShow.Run = runPkgShow
+	for _, cmd := range []*command{cmdDomain, cmdPkg, cmdResolve} {
+		backendFlags(cmd.Flags)
+	}
+	for _, sub := range append(domainCommands, pkgCommands...) {
+		backendFlags(sub.Flags)
+	}
+	commands = append(commands, cmdDomain, cmdPkg, cmdResolve)
+}
+
+// runSubcommand returns the Run function of a command dispatching to subs.
+// Flags are accepted both before and after the subcommand name.
+func runSubcommand(subs []*subcommand) func(cmd *command, args []string) error {
+	return func(cmd *command, args []string) error {
+		if len(args) == 0 {
+			subcommandUsage(cmd, subs)
+		}
+		var sub *subcommand
+		for _, s := range subs {
+			if s.Name == args[0] {
+				sub = s
+			}
+		}
+		if sub == nil {
+			log.Printf("unknown %s command %q", cmd.Name, args[0])
+			subcommandUsage(cmd, subs)
+		}
+		usage := func() {
+			fmt.Fprintf(os.Stderr, "usage: gopherpath %s %s %s\n\n%s.\n\n", cmd.Name, sub.Name, sub.Usage, sub.Short)
+			sub.Flags.PrintDefaults()
+			os.Exit(2)
+		}
+		sub.Flags.Usage = usage
+		sub.Flags.Parse(args[1:])
+		b, err := openBackend(cmd.Name + " " + sub.Name)
+		if err != nil {
+			return err
+		}
+		err = sub.Run(b, sub.Flags.Args())
+		if err == errUsage {
+			usage()
+		}
+		return err
+	}
+}
+
+func subcommandUsage(cmd *command, subs []*subcommand) {
+	fmt.Fprintf(os.Stderr, "usage: gopherpath %s %s\n\n%s.\n\ncommands:\n", cmd.Name, cmd.Usage, cmd.Short)
+	for _, sub := range subs {
+		fmt.Fprintf(os.Stderr, "\t%-10s %s\n", sub.Name, sub.Short)
+	}
+	os.Exit(2)
+}
+
+// errUsage is returned by a subcommand given invalid arguments.
+var errUsage = fmt.Errorf("invalid arguments")
+
+// backend is the store managed by a command.
+type backend interface {
+	gipspot.AssocStore
+
+	// Verify checks the verification challenges of the association
+	// identified by key and stores it as verified if they hold.
+	Verify(c gipspot.Context, key string) (*gipspot.DomainAssoc, error)
+}
+
+// fileBackend is a backend for a store file, which verifies domains itself.
+type fileBackend struct {
+	gipspot.AssocStore
+	verifier gipspot.Verifier
+}
+
+func (b *fileBackend) Verify(c gipspot.Context, key string) (*gipspot.DomainAssoc, error) {
+	assoc, err := b.GetDomainAssoc(c, key)
+	if err != nil {
+		return nil, err
+	}
+	err = b.verifier.Verify(c, assoc)
+	if err == nil {
+		err = b.PutDomainAssoc(c, assoc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return assoc, nil
+}
+
+// openBackend returns the backend named by the backend flags.  Changes made
+// to a store file are validated like those made through the admin API and
+// recorded in the audit log as made by actor.
+func openBackend(actor string) (backend, error) {
+	switch {
+	case backendAPI != "" && backendStore != "":
+		return nil, fmt.Errorf("-api and -store are exclusive")
+	case backendAPI != "":
+		return &gipspot.AdminClient{URL: backendAPI, Token: backendToken}, nil
+	case backendStore == "":
+		return nil, fmt.Errorf("a store file (-store) or server (-api) is required")
+	}
+	store, err := gipspot.OpenFileStore(backendStore)
+	if err != nil {
+		return nil, err
+	}
+	audit, err := openAuditLog(backendAuditLog)
+	if err != nil {
+		return nil, err
+	}
+	return &fileBackend{AssocStore: gipspot.Audited(gipspot.Validated(store), audit, actor)}, nil
+}
+
+var cliContext = gipspot.LogContext(log.New(os.Stderr, "", 0))
+
+func runDomainAdd(b backend, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	assoc := &gipspot.DomainAssoc{AliasOf: *addAliasOf, Provider: *addProvider}
+	assoc.Domain = args[0]
+	if i := strings.Index(args[0], "/"); i >= 0 {
+		assoc.Domain, assoc.Prefix = args[0][:i], strings.Trim(args[0][i+1:], "/")
+	}
+	if len(args) == 2 {
+		assoc.GitHubLogin = args[1]
+	}
+	if _, ok := b.(*fileBackend); !ok && *addVerified {
+		return fmt.Errorf("-verified requires a store file")
+	}
+	if *addVerified {
+		domain, err := gipspot.NormalizeHost(assoc.Domain)
+		if err != nil {
+			return err
+		}
+		assoc.Verified = time.Now()
+		assoc.VerifiedDomain = domain
+	} else {
+		token, err := gipspot.NewVerifyToken()
+		if err != nil {
+			return err
+		}
+		assoc.VerifyToken = token
+	}
+	err := b.PutDomainAssoc(cliContext, assoc)
+	if err != nil {
+		return err
+	}
+	if outputJSON {
+		return printJSON(assoc)
+	}
+	fmt.Printf("created association %s for %s\n", assoc.Key, assoc.Path())
+	if !assoc.IsVerified() {
+		domain := strings.TrimPrefix(assoc.Domain, "*.")
+		fmt.Printf("\nverify ownership of %s by publishing the DNS TXT record\n\n\t%s%s. TXT %q\n\n",
+			domain, gipspot.VerifyTXTPrefix, domain, gipspot.VerifyTXTValue(assoc.VerifyToken))
+		fmt.Printf("or serving the following content at http://%s%s\n\n\t%s\n\n",
+			domain, gipspot.VerifyPath, assoc.VerifyToken)
+		fmt.Printf("then run \"gopherpath domain verify %s\"\n", assoc.Path())
+	}
+	return nil
+}
+
+func runDomainVerify(b backend, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	assoc, err := gipspot.GetAssocByPath(cliContext, b, args[0])
+	if err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+	assoc, err = b.Verify(cliContext, assoc.Key)
+	if err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+	if outputJSON {
+		return printJSON(assoc)
+	}
+	fmt.Printf("verified ownership of %s\n", assoc.Domain)
+	return nil
+}
+
+func runDomainList(b backend, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	var assocs []gipspot.DomainAssoc
+	var err error
+	if *listLogin != "" {
+		assocs, err = b.GetDomainAssocsGitHubLogin(cliContext, *listLogin)
+	} else {
+		assocs, err = b.ListDomainAssocs(cliContext)
+	}
+	if err != nil {
+		return err
+	}
+	if assocs == nil {
+		assocs = []gipspot.DomainAssoc{}
+	}
+	if outputJSON {
+		return printJSON(assocs)
+	}
+	w := newTable("KEY", "PATH", "LOGIN", "PACKAGES", "STATUS", "ALIAS OF")
+	for _, assoc := range assocs {
+		status := "unverified"
+		switch {
+		case assoc.IsActive():
+			status = "active"
+		case assoc.IsVerified():
+			status = "inactive"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", assoc.Key, assoc.Path(), dash(assoc.GitHubLogin),
+			len(assoc.Packages), status, dash(assoc.AliasOf))
+	}
+	return w.Flush()
+}
+
+func runDomainRemove(b backend, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	assoc, err := gipspot.GetAssocByPath(cliContext, b, args[0])
+	if err == nil {
+		err = b.DeleteDomainAssoc(cliContext, assoc.Key)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+	if !outputJSON {
+		fmt.Printf("deleted association %s for %s\n", assoc.Key, assoc.Path())
+	}
+	return nil
+}
+
+// packageAssoc returns the association of the root package named by the
+// import path p, and the root of the package.
+func packageAssoc(b backend, p string) (*gipspot.DomainAssoc, string, error) {
+	p = strings.Trim(p, "/")
+	if !strings.Contains(p, "/") {
+		return nil, "", fmt.Errorf("%s: not a package import path", p)
+	}
+	assoc, err := gipspot.GetAssocByPath(cliContext, b, path.Dir(p))
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %v", path.Dir(p), err)
+	}
+	return assoc, path.Base(p), nil
+}
+
+// modifyPackages applies fn to the association of the root package named by
+// p, retrying if the association changes before it is stored.
+func modifyPackages(b backend, p string, fn func(assoc *gipspot.DomainAssoc, root string) error) (*gipspot.DomainAssoc, string, error) {
+	for attempt := 0; ; attempt++ {
+		assoc, root, err := packageAssoc(b, p)
+		if err != nil {
+			return nil, "", err
+		}
+		err = fn(assoc, root)
+		if err == nil {
+			err = b.PutDomainAssoc(cliContext, assoc)
+		}
+		if err == gipspot.ErrConflict && attempt < 3 {
+			continue
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %v", p, err)
+		}
+		return assoc, root, nil
+	}
+}
+
+func runPkgMap(b backend, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	assoc, root, err := modifyPackages(b, args[0], func(assoc *gipspot.DomainAssoc, root string) error {
+		pkg := gipspot.Package{
+			Root:     root,
+			Repo:     *mapRepo,
+			Subdir:   *mapSubdir,
+			Owner:    *mapOwner,
+			Provider: *mapProvider,
+			VCS:      *mapVCS,
+			Hidden:   *mapHidden,
+			Private:  *mapPrivate,
+			Disabled: *mapDisabled,
+			Modified: time.Now(),
+		}
+		if p := assoc.Package(root); p != nil {
+			*p = pkg
+			return nil
+		}
+		assoc.Packages = append(assoc.Packages, pkg)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	pkg := assoc.Package(root)
+	if outputJSON {
+		return printJSON(pkg)
+	}
+	return printPackages(assoc, *pkg)
+}
+
+func runPkgUnmap(b backend, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	_, root, err := modifyPackages(b, args[0], func(assoc *gipspot.DomainAssoc, root string) error {
+		for i := range assoc.Packages {
+			if assoc.Packages[i].Root == root {
+				assoc.Packages = append(assoc.Packages[:i], assoc.Packages[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("no package %s", root)
+	})
+	if err != nil {
+		return err
+	}
+	if !outputJSON {
+		fmt.Printf("deleted package %s\n", root)
+	}
+	return nil
+}
+
+func runPkgShow(b backend, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	assoc, err := gipspot.GetAssocByPath(cliContext, b, args[0])
+	if err == nil {
+		return printPackages(assoc, assoc.Packages...)
+	}
+	if err != gipspot.ErrNoSuchAssoc {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+	assoc, root, err := packageAssoc(b, args[0])
+	if err != nil {
+		return err
+	}
+	pkg := assoc.Package(root)
+	if pkg == nil {
+		return fmt.Errorf("%s: no package %s", args[0], root)
+	}
+	if outputJSON {
+		return printJSON(pkg)
+	}
+	return printPackages(assoc, *pkg)
+}
+
+// printPackages prints pkgs, mapped by assoc, as a table or JSON array.
+func printPackages(assoc *gipspot.DomainAssoc, pkgs ...gipspot.Package) error {
+	if pkgs == nil {
+		pkgs = []gipspot.Package{}
+	}
+	if outputJSON {
+		return printJSON(pkgs)
+	}
+	w := newTable("PACKAGE", "REPO", "SUBDIR", "OWNER", "PROVIDER", "FLAGS")
+	for _, pkg := range pkgs {
+		var flags []string
+		for _, f := range []struct {
+			name string
+			set  bool
+		}{{"hidden", pkg.Hidden}, {"private", pkg.Private}, {"disabled", pkg.Disabled}} {
+			if f.set {
+				flags = append(flags, f.name)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", path.Join(assoc.Path(), pkg.Root), dash(pkg.Repo),
+			dash(pkg.Subdir), dash(pkg.Owner), dash(pkg.Provider), dash(strings.Join(flags, ",")))
+	}
+	return w.Flush()
+}
+
+func runResolve(cmd *command, args []string) error {
+	if len(args) != 1 {
+		cmd.usage()
+	}
+	b, err := openBackend("resolve")
+	if err != nil {
+		return err
+	}
+	p := strings.Trim(args[0], "/")
+	host, reqpath := p, "/"
+	if i := strings.Index(p, "/"); i >= 0 {
+		host, reqpath = p[:i], p[i:]
+	}
+	host, err = gipspot.NormalizeHost(host)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", "http://"+host+reqpath+"?go-get=1", nil)
+	if err != nil {
+		return err
+	}
+	server := &gipspot.Server{
+		NewContext: func(req *http.Request) gipspot.Context { return cliContext },
+		Store:      b,
+	}
+	metas, err := server.ImportMetas(req)
+	if err != nil {
+		return fmt.Errorf("%s: %v", p, err)
+	}
+	if outputJSON {
+		return printJSON(metas)
+	}
+	w := newTable("ROOT", "VCS", "REPO", "SUBDIR", "CANONICAL")
+	for _, meta := range metas {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", meta.RootPkg, meta.VCS, meta.Repo, dash(meta.Subdir), dash(meta.Canonical))
+	}
+	return w.Flush()
+}
+
+// newTable returns a writer aligning tab separated columns of standard
+// output, with a header line of columns.
+func newTable(columns ...string) *tabwriter.Writer {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(columns, "\t"))
+	return w
+}
+
+// dash returns s, or "-" if it is empty, so table cells are never blank.
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func printJSON(v interface{}) error {
+	p, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(p, '\n'))
+	return err
+}
@@ -0,0 +1,80 @@
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"gipspot"
+
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+var cmdMigrate = &command{
+	Name:  "migrate",
+	Usage: "[-n] [-from key] [-limit n] [-audit-log file] store.json",
+	Short: "upgrade the associations of a store file to the current schema",
+	Flags: flag.NewFlagSet("migrate", flag.ExitOnError),
+}
+
+var (
+	migrateDryRun   = cmdMigrate.Flags.Bool("n", false, "count the associations to upgrade without writing them")
+	migrateFrom     = cmdMigrate.Flags.String("from", "", "resume a migration with the association with this key")
+	migrateLimit    = cmdMigrate.Flags.Int("limit", 0, "most associations to upgrade; all if 0")
+	migrateAuditLog = cmdMigrate.Flags.String("audit-log", envString("GOPHERPATH_AUDIT_LOG", ""), "audit log file recording changes ($GOPHERPATH_AUDIT_LOG)")
+)
+
+func init() {
+	cmdMigrate.Run = runMigrate
+	commands = append(commands, cmdMigrate)
+}
+
+func runMigrate(cmd *command, args []string) error {
+	if len(args) != 1 {
+		cmd.usage()
+	}
+	store, err := gipspot.OpenFileStore(args[0])
+	if err != nil {
+		return err
+	}
+	audit, err := openAuditLog(*migrateAuditLog)
+	if err != nil {
+		return err
+	}
+	ctx := gipspot.LogContext(log.New(os.Stderr, "", 0))
+	migrated := 0
+	opts := gipspot.MigrateOptions{
+		From:   *migrateFrom,
+		Limit:  *migrateLimit,
+		DryRun: *migrateDryRun,
+		Progress: func(p *gipspot.MigrateProgress) {
+			if p.Migrated != migrated {
+				migrated = p.Migrated
+				fmt.Fprintf(os.Stderr, "checked %d of %d associations, %d upgraded\n", p.Checked, p.Total, p.Migrated)
+			}
+		},
+	}
+	p, err := gipspot.Migrate(ctx, gipspot.Audited(store, audit, "migrate"), opts)
+	if p != nil {
+		for _, failed := range p.Failed {
+			fmt.Printf("failed: %s\n", failed)
+		}
+		verb := "upgraded"
+		if *migrateDryRun {
+			verb = "to upgrade"
+		}
+		fmt.Printf("%d of %d associations %s to schema %d\n", p.Migrated, p.Total, verb, gipspot.SchemaVersion)
+		if p.Next != "" {
+			fmt.Printf("resume with -from %s\n", p.Next)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if p.Next == "" && len(p.Failed) > 0 {
+		return fmt.Errorf("%d associations could not be upgraded", len(p.Failed))
+	}
+	return nil
+}
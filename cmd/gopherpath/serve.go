@@ -0,0 +1,273 @@
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"gipspot"
+	"importmeta"
+
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var cmdServe = &command{
+	Name:  "serve",
+	Usage: "[-http addr] [-store file] [-audit-log file] [-assoc domain=login,...] [-admin-tokens user=token,...] [-client-tokens user=token,...] [-session-key key] [-check-repos] [-trusted-proxies cidr,...] [-ip-rate r] [-ip-burst n] [-host-rate r] [-host-burst n] [-rate-allowlist cidr,...] [-shutdown-timeout d]",
+	Short: "serve import metadata over http",
+	Flags: flag.NewFlagSet("serve", flag.ExitOnError),
+}
+
+var (
+	serveHTTP = cmdServe.Flags.String("http",
+		envString("GOPHERPATH_HTTP", ":8080"),
+		"listen address ($GOPHERPATH_HTTP)")
+	serveStore = cmdServe.Flags.String("store",
+		envString("GOPHERPATH_STORE", ""),
+		"association store file; associations are kept in memory if empty ($GOPHERPATH_STORE)")
+	serveAuditLog = cmdServe.Flags.String("audit-log",
+		envString("GOPHERPATH_AUDIT_LOG", ""),
+		"file to which changes of associations are appended as JSON lines; changes are not audited if empty ($GOPHERPATH_AUDIT_LOG)")
+	serveAssocs = cmdServe.Flags.String("assoc",
+		envString("GOPHERPATH_ASSOCS", ""),
+		"comma separated domain=login associations added to the store ($GOPHERPATH_ASSOCS)")
+	serveAdminTokens = cmdServe.Flags.String("admin-tokens",
+		envString("GOPHERPATH_ADMIN_TOKENS", ""),
+		"comma separated user=token bearer tokens for the admin api ($GOPHERPATH_ADMIN_TOKENS)")
+	serveClientTokens = cmdServe.Flags.String("client-tokens",
+		envString("GOPHERPATH_CLIENT_TOKENS", ""),
+		"comma separated user=token credentials of clients of private packages ($GOPHERPATH_CLIENT_TOKENS)")
+	serveSessionKey = cmdServe.Flags.String("session-key",
+		envString("GOPHERPATH_SESSION_KEY", ""),
+		"key signing console sessions; sessions end on restart if empty ($GOPHERPATH_SESSION_KEY)")
+	serveCheckRepos = cmdServe.Flags.Bool("check-repos",
+		envBool("GOPHERPATH_CHECK_REPOS", false),
+		"serve metadata only for repositories the provider's api reports to exist ($GOPHERPATH_CHECK_REPOS)")
+	serveTrustedProxies = cmdServe.Flags.String("trusted-proxies",
+		envString("GOPHERPATH_TRUSTED_PROXIES", ""),
+		"comma separated networks of proxies whose X-Forwarded-Host header is honored ($GOPHERPATH_TRUSTED_PROXIES)")
+	serveIPRate = cmdServe.Flags.Float64("ip-rate",
+		envFloat("GOPHERPATH_IP_RATE", 10),
+		"requests per second served to a client address; unlimited if 0 ($GOPHERPATH_IP_RATE)")
+	serveIPBurst = cmdServe.Flags.Int("ip-burst",
+		envInt("GOPHERPATH_IP_BURST", 100),
+		"requests a client address may make at once ($GOPHERPATH_IP_BURST)")
+	serveHostRate = cmdServe.Flags.Float64("host-rate",
+		envFloat("GOPHERPATH_HOST_RATE", 100),
+		"requests per second served for a host; unlimited if 0 ($GOPHERPATH_HOST_RATE)")
+	serveHostBurst = cmdServe.Flags.Int("host-burst",
+		envInt("GOPHERPATH_HOST_BURST", 1000),
+		"requests which may be made for a host at once ($GOPHERPATH_HOST_BURST)")
+	serveRateAllowlist = cmdServe.Flags.String("rate-allowlist",
+		envString("GOPHERPATH_RATE_ALLOWLIST", ""),
+		"comma separated networks of clients which are never rate limited, such as CI runners ($GOPHERPATH_RATE_ALLOWLIST)")
+	serveShutdownTimeout = cmdServe.Flags.Duration("shutdown-timeout",
+		envDuration("GOPHERPATH_SHUTDOWN_TIMEOUT", 10*time.Second),
+		"time allowed for requests to finish on shutdown ($GOPHERPATH_SHUTDOWN_TIMEOUT)")
+)
+
+func init() {
+	cmdServe.Run = runServe
+	commands = append(commands, cmdServe)
+}
+
+func runServe(cmd *command, args []string) error {
+	if len(args) != 0 {
+		cmd.usage()
+	}
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	importmeta.Logger = importmetaLogger{logger}
+	ctx := gipspot.LogContext(logger)
+
+	store, err := openStore(*serveStore)
+	if err != nil {
+		return err
+	}
+	audit, err := openAuditLog(*serveAuditLog)
+	if err != nil {
+		return err
+	}
+	err = addAssocs(ctx, gipspot.Audited(store, audit, "serve -assoc"), *serveAssocs)
+	if err != nil {
+		return err
+	}
+
+	server := &gipspot.Server{
+		NewContext: func(req *http.Request) gipspot.Context {
+			return ctx
+		},
+		Store:      store,
+		Audit:      audit,
+		SessionKey: []byte(*serveSessionKey),
+	}
+	server.TrustedProxies, err = gipspot.ParseNetworks(*serveTrustedProxies)
+	if err != nil {
+		return fmt.Errorf("-trusted-proxies: %v", err)
+	}
+	server.RateLimit = &gipspot.RateLimiter{
+		PerIP:   gipspot.Rate{PerSecond: *serveIPRate, Burst: *serveIPBurst},
+		PerHost: gipspot.Rate{PerSecond: *serveHostRate, Burst: *serveHostBurst},
+	}
+	server.RateLimit.Allowlist, err = gipspot.ParseNetworks(*serveRateAllowlist)
+	if err != nil {
+		return fmt.Errorf("-rate-allowlist: %v", err)
+	}
+	needsSetup, err := gipspot.NeedsSetup(ctx, store)
+	if err != nil {
+		return err
+	}
+	if needsSetup {
+		// the token is only printed here, for whoever started the server.
+		server.SetupToken, err = gipspot.NewVerifyToken()
+		if err != nil {
+			return err
+		}
+		logger.Printf("no verified associations. set up gopherpath at http://<your domain>%s with the setup token %s",
+			gipspot.SetupPath, server.SetupToken)
+	}
+	if *serveCheckRepos {
+		server.RepoChecker = new(gipspot.RepoChecker)
+	}
+	if *serveAdminTokens != "" {
+		tokens, err := parseTokens(*serveAdminTokens)
+		if err != nil {
+			return err
+		}
+		server.Authenticate = gipspot.BearerTokens(tokens)
+		server.ConsoleLogin = gipspot.TokenLogin(tokens)
+	}
+	if *serveClientTokens != "" {
+		tokens, err := parseTokens(*serveClientTokens)
+		if err != nil {
+			return err
+		}
+		server.ClientAuth = gipspot.ClientTokens(tokens)
+	}
+	return listenAndServe(logger, *serveHTTP, server, *serveShutdownTimeout)
+}
+
+// listenAndServe serves handler on addr until the process receives SIGINT or
+// SIGTERM.  Requests in progress are given timeout to complete.
+func listenAndServe(logger *log.Logger, addr string, handler http.Handler, timeout time.Duration) error {
+	srv := &http.Server{
+		Addr:     addr,
+		Handler:  handler,
+		ErrorLog: logger,
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	errc := make(chan error, 1)
+	go func() {
+		logger.Printf("listening on %s", addr)
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case s := <-sig:
+		logger.Printf("received %v, shutting down", s)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		return fmt.Errorf("shutdown: %v", err)
+	}
+	return nil
+}
+
+// openStore opens the file store at path, or a memory store if path is
+// empty.
+func openStore(path string) (gipspot.AssocStore, error) {
+	if path == "" {
+		return gipspot.NewMemStore(), nil
+	}
+	return gipspot.OpenFileStore(path)
+}
+
+// openAuditLog opens the audit log file at path, or returns nil if path is
+// empty.
+func openAuditLog(path string) (gipspot.AuditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return gipspot.OpenFileAuditLog(path)
+}
+
+// addAssocs adds associations given as a comma separated list of
+// domain=login pairs to store.  Domains which already have an association
+// are left alone.  The operator vouches for these domains so they are marked
+// verified.
+func addAssocs(c gipspot.Context, store gipspot.AssocStore, s string) error {
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("invalid association %q (expected domain=login)", pair)
+		}
+		domain, err := gipspot.NormalizeHost(kv[0])
+		if err != nil {
+			return err
+		}
+		kv[0] = domain
+		assocs, err := store.GetDomainAssocs(c, kv[0])
+		if err != nil {
+			return err
+		}
+		if len(assocs) > 0 {
+			continue
+		}
+		err = store.PutDomainAssoc(c, &gipspot.DomainAssoc{
+			Domain:         kv[0],
+			GitHubLogin:    kv[1],
+			Verified:       time.Now(),
+			VerifiedDomain: kv[0],
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseTokens parses a comma separated list of user=token pairs into a
+// map from token to user.
+func parseTokens(s string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid token for %q (expected user=token)", kv[0])
+		}
+		tokens[kv[1]] = kv[0]
+	}
+	return tokens, nil
+}
+
+// importmetaLogger adapts a log.Logger to importmeta.Logger.
+type importmetaLogger struct {
+	logger *log.Logger
+}
+
+func (l importmetaLogger) Log(msg string) {
+	l.logger.Print(msg)
+}
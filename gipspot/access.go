@@ -0,0 +1,260 @@
+package gipspot
+
+import (
+	"importmeta"
+
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// AccessToken is a credential issued by an association to a client, such as
+// a CI system, which lets it resolve the association's private packages, or
+// all of its packages if the association requires credentials.  Only a hash
+// of the token is stored.  The token itself is returned once when it is
+// issued.
+type AccessToken struct {
+	ID      string    `json:"id"`                        // identifies the token in access logs and the admin API
+	Name    string    `json:"name"`                      // holder of the token (e.g. "ci")
+	Hash    string    `json:"hash" datastore:",noindex"` // hex sha-256 of the token
+	Scope   string    `json:"scope,omitempty"`           // space separated paths beneath the association the token may resolve; all if empty
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"` // the token is rejected from this time; never if zero
+	Revoked time.Time `json:"revoked"` // the time the token was revoked; zero unless revoked
+}
+
+// NewAccessToken returns a token for name with the given scope and expiry
+// and the secret to give its holder.
+func NewAccessToken(name, scope string, expires time.Time) (*AccessToken, string, error) {
+	id, err := NewVerifyToken()
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := NewVerifyToken()
+	if err != nil {
+		return nil, "", err
+	}
+	tok := &AccessToken{
+		ID:      id[:12],
+		Name:    name,
+		Hash:    hashAccessToken(secret),
+		Scope:   strings.Join(strings.Fields(scope), " "),
+		Created: time.Now(),
+		Expires: expires,
+	}
+	return tok, secret, nil
+}
+
+func hashAccessToken(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// Token returns the token of assoc with the given id, or nil if there is no
+// such token.
+func (assoc *DomainAssoc) Token(id string) *AccessToken {
+	for i := range assoc.Tokens {
+		if assoc.Tokens[i].ID == id {
+			return &assoc.Tokens[i]
+		}
+	}
+	return nil
+}
+
+// revokeToken revokes the token of assoc with the given id.  Revoking a
+// revoked token has no effect.
+func revokeToken(assoc *DomainAssoc, id string) error {
+	tok := assoc.Token(id)
+	if tok == nil {
+		return errNoSuchToken
+	}
+	if tok.Revoked.IsZero() {
+		tok.Revoked = time.Now()
+	}
+	return nil
+}
+
+// IsValid returns true if tok is neither expired nor revoked at time t.
+func (tok *AccessToken) IsValid(t time.Time) bool {
+	return tok.Revoked.IsZero() && (tok.Expires.IsZero() || t.Before(tok.Expires))
+}
+
+// allows returns true if the scope of tok contains rel, a path beneath the
+// prefix of its association.
+func (tok *AccessToken) allows(rel string) bool {
+	if tok.Scope == "" {
+		return true
+	}
+	for _, p := range strings.Fields(tok.Scope) {
+		if rel == p || strings.HasPrefix(rel, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// validateToken returns a *ValidationError if tok is invalid.
+func validateToken(tok *AccessToken) error {
+	if tok.ID == "" || strings.ContainsAny(tok.ID, "/ ") {
+		return &ValidationError{"id", fmt.Sprintf("invalid token id %q", tok.ID)}
+	}
+	if len(tok.Hash) != 2*sha256.Size {
+		return &ValidationError{"hash", fmt.Sprintf("invalid hash for token %q", tok.ID)}
+	}
+	for _, p := range strings.Fields(tok.Scope) {
+		if path.IsAbs(p) || path.Clean(p) != p || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+			return &ValidationError{"scope", fmt.Sprintf("invalid path %q in the scope of token %q", p, tok.ID)}
+		}
+	}
+	return nil
+}
+
+// requestToken returns the token presented by req as a bearer token or the
+// password of basic authentication.
+func requestToken(req *http.Request) string {
+	if _, password, ok := req.BasicAuth(); ok {
+		return password
+	}
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return ""
+}
+
+// matchToken returns the token of assoc matching secret, valid or not, or
+// nil if none does.
+func (assoc *DomainAssoc) matchToken(secret string) *AccessToken {
+	if secret == "" {
+		return nil
+	}
+	hash := []byte(hashAccessToken(secret))
+	for i := range assoc.Tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(assoc.Tokens[i].Hash)) == 1 {
+			return &assoc.Tokens[i]
+		}
+	}
+	return nil
+}
+
+// AccessRecord describes a resolution of a package requiring credentials.
+type AccessRecord struct {
+	Time    time.Time `json:"time"`
+	Assoc   string    `json:"assoc"`             // key of the association
+	Package string    `json:"package"`           // import path of the root package
+	Path    string    `json:"path"`              // requested import path
+	Client  string    `json:"client,omitempty"`  // name of the token holder or user identified by ClientAuth
+	TokenID string    `json:"tokenID,omitempty"` // id of the token presented
+	Remote  string    `json:"remote"`            // address of the client
+	Allowed bool      `json:"allowed"`
+	Reason  string    `json:"reason,omitempty"` // why access was denied
+}
+
+// String returns rec as a line for a log.
+func (rec *AccessRecord) String() string {
+	result := "allowed"
+	if !rec.Allowed {
+		result = "denied (" + rec.Reason + ")"
+	}
+	client := rec.Client
+	if client == "" {
+		client = "anonymous"
+	}
+	if rec.TokenID != "" {
+		client += " token " + rec.TokenID
+	}
+	return fmt.Sprintf("access %s: %s by %s from %s", result, rec.Path, client, rec.Remote)
+}
+
+// Authorize checks the credentials of requests for the packages of an
+// association which requires credentials.  It returns importmeta.ErrNotFound,
+// as ImportMetas does for a package which isn't served, if the request may
+// not resolve the package.  importmeta.Handler authorizes requests before
+// looking up their metadata.  The private packages of other associations are
+// checked by ImportMetas, which serves clients without access the metadata
+// of an unregistered package of the same root.
+//
+// A client is allowed a valid, unexpired token of the association whose
+// scope contains the requested path, or credentials accepted by ClientAuth.
+// Every resolution checked is recorded with AccessLog.
+func (s *Server) Authorize(req *http.Request) error {
+	c := s.NewContext(req)
+	host := req.Host
+	assoc, err := lookupDomainAssoc(c, s.Store, host, req.URL.Path)
+	if err != nil {
+		// ImportMetas reports the error.
+		return nil
+	}
+	assoc, err = s.serving(c, assoc, host)
+	if err != nil || !assoc.RequireToken {
+		return nil
+	}
+	pkg, err := assoc.servedPackage(req.URL.Path)
+	if err != nil {
+		return nil
+	}
+	if !s.allowed(c, req, assoc, pkg) {
+		return importmeta.ErrNotFound
+	}
+	return nil
+}
+
+// allowed returns true if req may resolve pkg of assoc, recording the
+// resolution with AccessLog.
+func (s *Server) allowed(c Context, req *http.Request, assoc *DomainAssoc, pkg *Package) bool {
+	rec := &AccessRecord{
+		Time:    time.Now(),
+		Assoc:   assoc.Key,
+		Package: path.Join(assoc.Path(), pkg.Root),
+		Path:    path.Join(req.Host, req.URL.Path),
+		Remote:  req.RemoteAddr,
+	}
+	s.authorize(req, assoc, rec)
+	s.logAccess(c, rec)
+	return rec.Allowed
+}
+
+// authorize decides rec for the request req for a package of assoc.
+func (s *Server) authorize(req *http.Request, assoc *DomainAssoc, rec *AccessRecord) {
+	if tok := assoc.matchToken(requestToken(req)); tok != nil {
+		rec.Client, rec.TokenID = tok.Name, tok.ID
+		switch {
+		case !tok.Revoked.IsZero():
+			rec.Reason = "token revoked"
+		case !tok.IsValid(rec.Time):
+			rec.Reason = "token expired"
+		case !tok.allows(assoc.relPath(req.URL.Path)):
+			rec.Reason = "path out of the token's scope"
+		default:
+			rec.Allowed = true
+		}
+		return
+	}
+	if s.ClientAuth == nil {
+		rec.Reason = "no credentials"
+		if requestToken(req) != "" {
+			rec.Reason = "unknown token"
+		}
+		return
+	}
+	user, err := s.ClientAuth(req)
+	if err != nil {
+		rec.Reason = err.Error()
+		return
+	}
+	rec.Client = user
+	rec.Allowed = true
+}
+
+func (s *Server) logAccess(c Context, rec *AccessRecord) {
+	if s.AccessLog != nil {
+		s.AccessLog(c, rec)
+		return
+	}
+	c.Infof("%v", rec)
+}
@@ -0,0 +1,114 @@
+package gipspot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAccessTokens(t *testing.T) {
+	s := testServer(verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo", RequireToken: true}))
+	s.Authenticate = BearerTokens(map[string]string{"s3cret": "admin"})
+	var records []*AccessRecord
+	s.AccessLog = func(c Context, rec *AccessRecord) { records = append(records, rec) }
+
+	issue := func(body string) string {
+		resp := apiRequest(s, "POST", "/assocs/1/tokens", body)
+		if resp.Code != http.StatusCreated {
+			t.Fatalf("issue: %d %q", resp.Code, resp.Body.String())
+		}
+		var issued issuedToken
+		decodeAPI(t, resp, &issued)
+		if issued.Secret == "" || issued.Token.Hash == issued.Secret || issued.Token.Hash == "" {
+			t.Fatalf("unexpected issued token: %q", resp.Body.String())
+		}
+		return issued.Secret
+	}
+	all := issue(`{"name": "ci"}`)
+	scoped := issue(`{"name": "bot", "scope": "bar baz/qux"}`)
+	expired := issue(`{"name": "old", "expires": "2014-01-01T00:00:00Z"}`)
+	revoked := issue(`{"name": "gone"}`)
+	assoc, _ := s.Store.GetDomainAssoc(testContext, "1")
+	if resp := apiRequest(s, "DELETE", "/assocs/1/tokens/"+assoc.Tokens[3].ID, ""); resp.Code != http.StatusNoContent {
+		t.Fatalf("revoke: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp := apiRequest(s, "DELETE", "/assocs/1/tokens/nope", ""); resp.Code != http.StatusNotFound {
+		t.Errorf("revoked a missing token: %d", resp.Code)
+	}
+
+	// tokens can't be changed by updating the association.
+	resp := apiRequest(s, "PUT", "/assocs/1", `{"domain": "foo.io", "githubLogin": "mcfoo", "requireToken": true, "revision": 6, "tokens": []}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("update: %d %q", resp.Code, resp.Body.String())
+	}
+	if assoc, _ := s.Store.GetDomainAssoc(testContext, "1"); len(assoc.Tokens) != 4 {
+		t.Errorf("tokens changed by an update: %#v", assoc.Tokens)
+	}
+
+	for i, test := range []struct {
+		path    string
+		token   string
+		allowed bool
+		reason  string
+	}{
+		{"/bar", "", false, "no credentials"},
+		{"/bar", "guess", false, "unknown token"},
+		{"/bar/x", all, true, ""},
+		{"/bar/x", scoped, true, ""},
+		{"/baz/qux/x", scoped, true, ""},
+		{"/baz", scoped, false, "path out of the token's scope"},
+		{"/barn", scoped, false, "path out of the token's scope"},
+		{"/bar", expired, false, "token expired"},
+		{"/bar", revoked, false, "token revoked"},
+	} {
+		records = nil
+		req, _ := http.NewRequest("GET", "http://foo.io"+test.path+"?go-get=1", nil)
+		if test.token != "" {
+			req.SetBasicAuth("anyone", test.token)
+		}
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		if test.allowed != (resp.Code == http.StatusOK) {
+			t.Errorf("test %d: unexpected response: %d %q", i, resp.Code, resp.Body.String())
+		}
+		if !test.allowed && resp.Body.String() != "unrecognized package\n" {
+			t.Errorf("test %d: denial distinguishable from a missing package: %q", i, resp.Body.String())
+		}
+		if len(records) != 1 || records[0].Allowed != test.allowed || records[0].Reason != test.reason {
+			t.Errorf("test %d: unexpected access records: %v", i, records)
+		}
+	}
+
+	// server wide client credentials are also accepted.
+	s.ClientAuth = ClientTokens(map[string]string{"t0ken": "ops"})
+	records = nil
+	req, _ := http.NewRequest("GET", "http://foo.io/bar?go-get=1", nil)
+	req.Header.Set("Authorization", "Bearer t0ken")
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK || len(records) != 1 || records[0].Client != "ops" {
+		t.Errorf("client credentials denied: %d %v", resp.Code, records)
+	}
+}
+
+func TestAccessTokenScope(t *testing.T) {
+	now := time.Now()
+	for i, test := range []struct {
+		tok   AccessToken
+		rel   string
+		valid bool
+		allow bool
+	}{
+		{AccessToken{}, "bar", true, true},
+		{AccessToken{Scope: "bar"}, "bar/baz", true, true},
+		{AccessToken{Scope: "bar/baz"}, "bar", true, false},
+		{AccessToken{Expires: now.Add(time.Hour)}, "bar", true, true},
+		{AccessToken{Expires: now}, "bar", false, true},
+		{AccessToken{Revoked: now}, "bar", false, true},
+	} {
+		if test.tok.IsValid(now) != test.valid || test.tok.allows(test.rel) != test.allow {
+			t.Errorf("test %d: unexpected validity or scope of %#v", i, test.tok)
+		}
+	}
+}
@@ -0,0 +1,897 @@
+package gipspot
+
+import (
+	"pat"
+
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminAPIPath is the path beneath which the JSON admin API is served.
+//
+//	GET    /_gopherpath/api/assocs                      list associations (?domain=, ?login=, ?aliasOf=)
+//	POST   /_gopherpath/api/assocs                      create an association
+//	GET    /_gopherpath/api/assocs/:key                 get an association
+//	PUT    /_gopherpath/api/assocs/:key                 update an association
+//	DELETE /_gopherpath/api/assocs/:key                 delete an association
+//	POST   /_gopherpath/api/assocs/:key/verify          check verification of an association
+//	GET    /_gopherpath/api/assocs/:key/packages        list package mappings
+//	GET    /_gopherpath/api/assocs/:key/packages/:root  get a package mapping
+//	PUT    /_gopherpath/api/assocs/:key/packages/:root  create or update a package mapping
+//	DELETE /_gopherpath/api/assocs/:key/packages/:root  delete a package mapping
+//	GET    /_gopherpath/api/assocs/:key/tokens          list access tokens
+//	POST   /_gopherpath/api/assocs/:key/tokens          issue an access token
+//	DELETE /_gopherpath/api/assocs/:key/tokens/:id      revoke an access token
+//	GET    /_gopherpath/api/assocs/:key/aliases         list the aliases of an association
+//	GET    /_gopherpath/api/conflicts                   list domains with conflicting associations
+//	POST   /_gopherpath/api/conflicts/resolve           merge conflicting associations (see ResolveConflicts)
+//	GET    /_gopherpath/api/audit                       query the audit log (see below)
+//	GET    /_gopherpath/api/backup                      export every association (see ExportBackup)
+//	POST   /_gopherpath/api/backup                      import a backup (?mode=merge|replace, ?dryRun=true; see ImportBackup)
+//	POST   /_gopherpath/api/migrate                     upgrade stored associations (?from=, ?limit=, ?dryRun=true; see Migrate)
+//	GET    /_gopherpath/api/metrics                     report request counters of this instance
+//
+// Requests other than GET and HEAD must have the content type
+// application/json, even if they have no body, and are rejected if their
+// Origin header names another host or port.  Browsers don't send such
+// requests across sites without asking, so credentials a browser sends by
+// itself, like the App Engine login cookie, can't be used by other sites to
+// make changes.
+//
+// Responses for a single association carry its Revision as an ETag.  Updates
+// are rejected with 409 Conflict unless the revision in the request body
+// matches the stored one, or with 412 Precondition Failed unless the revision
+// in an If-Match header does.  Invalid values are rejected with 422 and a
+// body naming the field at fault.  Creating an association for a domain which
+// already has one is rejected with 409 Conflict.
+//
+// Access tokens are only changed through their endpoints.  Issuing a token
+// takes {"name", "scope", "expires"} and the response holds the token, which
+// is not stored, as "secret" alongside the stored "token".
+//
+// The audit log is queried with the parameters assoc, path, package, actor,
+// since and until (RFC 3339 times) and limit, each optional.  Entries are
+// listed oldest first as a JSON array, or as JSON lines with format=jsonl.
+//
+// An alias is created like any association, with "aliasOf" naming the import
+// path of an existing association which is not an alias itself.
+//
+// A migration responds with its MigrateProgress.  Until "next" is empty it is
+// continued by passing "next" as the from parameter of another request.  A
+// migration stopped by an error responds with a 500 whose body is the
+// progress, with "error" set, so it can be resumed as well.
+const AdminAPIPath = "/_gopherpath/api"
+
+var (
+	errNoSuchPackage = fmt.Errorf("no such package")
+	errNoSuchToken   = fmt.Errorf("no such token")
+)
+
+// maxAdminBody limits the size of admin API request bodies, and
+// maxBackupBody that of imported backups.
+const (
+	maxAdminBody  = 1 << 20
+	maxBackupBody = 64 << 20
+)
+
+// Authenticator returns the identity of the user making req.  It returns an
+// error if req may not use the admin API.
+type Authenticator func(req *http.Request) (user string, err error)
+
+// ErrUnauthorized is returned by an Authenticator when req has no valid
+// credentials.
+var ErrUnauthorized = fmt.Errorf("unauthorized")
+
+// BearerTokens returns an Authenticator accepting requests with an
+// "Authorization: Bearer <token>" header for a key of tokens.  The value of
+// the token is the identity of the user.
+func BearerTokens(tokens map[string]string) Authenticator {
+	return func(req *http.Request) (string, error) {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return "", ErrUnauthorized
+		}
+		given := []byte(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+		for token, user := range tokens {
+			if subtle.ConstantTimeCompare(given, []byte(token)) == 1 {
+				return user, nil
+			}
+		}
+		return "", ErrUnauthorized
+	}
+}
+
+// apiError is the body of admin API error responses.
+type apiError struct {
+	Error string `json:"error"`
+	Field string `json:"field,omitempty"`
+}
+
+// adminHandler is an admin API endpoint.
+type adminHandler func(c Context, user string, resp http.ResponseWriter, req *http.Request)
+
+// adminAPI returns the handler for requests beneath AdminAPIPath.
+func (s *Server) adminAPI() http.Handler {
+	s.adminOnce.Do(func() {
+		m := pat.New()
+		m.Get(AdminAPIPath+"/assocs", s.admin(s.apiListAssocs))
+		m.Post(AdminAPIPath+"/assocs", s.admin(s.apiCreateAssoc))
+		m.Get(AdminAPIPath+"/assocs/:key", s.admin(s.apiGetAssoc))
+		m.Put(AdminAPIPath+"/assocs/:key", s.admin(s.apiUpdateAssoc))
+		m.Del(AdminAPIPath+"/assocs/:key", s.admin(s.apiDeleteAssoc))
+		m.Post(AdminAPIPath+"/assocs/:key/verify", s.admin(s.apiVerifyAssoc))
+		m.Get(AdminAPIPath+"/assocs/:key/packages", s.admin(s.apiListPackages))
+		m.Get(AdminAPIPath+"/assocs/:key/packages/:root", s.admin(s.apiGetPackage))
+		m.Put(AdminAPIPath+"/assocs/:key/packages/:root", s.admin(s.apiPutPackage))
+		m.Del(AdminAPIPath+"/assocs/:key/packages/:root", s.admin(s.apiDeletePackage))
+		m.Get(AdminAPIPath+"/assocs/:key/tokens", s.admin(s.apiListTokens))
+		m.Post(AdminAPIPath+"/assocs/:key/tokens", s.admin(s.apiIssueToken))
+		m.Del(AdminAPIPath+"/assocs/:key/tokens/:id", s.admin(s.apiRevokeToken))
+		m.Get(AdminAPIPath+"/assocs/:key/aliases", s.admin(s.apiListAliases))
+		m.Get(AdminAPIPath+"/conflicts", s.admin(s.apiListConflicts))
+		m.Post(AdminAPIPath+"/conflicts/resolve", s.admin(s.apiResolveConflicts))
+		m.Get(AdminAPIPath+"/audit", s.admin(s.apiAudit))
+		m.Get(AdminAPIPath+"/backup", s.admin(s.apiExportBackup))
+		m.Post(AdminAPIPath+"/backup", s.admin(s.apiImportBackup))
+		m.Post(AdminAPIPath+"/migrate", s.admin(s.apiMigrate))
+		m.Get(AdminAPIPath+"/metrics", s.admin(s.apiMetrics))
+		m.NotFound = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			writeAPIError(resp, http.StatusNotFound, fmt.Errorf("no such endpoint"))
+		})
+		s.adminMux = m
+	})
+	return s.adminMux
+}
+
+// admin authenticates requests before passing them to fn.
+func (s *Server) admin(fn adminHandler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		c := s.NewContext(req)
+		if s.Authenticate == nil {
+			writeAPIError(resp, http.StatusNotFound, fmt.Errorf("admin api disabled"))
+			return
+		}
+		user, err := s.Authenticate(req)
+		if err != nil {
+			c.Warningf("admin api request denied: %v", err)
+			resp.Header().Set("WWW-Authenticate", `Bearer realm="gopherpath"`)
+			writeAPIError(resp, http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+		fn(c, user, resp, req)
+	})
+}
+
+// checkAPIWrite returns an error unless req, which changes state, is a JSON
+// request from the origin it is made to, authority being the requested host
+// with its port, or from outside a browser.
+func checkAPIWrite(req *http.Request, authority string) error {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return fmt.Errorf("content type must be application/json")
+	}
+	if origin := req.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !sameOrigin(u, authority) {
+			return fmt.Errorf("cross-origin request from %q", origin)
+		}
+	}
+	return nil
+}
+
+// defaultPorts holds the port of each origin scheme when it gives none.
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// sameOrigin returns true if origin names the host and port of authority.
+// A request to an authority without a port may be from either scheme, as
+// proxies terminating TLS forward requests without one, but not from a
+// non-default port.
+func sameOrigin(origin *url.URL, authority string) bool {
+	originHost, err := NormalizeHost(origin.Host)
+	if err != nil {
+		return false
+	}
+	host, err := NormalizeHost(authority)
+	if err != nil || host != originHost {
+		return false
+	}
+	originPort := origin.Port()
+	if originPort == "" {
+		originPort = defaultPorts[origin.Scheme]
+	}
+	port := (&url.URL{Host: authority}).Port()
+	if port == "" {
+		return originPort == defaultPorts[origin.Scheme]
+	}
+	return originPort == port
+}
+
+func (s *Server) apiListAssocs(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	var assocs []DomainAssoc
+	var err error
+	q := req.URL.Query()
+	switch {
+	case q.Get("domain") != "":
+		assocs, err = s.Store.GetDomainAssocs(c, q.Get("domain"))
+	case q.Get("login") != "":
+		assocs, err = s.Store.GetDomainAssocsGitHubLogin(c, q.Get("login"))
+	case q.Get("aliasOf") != "":
+		assocs, err = s.Store.GetDomainAssocsAliasOf(c, q.Get("aliasOf"))
+	default:
+		assocs, err = s.Store.ListDomainAssocs(c)
+	}
+	if err != nil {
+		s.apiStoreError(c, resp, err)
+		return
+	}
+	if assocs == nil {
+		assocs = []DomainAssoc{}
+	}
+	writeJSON(resp, http.StatusOK, assocs)
+}
+
+func (s *Server) apiCreateAssoc(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	var assoc DomainAssoc
+	if !readJSON(resp, req, &assoc) {
+		return
+	}
+	// verification state is never accepted from clients.
+	assoc.Key = ""
+	assoc.Revision = 0
+	assoc.Verified = time.Time{}
+	assoc.VerifiedDomain = ""
+	assoc.Tokens = nil
+	assoc.Domain = canonicalDomain(assoc.Domain)
+	assoc.AliasOf = canonicalAssocPath(assoc.AliasOf)
+	token, err := NewVerifyToken()
+	if err != nil {
+		s.apiStoreError(c, resp, err)
+		return
+	}
+	assoc.VerifyToken = token
+	touchPackages(assoc.Packages, nil)
+	err = validateDomainAssoc(&assoc)
+	if err == nil {
+		err = checkAliasOf(c, s.Store, &assoc)
+	}
+	if err == nil {
+		err = s.storeFor(user).PutDomainAssoc(c, &assoc)
+	}
+	if err != nil {
+		s.apiStoreError(c, resp, err)
+		return
+	}
+	c.Infof("%v created association %v for %v", user, assoc.Key, assoc.Domain)
+	resp.Header().Set("Location", AdminAPIPath+"/assocs/"+assoc.Key)
+	writeAssoc(resp, http.StatusCreated, &assoc)
+}
+
+func (s *Server) apiGetAssoc(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	assoc, ok := s.apiAssoc(c, resp, req)
+	if !ok {
+		return
+	}
+	writeAssoc(resp, http.StatusOK, assoc)
+}
+
+func (s *Server) apiUpdateAssoc(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	current, ok := s.apiAssoc(c, resp, req)
+	if !ok {
+		return
+	}
+	var assoc DomainAssoc
+	if !readJSON(resp, req, &assoc) {
+		return
+	}
+	revision, ok := ifMatch(resp, req)
+	if !ok {
+		return
+	}
+	if revision >= 0 {
+		assoc.Revision = revision
+	}
+	assoc.Key = current.Key
+	assoc.VerifyToken = current.VerifyToken
+	assoc.Verified = current.Verified
+	assoc.VerifiedDomain = current.VerifiedDomain
+	assoc.Tokens = current.Tokens
+	assoc.Domain = canonicalDomain(assoc.Domain)
+	assoc.AliasOf = canonicalAssocPath(assoc.AliasOf)
+	touchPackages(assoc.Packages, current.Packages)
+	err := validateDomainAssoc(&assoc)
+	if err == nil {
+		err = checkAliasOf(c, s.Store, &assoc)
+	}
+	if err == nil {
+		err = s.storeFor(user).PutDomainAssoc(c, &assoc)
+	}
+	if err == ErrConflict && revision >= 0 {
+		writeAPIError(resp, http.StatusPreconditionFailed, err)
+		return
+	}
+	if err != nil {
+		s.apiStoreError(c, resp, err)
+		return
+	}
+	c.Infof("%v updated association %v for %v", user, assoc.Key, assoc.Domain)
+	writeAssoc(resp, http.StatusOK, &assoc)
+}
+
+func (s *Server) apiDeleteAssoc(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	assoc, ok := s.apiAssoc(c, resp, req)
+	if !ok {
+		return
+	}
+	revision, ok := ifMatch(resp, req)
+	if !ok {
+		return
+	}
+	if revision >= 0 && revision != assoc.Revision {
+		writeAPIError(resp, http.StatusPreconditionFailed, ErrConflict)
+		return
+	}
+	err := s.storeFor(user).DeleteDomainAssoc(c, assoc.Key)
+	if err != nil {
+		s.apiStoreError(c, resp, err)
+		return
+	}
+	c.Infof("%v deleted association %v for %v", user, assoc.Key, assoc.Domain)
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// apiVerifyAssoc checks the verification challenges of an association.  If
+// neither holds its token it is rejected with 422.
+func (s *Server) apiVerifyAssoc(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	assoc, ok := s.apiModifyAssoc(c, user, resp, req, func(assoc *DomainAssoc) error {
+		if assoc.VerifyToken == "" {
+			token, err := NewVerifyToken()
+			if err != nil {
+				return err
+			}
+			assoc.VerifyToken = token
+		}
+		err := s.verifier().Verify(c, assoc)
+		if err == ErrNotVerified {
+			return &ValidationError{"verifyToken", fmt.Sprintf("%v: publish the verification token of %v", err, assoc.verifyDomain())}
+		}
+		return err
+	})
+	if !ok {
+		return
+	}
+	c.Infof("%v verified ownership of %v", user, assoc.Domain)
+	writeAssoc(resp, http.StatusOK, assoc)
+}
+
+func (s *Server) apiListPackages(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	assoc, ok := s.apiAssoc(c, resp, req)
+	if !ok {
+		return
+	}
+	pkgs := assoc.Packages
+	if pkgs == nil {
+		pkgs = []Package{}
+	}
+	setETag(resp, assoc.Revision)
+	writeJSON(resp, http.StatusOK, pkgs)
+}
+
+func (s *Server) apiGetPackage(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	assoc, ok := s.apiAssoc(c, resp, req)
+	if !ok {
+		return
+	}
+	pkg := assoc.Package(req.URL.Query().Get(":root"))
+	if pkg == nil {
+		writeAPIError(resp, http.StatusNotFound, errNoSuchPackage)
+		return
+	}
+	setETag(resp, assoc.Revision)
+	writeJSON(resp, http.StatusOK, pkg)
+}
+
+func (s *Server) apiPutPackage(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	var pkg Package
+	if !readJSON(resp, req, &pkg) {
+		return
+	}
+	root := req.URL.Query().Get(":root")
+	if pkg.Root == "" {
+		pkg.Root = root
+	}
+	if pkg.Root != root {
+		writeAPIError(resp, http.StatusUnprocessableEntity,
+			&ValidationError{"root", fmt.Sprintf("package root %q does not match url", pkg.Root)})
+		return
+	}
+	err := validatePackage(&pkg)
+	if err != nil {
+		writeAPIError(resp, http.StatusUnprocessableEntity, err)
+		return
+	}
+	pkg.Modified = time.Now()
+	created := false
+	assoc, ok := s.apiModifyAssoc(c, user, resp, req, func(assoc *DomainAssoc) error {
+		created = false
+		if p := assoc.Package(pkg.Root); p != nil {
+			*p = pkg
+			return nil
+		}
+		created = true
+		assoc.Packages = append(assoc.Packages, pkg)
+		return nil
+	})
+	if !ok {
+		return
+	}
+	c.Infof("%v mapped package %v of association %v", user, pkg.Root, assoc.Key)
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+	}
+	setETag(resp, assoc.Revision)
+	writeJSON(resp, code, assoc.Package(pkg.Root))
+}
+
+func (s *Server) apiDeletePackage(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	root := req.URL.Query().Get(":root")
+	assoc, ok := s.apiModifyAssoc(c, user, resp, req, func(assoc *DomainAssoc) error {
+		for i := range assoc.Packages {
+			if assoc.Packages[i].Root == root {
+				assoc.Packages = append(assoc.Packages[:i], assoc.Packages[i+1:]...)
+				return nil
+			}
+		}
+		return errNoSuchPackage
+	})
+	if !ok {
+		return
+	}
+	c.Infof("%v unmapped package %v of association %v", user, root, assoc.Key)
+	setETag(resp, assoc.Revision)
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) apiListTokens(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	assoc, ok := s.apiAssoc(c, resp, req)
+	if !ok {
+		return
+	}
+	toks := assoc.Tokens
+	if toks == nil {
+		toks = []AccessToken{}
+	}
+	setETag(resp, assoc.Revision)
+	writeJSON(resp, http.StatusOK, toks)
+}
+
+// issuedToken is the response to a request issuing an access token.
+type issuedToken struct {
+	Token  *AccessToken `json:"token"`
+	Secret string       `json:"secret"`
+}
+
+func (s *Server) apiIssueToken(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	var params struct {
+		Name    string    `json:"name"`
+		Scope   string    `json:"scope"`
+		Expires time.Time `json:"expires"`
+	}
+	if !readJSON(resp, req, &params) {
+		return
+	}
+	if strings.TrimSpace(params.Name) == "" {
+		writeAPIError(resp, http.StatusUnprocessableEntity, &ValidationError{"name", "the token holder must be named"})
+		return
+	}
+	tok, secret, err := NewAccessToken(strings.TrimSpace(params.Name), params.Scope, params.Expires)
+	if err != nil {
+		s.apiStoreError(c, resp, err)
+		return
+	}
+	assoc, ok := s.apiModifyAssoc(c, user, resp, req, func(assoc *DomainAssoc) error {
+		assoc.Tokens = append(assoc.Tokens, *tok)
+		return nil
+	})
+	if !ok {
+		return
+	}
+	c.Infof("%v issued token %v to %v for association %v", user, tok.ID, tok.Name, assoc.Key)
+	resp.Header().Set("Location", AdminAPIPath+"/assocs/"+assoc.Key+"/tokens/"+tok.ID)
+	setETag(resp, assoc.Revision)
+	writeJSON(resp, http.StatusCreated, &issuedToken{assoc.Token(tok.ID), secret})
+}
+
+func (s *Server) apiRevokeToken(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+	assoc, ok := s.apiModifyAssoc(c, user, resp, req, func(assoc *DomainAssoc) error {
+		return revokeToken(assoc, id)
+	})
+	if !ok {
+		return
+	}
+	c.Infof("%v revoked token %v of association %v", user, id, assoc.Key)
+	setETag(resp, assoc.Revision)
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) apiListAliases(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	assoc, ok := s.apiAssoc(c, resp, req)
+	if !ok {
+		return
+	}
+	aliases, err := s.Store.GetDomainAssocsAliasOf(c, assoc.Path())
+	if err != nil {
+		s.apiStoreError(c, resp, err)
+		return
+	}
+	if aliases == nil {
+		aliases = []DomainAssoc{}
+	}
+	writeJSON(resp, http.StatusOK, aliases)
+}
+
+// apiModifyAssoc applies fn to the association named in the url of req and
+// stores the result unless fn returns an error.  Without an If-Match header a
+// concurrent change to the association causes fn to be retried with the new
+// content.
+func (s *Server) apiModifyAssoc(c Context, user string, resp http.ResponseWriter, req *http.Request, fn func(*DomainAssoc) error) (*DomainAssoc, bool) {
+	revision, ok := ifMatch(resp, req)
+	if !ok {
+		return nil, false
+	}
+	for attempt := 0; ; attempt++ {
+		assoc, ok := s.apiAssoc(c, resp, req)
+		if !ok {
+			return nil, false
+		}
+		if revision >= 0 && revision != assoc.Revision {
+			writeAPIError(resp, http.StatusPreconditionFailed, ErrConflict)
+			return nil, false
+		}
+		err := fn(assoc)
+		if err == errNoSuchPackage || err == errNoSuchToken {
+			writeAPIError(resp, http.StatusNotFound, err)
+			return nil, false
+		}
+		if err == nil {
+			err = s.storeFor(user).PutDomainAssoc(c, assoc)
+		}
+		if err == ErrConflict && revision < 0 && attempt < 3 {
+			continue
+		}
+		if err == ErrConflict && revision >= 0 {
+			writeAPIError(resp, http.StatusPreconditionFailed, err)
+			return nil, false
+		}
+		if err != nil {
+			s.apiStoreError(c, resp, err)
+			return nil, false
+		}
+		return assoc, true
+	}
+}
+
+// apiAssoc returns the association named in the url of req.
+func (s *Server) apiAssoc(c Context, resp http.ResponseWriter, req *http.Request) (*DomainAssoc, bool) {
+	assoc, err := s.Store.GetDomainAssoc(c, req.URL.Query().Get(":key"))
+	if err != nil {
+		s.apiStoreError(c, resp, err)
+		return nil, false
+	}
+	return assoc, true
+}
+
+// apiStoreError writes the response for an error returned by the store.
+func (s *Server) apiStoreError(c Context, resp http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *ValidationError:
+		writeAPIError(resp, http.StatusUnprocessableEntity, err)
+		return
+	case *AuditError:
+		writeAPIError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	switch err {
+	case ErrNoSuchAssoc:
+		writeAPIError(resp, http.StatusNotFound, err)
+	case ErrConflict:
+		writeAPIError(resp, http.StatusConflict, err)
+	case ErrDomainTaken:
+		writeAPIError(resp, http.StatusConflict, &ValidationError{"domain", err.Error()})
+	default:
+		c.Errorf("admin api: %v", err)
+		writeAPIError(resp, http.StatusInternalServerError, fmt.Errorf("an error occurred"))
+	}
+}
+
+func (s *Server) apiListConflicts(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	conflicts, err := FindConflicts(c, s.Store)
+	if err != nil {
+		s.apiStoreError(c, resp, err)
+		return
+	}
+	if conflicts == nil {
+		conflicts = []Conflict{}
+	}
+	writeJSON(resp, http.StatusOK, conflicts)
+}
+
+func (s *Server) apiResolveConflicts(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	conflicts, err := ResolveConflicts(c, s.storeFor(user))
+	if err != nil {
+		s.apiStoreError(c, resp, err)
+		return
+	}
+	if conflicts == nil {
+		conflicts = []Conflict{}
+	}
+	c.Infof("%v resolved conflicting associations", user)
+	writeJSON(resp, http.StatusOK, conflicts)
+}
+
+func (s *Server) apiAudit(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	if s.Audit == nil {
+		writeAPIError(resp, http.StatusNotFound, fmt.Errorf("audit log disabled"))
+		return
+	}
+	q, err := parseAuditQuery(req.URL.Query())
+	if err != nil {
+		writeAPIError(resp, http.StatusBadRequest, err)
+		return
+	}
+	entries, err := s.Audit.QueryAudit(c, q)
+	if err != nil {
+		s.apiStoreError(c, resp, err)
+		return
+	}
+	switch req.URL.Query().Get("format") {
+	case "", "json":
+		if entries == nil {
+			entries = []AuditEntry{}
+		}
+		writeJSON(resp, http.StatusOK, entries)
+	case "jsonl":
+		resp.Header().Set("Content-Type", "application/x-ndjson")
+		WriteAuditJSONLines(resp, entries)
+	default:
+		writeAPIError(resp, http.StatusBadRequest, fmt.Errorf("unknown format %q", req.URL.Query().Get("format")))
+	}
+}
+
+func (s *Server) apiExportBackup(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	b, err := ExportBackup(c, s.Store)
+	if err != nil {
+		s.apiStoreError(c, resp, err)
+		return
+	}
+	c.Infof("%v exported %d associations", user, len(b.Assocs))
+	writeJSON(resp, http.StatusOK, b)
+}
+
+func (s *Server) apiImportBackup(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	b, err := ReadBackup(io.LimitReader(req.Body, maxBackupBody))
+	if err != nil {
+		writeAPIError(resp, http.StatusBadRequest, err)
+		return
+	}
+	opts := ImportOptions{Mode: req.URL.Query().Get("mode")}
+	if v := req.URL.Query().Get("dryRun"); v != "" {
+		opts.DryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			writeAPIError(resp, http.StatusBadRequest, fmt.Errorf("invalid dryRun %q", v))
+			return
+		}
+	}
+	if opts.Mode != "" && opts.Mode != ImportMerge && opts.Mode != ImportReplace {
+		writeAPIError(resp, http.StatusBadRequest, fmt.Errorf("unknown import mode %q", opts.Mode))
+		return
+	}
+	changes, err := ImportBackup(c, s.storeFor(user), b, opts)
+	if cerr, ok := err.(*ConflictError); ok {
+		writeAPIError(resp, http.StatusConflict, cerr)
+		return
+	}
+	if err != nil {
+		s.apiStoreError(c, resp, err)
+		return
+	}
+	if changes == nil {
+		changes = []BackupChange{}
+	}
+	if !opts.DryRun {
+		c.Infof("%v imported a backup making %d changes", user, len(changes))
+	}
+	writeJSON(resp, http.StatusOK, changes)
+}
+
+func (s *Server) apiMigrate(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	opts := MigrateOptions{From: q.Get("from")}
+	var err error
+	if v := q.Get("limit"); v != "" {
+		opts.Limit, err = strconv.Atoi(v)
+		if err != nil || opts.Limit < 0 {
+			writeAPIError(resp, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+			return
+		}
+	}
+	if v := q.Get("dryRun"); v != "" {
+		opts.DryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			writeAPIError(resp, http.StatusBadRequest, fmt.Errorf("invalid dryRun %q", v))
+			return
+		}
+	}
+	progress, err := Migrate(c, s.storeFor(user), opts)
+	if err != nil && progress != nil {
+		c.Errorf("migration by %v stopped at %v: %v", user, progress.Next, err)
+		progress.Error = err.Error()
+		writeJSON(resp, http.StatusInternalServerError, progress)
+		return
+	}
+	if err != nil {
+		s.apiStoreError(c, resp, err)
+		return
+	}
+	if !opts.DryRun {
+		c.Infof("%v migrated %d associations to schema %d (%d of %d checked)",
+			user, progress.Migrated, SchemaVersion, progress.Checked, progress.Total)
+	}
+	writeJSON(resp, http.StatusOK, progress)
+}
+
+// metrics is the response of the metrics endpoint.  Counters are those of the
+// instance serving the request since it started.
+type metrics struct {
+	RateLimit *RateLimitStats `json:"rateLimit"` // null without a rate limit
+}
+
+func (s *Server) apiMetrics(c Context, user string, resp http.ResponseWriter, req *http.Request) {
+	var m metrics
+	if s.RateLimit != nil {
+		stats := s.RateLimit.Stats()
+		m.RateLimit = &stats
+	}
+	writeJSON(resp, http.StatusOK, &m)
+}
+
+// parseAuditQuery returns the audit query given by the parameters v.
+func parseAuditQuery(v url.Values) (AuditQuery, error) {
+	q := AuditQuery{
+		Assoc:   v.Get("assoc"),
+		Path:    v.Get("path"),
+		Package: v.Get("package"),
+		Actor:   v.Get("actor"),
+	}
+	var err error
+	if since := v.Get("since"); since != "" {
+		q.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return q, fmt.Errorf("invalid since %q", since)
+		}
+	}
+	if until := v.Get("until"); until != "" {
+		q.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			return q, fmt.Errorf("invalid until %q", until)
+		}
+	}
+	if limit := v.Get("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("invalid limit %q", limit)
+		}
+	}
+	return q, nil
+}
+
+// touchPackages sets the modification time of each element of pkgs which is
+// new or differs from its counterpart in old.
+func touchPackages(pkgs, old []Package) {
+	now := time.Now()
+	for i := range pkgs {
+		pkgs[i].Modified = now
+		for _, prev := range old {
+			pkg := pkgs[i]
+			pkg.Modified = prev.Modified
+			if reflect.DeepEqual(pkg, prev) {
+				pkgs[i].Modified = prev.Modified
+			}
+		}
+	}
+}
+
+// ifMatch returns the revision in the If-Match header of req, or -1 if there
+// is no header.
+func ifMatch(resp http.ResponseWriter, req *http.Request) (int64, bool) {
+	etag := req.Header.Get("If-Match")
+	if etag == "" {
+		return -1, true
+	}
+	revision, err := strconv.ParseInt(strings.Trim(etag, `"`), 10, 64)
+	if err != nil || revision < 0 {
+		writeAPIError(resp, http.StatusBadRequest, fmt.Errorf("invalid If-Match header %q", etag))
+		return 0, false
+	}
+	return revision, true
+}
+
+func setETag(resp http.ResponseWriter, revision int64) {
+	resp.Header().Set("ETag", strconv.Quote(strconv.FormatInt(revision, 10)))
+}
+
+func writeAssoc(resp http.ResponseWriter, code int, assoc *DomainAssoc) {
+	setETag(resp, assoc.Revision)
+	writeJSON(resp, code, assoc)
+}
+
+// readJSON decodes the body of req into v.  If the body is invalid an error
+// response is written and false is returned.
+func readJSON(resp http.ResponseWriter, req *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(io.LimitReader(req.Body, maxAdminBody))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		return true
+	}
+	if err, ok := err.(*json.UnmarshalTypeError); ok {
+		writeAPIError(resp, http.StatusUnprocessableEntity,
+			&ValidationError{jsonFieldPath(err.Field), fmt.Sprintf("expected a json %v", err.Type.Kind())})
+		return false
+	}
+	if msg := err.Error(); strings.HasPrefix(msg, "json: unknown field ") {
+		field, _ := strconv.Unquote(strings.TrimPrefix(msg, "json: unknown field "))
+		writeAPIError(resp, http.StatusUnprocessableEntity, &ValidationError{field, "unknown field"})
+		return false
+	}
+	writeAPIError(resp, http.StatusBadRequest, fmt.Errorf("invalid json: %v", err))
+	return false
+}
+
+// jsonFieldPath converts the dotted field path of a json decoding error
+// (e.g. "packages.1.root") to the form used by ValidationError.
+func jsonFieldPath(field string) string {
+	elems := strings.Split(field, ".")
+	var path string
+	for _, elem := range elems {
+		if _, err := strconv.Atoi(elem); err == nil && path != "" {
+			path += "[" + elem + "]"
+			continue
+		}
+		if path != "" {
+			path += "."
+		}
+		path += elem
+	}
+	return path
+}
+
+func writeJSON(resp http.ResponseWriter, code int, v interface{}) {
+	p, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		code = http.StatusInternalServerError
+		p, _ = json.Marshal(apiError{Error: err.Error()})
+	}
+	resp.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp.WriteHeader(code)
+	resp.Write(append(p, '\n'))
+}
+
+func writeAPIError(resp http.ResponseWriter, code int, err error) {
+	body := apiError{Error: err.Error()}
+	if verr, ok := err.(*ValidationError); ok {
+		body.Error = verr.Message
+		body.Field = verr.Field
+	}
+	writeJSON(resp, code, body)
+}
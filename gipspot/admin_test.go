@@ -0,0 +1,193 @@
+package gipspot
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// apiRequest sends an admin API request to s authenticated as "admin".
+func apiRequest(s *Server, method, path, body string, header ...string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "http://foo.io"+AdminAPIPath+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	if method != "GET" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	return resp
+}
+
+func decodeAPI(t *testing.T, resp *httptest.ResponseRecorder, v interface{}) {
+	err := json.Unmarshal(resp.Body.Bytes(), v)
+	if err != nil {
+		t.Fatalf("invalid response body %q: %v", resp.Body.String(), err)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	s := testServer()
+	if resp := apiRequest(s, "GET", "/assocs", ""); resp.Code != http.StatusNotFound {
+		t.Errorf("admin api served without an authenticator: %d", resp.Code)
+	}
+	s.Authenticate = BearerTokens(map[string]string{"0ther": "admin"})
+	if resp := apiRequest(s, "GET", "/assocs", ""); resp.Code != http.StatusUnauthorized {
+		t.Errorf("admin api served with a bad token: %d", resp.Code)
+	}
+	s.Authenticate = BearerTokens(map[string]string{"s3cret": "admin"})
+	if resp := apiRequest(s, "GET", "/assocs", ""); resp.Code != http.StatusOK {
+		t.Errorf("admin api denied a good token: %d", resp.Code)
+	}
+
+	// browsers can't be made to send writes from other sites.
+	for _, header := range [][]string{
+		{"Content-Type", "text/plain"},
+		{"Content-Type", "application/x-www-form-urlencoded"},
+		{"Content-Type", "application/json", "Origin", "http://evil.io"},
+	} {
+		resp := apiRequest(s, "POST", "/assocs", `{"domain": "foo.io"}`, header...)
+		if resp.Code != http.StatusForbidden {
+			t.Errorf("%v: write accepted: %d", header, resp.Code)
+		}
+	}
+	resp := apiRequest(s, "POST", "/assocs", `{"domain": "foo.io"}`, "Origin", "http://FOO.io")
+	if resp.Code != http.StatusCreated {
+		t.Errorf("same origin write denied: %d %q", resp.Code, resp.Body.String())
+	}
+
+	// servers on other ports are other origins.
+	for i, test := range []struct {
+		host, origin string
+		ok           bool
+	}{
+		{"localhost:8080", "http://localhost:8080", true},
+		{"localhost:8080", "http://localhost:9090", false},
+		{"localhost:8080", "http://localhost", false},
+		{"localhost", "http://localhost:8080", false},
+		{"foo.io", "https://foo.io", true},
+		{"foo.io:443", "https://foo.io", true},
+	} {
+		req, _ := http.NewRequest("POST", "http://"+test.host+AdminAPIPath+"/assocs", strings.NewReader(`{"domain": "foo.io"}`))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Origin", test.origin)
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		if ok := resp.Code != http.StatusForbidden; ok != test.ok {
+			t.Errorf("test %d: unexpected response for %v from %v: %d %q", i, test.host, test.origin, resp.Code, resp.Body.String())
+		}
+	}
+}
+
+func TestAdminAssocs(t *testing.T) {
+	s := testServer()
+	s.Authenticate = BearerTokens(map[string]string{"s3cret": "admin"})
+
+	resp := apiRequest(s, "POST", "/assocs", `{"domain": "foo.io", "githubLogin": "mcfoo", "verified": "2014-01-01T00:00:00Z"}`)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("create: %d %q", resp.Code, resp.Body.String())
+	}
+	var assoc DomainAssoc
+	decodeAPI(t, resp, &assoc)
+	if assoc.Key == "" || assoc.VerifyToken == "" || assoc.IsVerified() {
+		t.Errorf("unexpected created association: %#v", assoc)
+	}
+	if resp.Header().Get("ETag") != `"1"` {
+		t.Errorf("unexpected etag: %q", resp.Header().Get("ETag"))
+	}
+
+	// validation errors name the field at fault.
+	for i, test := range []struct {
+		body  string
+		field string
+	}{
+		{`{"githubLogin": "mcfoo"}`, "domain"},
+		{`{"domain": "foo.io", "packages": [{"root": "ok"}, {"root": "x", "subdir": "../up"}]}`, "packages[1].subdir"},
+		{`{"domain": "foo.io", "packages": [{"root": 12}]}`, "packages[0].root"},
+		{`{"domain": "foo.io", "bogus": true}`, "bogus"},
+	} {
+		resp := apiRequest(s, "POST", "/assocs", test.body)
+		var body apiError
+		decodeAPI(t, resp, &body)
+		if resp.Code != http.StatusUnprocessableEntity || body.Field != test.field {
+			t.Errorf("test %d: unexpected response %d %#v", i, resp.Code, body)
+		}
+	}
+
+	path := "/assocs/" + assoc.Key
+	update := `{"domain": "foo.io", "githubLogin": "mcbar", "revision": 1}`
+	if resp := apiRequest(s, "PUT", path, update); resp.Code != http.StatusOK {
+		t.Fatalf("update: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp := apiRequest(s, "PUT", path, update); resp.Code != http.StatusConflict {
+		t.Errorf("stale update: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp := apiRequest(s, "PUT", path, update, "If-Match", `"1"`); resp.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale conditional update: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp := apiRequest(s, "PUT", path, update, "If-Match", `"2"`); resp.Code != http.StatusOK {
+		t.Errorf("conditional update: %d %q", resp.Code, resp.Body.String())
+	}
+
+	resp = apiRequest(s, "GET", "/assocs?login=mcbar", "")
+	var assocs []DomainAssoc
+	decodeAPI(t, resp, &assocs)
+	if len(assocs) != 1 || assocs[0].Revision != 3 || assocs[0].VerifyToken != assoc.VerifyToken {
+		t.Errorf("unexpected associations listed: %#v", assocs)
+	}
+
+	if resp := apiRequest(s, "DELETE", path, "", "If-Match", `"2"`); resp.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale delete: %d", resp.Code)
+	}
+	if resp := apiRequest(s, "DELETE", path, ""); resp.Code != http.StatusNoContent {
+		t.Errorf("delete: %d", resp.Code)
+	}
+	if resp := apiRequest(s, "GET", path, ""); resp.Code != http.StatusNotFound {
+		t.Errorf("get deleted association: %d", resp.Code)
+	}
+}
+
+func TestAdminPackages(t *testing.T) {
+	s := testServer(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo"})
+	s.Authenticate = BearerTokens(map[string]string{"s3cret": "admin"})
+	path := "/assocs/1/packages"
+
+	resp := apiRequest(s, "PUT", path+"/foo", `{"repo": "mono", "subdir": "go/foo"}`)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("map package: %d %q", resp.Code, resp.Body.String())
+	}
+	resp = apiRequest(s, "PUT", path+"/foo", `{"subdir": "/abs"}`)
+	var body apiError
+	decodeAPI(t, resp, &body)
+	if resp.Code != http.StatusUnprocessableEntity || body.Field != "subdir" {
+		t.Errorf("invalid mapping: %d %#v", resp.Code, body)
+	}
+	if resp := apiRequest(s, "PUT", path+"/foo", `{"repo": "mono"}`, "If-Match", `"1"`); resp.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale mapping: %d", resp.Code)
+	}
+
+	resp = apiRequest(s, "GET", path+"/foo", "")
+	var pkg Package
+	decodeAPI(t, resp, &pkg)
+	if pkg.Repo != "mono" || pkg.Subdir != "go/foo" || pkg.Modified.IsZero() {
+		t.Errorf("unexpected package: %#v", pkg)
+	}
+
+	if resp := apiRequest(s, "DELETE", path+"/foo", ""); resp.Code != http.StatusNoContent {
+		t.Errorf("unmap package: %d", resp.Code)
+	}
+	if resp := apiRequest(s, "DELETE", path+"/foo", ""); resp.Code != http.StatusNotFound {
+		t.Errorf("unmap missing package: %d", resp.Code)
+	}
+	resp = apiRequest(s, "GET", path, "")
+	var pkgs []Package
+	decodeAPI(t, resp, &pkgs)
+	if resp.Code != http.StatusOK || len(pkgs) != 0 {
+		t.Errorf("unexpected packages: %d %#v", resp.Code, pkgs)
+	}
+}
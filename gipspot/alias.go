@@ -0,0 +1,177 @@
+package gipspot
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Alias associations serve the packages of another, canonical, association
+// under their own domain and prefix.  AliasOf holds the import path of the
+// canonical association (see DomainAssoc.Path), e.g. "example.com/go".  The
+// go command requires the root package served for a path to lie beneath it,
+// so metadata served for an alias names the alias host and carries the
+// canonical import path as a hint for human visitors.  An alias is verified
+// like any association and serves nothing unless its canonical association
+// is active.  Wildcards can be neither aliases nor canonical associations,
+// and an alias can't be the canonical association of another.
+
+// isAlias returns true if assoc serves the packages of another association.
+func (assoc *DomainAssoc) isAlias() bool {
+	return assoc.AliasOf != ""
+}
+
+// splitAssocPath splits the import path of an association into its domain
+// and prefix.
+func splitAssocPath(p string) (domain, prefix string) {
+	if i := strings.Index(p, "/"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+// canonicalAssocPath returns the normalized form of the association import
+// path p, leaving invalid paths to validation.
+func canonicalAssocPath(p string) string {
+	p = strings.Trim(strings.TrimSpace(p), "/")
+	if p == "" {
+		return ""
+	}
+	domain, prefix := splitAssocPath(p)
+	return path.Join(canonicalDomain(domain), prefix)
+}
+
+// GetAssocByPath returns the association of store whose Path is p, after
+// normalizing its domain.  ErrNoSuchAssoc is returned if there is none, and a
+// *ConflictError if there are several.
+func GetAssocByPath(c Context, store AssocStore, p string) (*DomainAssoc, error) {
+	domain, prefix := splitAssocPath(canonicalAssocPath(p))
+	assocs, err := store.GetDomainAssocs(c, domain)
+	if err != nil {
+		return nil, err
+	}
+	var match []DomainAssoc
+	for _, assoc := range assocs {
+		if assoc.Prefix == prefix {
+			match = append(match, assoc)
+		}
+	}
+	switch len(match) {
+	case 0:
+		return nil, ErrNoSuchAssoc
+	case 1:
+		return &match[0], nil
+	}
+	return nil, &ConflictError{Domain: domain, Prefix: prefix, Keys: assocKeys(match)}
+}
+
+// canonicalAssoc returns the canonical association of the alias assoc.
+// ErrNoSuchAssoc is returned if there is none which can be served.
+func canonicalAssoc(c Context, store AssocStore, assoc *DomainAssoc) (*DomainAssoc, error) {
+	canon, err := GetAssocByPath(c, store, assoc.AliasOf)
+	if err != nil {
+		return nil, err
+	}
+	if canon.isAlias() || canon.isWildcard() {
+		c.Warningf("alias %v of %v, which is not a canonical association", assoc.Path(), assoc.AliasOf)
+		return nil, ErrNoSuchAssoc
+	}
+	return canon, nil
+}
+
+// serving returns the association serving host given assoc, the stored
+// association found for host by lookupDomainAssoc.  Wildcards are derived for
+// host by forHost.  An alias is resolved to a copy of its canonical
+// association with the domain and prefix of the alias, which is verified if
+// both are.  Neither copy may be stored.
+func (s *Server) serving(c Context, assoc *DomainAssoc, host string) (*DomainAssoc, error) {
+	if !assoc.isAlias() {
+		return assoc.forHost(host), nil
+	}
+	canon, err := canonicalAssoc(c, s.Store, assoc)
+	if err == ErrNoSuchAssoc {
+		c.Warningf("alias %v of missing association %v", assoc.Path(), assoc.AliasOf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	served := copyDomainAssoc(*canon)
+	served.Domain = assoc.Domain
+	served.Prefix = assoc.Prefix
+	served.VerifiedDomain = ""
+	if assoc.IsVerified() && canon.IsVerified() {
+		served.VerifiedDomain = assoc.Domain
+	}
+	served.canonical = canon.Path()
+	return &served, nil
+}
+
+// canonicalPath returns the canonical import path of reqpath served by assoc,
+// or "" if assoc is not a resolved alias.
+func (assoc *DomainAssoc) canonicalPath(reqpath string) string {
+	if assoc.canonical == "" {
+		return ""
+	}
+	return path.Join(assoc.canonical, assoc.relPath(reqpath))
+}
+
+// validateAlias returns a *ValidationError if the alias settings of assoc are
+// invalid.  The settings served for an alias are those of its canonical
+// association, so it may have none of its own.
+func validateAlias(assoc *DomainAssoc) error {
+	if !assoc.isAlias() {
+		return nil
+	}
+	if assoc.isWildcard() {
+		return &ValidationError{"aliasOf", "a wildcard association can't be an alias"}
+	}
+	domain, prefix := splitAssocPath(assoc.AliasOf)
+	if d, err := NormalizeHost(domain); err != nil || d != domain || path.Clean("/"+prefix) != "/"+prefix || strings.HasSuffix(assoc.AliasOf, "/") {
+		return &ValidationError{"aliasOf", fmt.Sprintf("invalid canonical import path %q", assoc.AliasOf)}
+	}
+	if assoc.AliasOf == assoc.Path() {
+		return &ValidationError{"aliasOf", "an association can't be an alias of itself"}
+	}
+	for _, field := range []struct {
+		name string
+		set  bool
+	}{
+		{"githubLogin", assoc.GitHubLogin != ""},
+		{"provider", assoc.Provider != "" || assoc.ProviderURL != ""},
+		{"proxy", assoc.Proxy != ""},
+		{"packages", len(assoc.Packages) > 0},
+		{"requireToken", assoc.RequireToken},
+		{"tokens", len(assoc.Tokens) > 0},
+	} {
+		if field.set {
+			return &ValidationError{field.name, "an alias serves the settings of its canonical association"}
+		}
+	}
+	return nil
+}
+
+// checkAliasOf returns a *ValidationError unless the canonical association
+// named by the alias assoc exists in store and may be aliased.
+func checkAliasOf(c Context, store AssocStore, assoc *DomainAssoc) error {
+	if !assoc.isAlias() {
+		return nil
+	}
+	canon, err := GetAssocByPath(c, store, assoc.AliasOf)
+	if err == ErrNoSuchAssoc {
+		return &ValidationError{"aliasOf", fmt.Sprintf("no association for %q", assoc.AliasOf)}
+	}
+	if err != nil {
+		return err
+	}
+	if canon.isAlias() || canon.isWildcard() {
+		return &ValidationError{"aliasOf", fmt.Sprintf("%q is not a canonical association", assoc.AliasOf)}
+	}
+	aliases, err := store.GetDomainAssocsAliasOf(c, assoc.Path())
+	if err != nil {
+		return err
+	}
+	if len(aliases) > 0 {
+		return &ValidationError{"aliasOf", fmt.Sprintf("%v has aliases of its own", assoc.Path())}
+	}
+	return nil
+}
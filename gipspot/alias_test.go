@@ -0,0 +1,137 @@
+package gipspot
+
+import (
+	"importmeta"
+
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAlias(t *testing.T) {
+	s := testServer(
+		verified(DomainAssoc{Domain: "foo.io", Prefix: "go", GitHubLogin: "mcfoo", Proxy: "https://proxy.foo.io"}),
+		verified(DomainAssoc{Domain: "go.foo.io", AliasOf: "foo.io/go"}),
+		DomainAssoc{Domain: "golang.foo.io", AliasOf: "foo.io/go", VerifyToken: "token"},
+		DomainAssoc{Domain: "bar.io", GitHubLogin: "mcbar"},
+		verified(DomainAssoc{Domain: "go.bar.io", AliasOf: "bar.io"}),
+		verified(DomainAssoc{Domain: "go.qux.io", AliasOf: "qux.io"}),
+	)
+	for i, test := range []struct {
+		URL       string
+		Root      string
+		Canonical string
+	}{
+		{"http://go.foo.io/bar/baz", "go.foo.io/bar", "foo.io/go/bar/baz"},
+		{"http://golang.foo.io/bar", "", ""},
+		{"http://go.bar.io/bar", "", ""},
+		{"http://go.qux.io/bar", "", ""},
+	} {
+		req, _ := http.NewRequest("GET", test.URL+"?go-get=1", nil)
+		metas, err := s.ImportMetas(req)
+		if test.Root == "" {
+			if err != importmeta.ErrNotFound {
+				t.Errorf("test %d: unexpected metadata: %v %v", i, metas, err)
+			}
+			continue
+		}
+		if err != nil || len(metas) != 2 {
+			t.Errorf("test %d: unexpected metadata: %v %v", i, metas, err)
+			continue
+		}
+		for _, m := range metas {
+			if m.RootPkg != test.Root || m.Canonical != test.Canonical {
+				t.Errorf("test %d: unexpected entry: %v", i, m)
+			}
+		}
+	}
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://go.foo.io/bar?go-get=1", nil)
+	s.ServeHTTP(resp, req)
+	for _, tag := range []string{
+		`<meta name="go-import" content="go.foo.io/bar git https://github.com/mcfoo/bar">`,
+		`<link rel="canonical" href="https://foo.io/go/bar">`,
+	} {
+		if !strings.Contains(resp.Body.String(), tag) {
+			t.Errorf("alias response missing %s: %q", tag, resp.Body.String())
+		}
+	}
+
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://go.foo.io/", nil)
+	s.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "go.foo.io is an alias of foo.io/go") {
+		t.Errorf("unexpected alias landing page: %d %q", resp.Code, resp.Body.String())
+	}
+
+	// an unverified alias is verified for its own domain.
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://golang.foo.io/", nil)
+	s.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotFound || !strings.Contains(resp.Body.String(), VerifyTXTPrefix+"golang.foo.io. TXT") {
+		t.Errorf("unexpected unverified alias page: %d %q", resp.Code, resp.Body.String())
+	}
+}
+
+func TestValidateAlias(t *testing.T) {
+	for i, test := range []struct {
+		Assoc DomainAssoc
+		Field string
+	}{
+		{DomainAssoc{Domain: "go.foo.io", AliasOf: "foo.io"}, ""},
+		{DomainAssoc{Domain: "go.foo.io", AliasOf: "foo.io/go/x"}, ""},
+		{DomainAssoc{Domain: "go.foo.io", AliasOf: "Foo.io"}, "aliasOf"},
+		{DomainAssoc{Domain: "go.foo.io", AliasOf: "foo.io/go/"}, "aliasOf"},
+		{DomainAssoc{Domain: "go.foo.io", AliasOf: "go.foo.io"}, "aliasOf"},
+		{DomainAssoc{Domain: "*.foo.io", AliasOf: "foo.io"}, "aliasOf"},
+		{DomainAssoc{Domain: "go.foo.io", AliasOf: "foo.io", GitHubLogin: "mcfoo"}, "githubLogin"},
+		{DomainAssoc{Domain: "go.foo.io", AliasOf: "foo.io", Packages: []Package{{Root: "bar"}}}, "packages"},
+	} {
+		err := validateDomainAssoc(&test.Assoc)
+		if test.Field == "" {
+			if err != nil {
+				t.Errorf("test %d: unexpected error: %v", i, err)
+			}
+			continue
+		}
+		if verr, ok := err.(*ValidationError); !ok || verr.Field != test.Field {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestAdminAliases(t *testing.T) {
+	s := testServer(
+		verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo"}),
+		verified(DomainAssoc{Domain: "*.foo.io"}),
+	)
+	s.Authenticate = BearerTokens(map[string]string{"s3cret": "admin"})
+
+	for i, test := range []struct {
+		Body string
+		Code int
+	}{
+		{`{"domain": "go.foo.io", "aliasOf": "FOO.io/"}`, http.StatusCreated},
+		{`{"domain": "golang.foo.io", "aliasOf": "bar.io"}`, http.StatusUnprocessableEntity},
+		{`{"domain": "golang.foo.io", "aliasOf": "*.foo.io"}`, http.StatusUnprocessableEntity},
+		{`{"domain": "golang.foo.io", "aliasOf": "go.foo.io"}`, http.StatusUnprocessableEntity},
+	} {
+		resp := apiRequest(s, "POST", "/assocs", test.Body)
+		if resp.Code != test.Code {
+			t.Errorf("test %d: unexpected response: %d %q", i, resp.Code, resp.Body.String())
+		}
+	}
+
+	resp := apiRequest(s, "GET", "/assocs/1/aliases", "")
+	var aliases []DomainAssoc
+	decodeAPI(t, resp, &aliases)
+	if len(aliases) != 1 || aliases[0].Domain != "go.foo.io" || aliases[0].AliasOf != "foo.io" {
+		t.Errorf("unexpected aliases: %#v", aliases)
+	}
+	resp = apiRequest(s, "GET", "/assocs/2/aliases", "")
+	if resp.Code != http.StatusOK || strings.TrimSpace(resp.Body.String()) != "[]" {
+		t.Errorf("unexpected aliases: %d %q", resp.Code, resp.Body.String())
+	}
+}
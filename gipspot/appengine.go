@@ -0,0 +1,59 @@
+//go:build appengine
+// +build appengine
+
+package gipspot
+
+import (
+	"appengine"
+	"appengine/urlfetch"
+	"appengine/user"
+
+	"net/http"
+	"os"
+)
+
+// AppEngine serves associations stored in the App Engine datastore.
+var AppEngine = &Server{
+	NewContext: func(req *http.Request) Context {
+		return appengine.NewContext(req)
+	},
+	Store: DatastoreStore{},
+	Audit: DatastoreAuditLog{},
+	// every request served by HandleRoot queries the datastore.
+	RateLimit: &RateLimiter{
+		PerIP:   Rate{PerSecond: 10, Burst: 100},
+		PerHost: Rate{PerSecond: 100, Burst: 1000},
+	},
+	Verifier: &Verifier{
+		Client: func(c Context) *http.Client {
+			return urlfetch.Client(c.(appengine.Context))
+		},
+	},
+	Authenticate: func(req *http.Request) (string, error) {
+		c := appengine.NewContext(req)
+		u, err := user.CurrentOAuth(c, "https://www.googleapis.com/auth/userinfo.email")
+		if err != nil || u == nil {
+			u = user.Current(c)
+		}
+		if u == nil || !u.Admin {
+			return "", ErrUnauthorized
+		}
+		return u.String(), nil
+	},
+	LoginURL: func(req *http.Request, dest string) (string, error) {
+		return user.LoginURL(appengine.NewContext(req), dest)
+	},
+}
+
+// init takes the rate limits from the env_variables of app.yaml, named as
+// the environment variables of gopherpath serve (e.g.
+// GOPHERPATH_RATE_ALLOWLIST), and the setup token from
+// GOPHERPATH_SETUP_TOKEN.
+func init() {
+	err := AppEngine.RateLimit.configure(os.Getenv)
+	if err != nil {
+		panic(err)
+	}
+	AppEngine.SetupToken = os.Getenv("GOPHERPATH_SETUP_TOKEN")
+	http.Handle("/", AppEngine)
+}
@@ -1,66 +1,258 @@
-package main
+package gipspot
 
 import (
-	"appengine"
-	"appengine/datastore"
-
 	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
 )
 
-var errNotFound = fmt.Errorf("not found")
-
+// DomainAssoc associates a domain, or a path prefix of a domain, with the
+// owner whose repositories are served for it.  Repositories are hosted by a
+// Provider, GitHub by default, and GitHubLogin names their owner on it
+// whatever the provider.  A wildcard association (Domain "*.example.com")
+// serves the subdomains of a domain with owners named by their labels.  An
+// alias association serves the packages of the association named by AliasOf.
 type DomainAssoc struct {
-	Key         *datastore.Key `json:"key" datastore:"-"`
-	GitHubLogin string         `json:"githubLogin"`
-	Domain      string         `json:"domain"`
+	Key         string    `json:"key" datastore:"-"` // identifies the association in its store
+	GitHubLogin string    `json:"githubLogin"`
+	Domain      string    `json:"domain"`
+	Prefix      string    `json:"prefix,omitempty"`      // path beneath the domain holding the packages (e.g. "go")
+	Provider    string    `json:"provider,omitempty"`    // name of a member of Providers; DefaultProvider if empty
+	ProviderURL string    `json:"providerURL,omitempty"` // base URL of a self-hosted provider
+	Proxy       string    `json:"proxy,omitempty"`       // module proxy URL served ahead of the repository
+	Packages    []Package `json:"packages"`
+	Robots      string    `json:"robots,omitempty" datastore:",noindex"` // custom robots.txt content
+	Modified    time.Time `json:"modified"`
+	Revision    int64     `json:"revision"`                    // incremented by every change to the association
+	Schema      int       `json:"schema" datastore:",noindex"` // SchemaVersion when the association was stored (see Migrate)
+
+	// Clients with an access token of the association may resolve its
+	// private packages, and any of its packages if it requires a token.
+	RequireToken bool          `json:"requireToken,omitempty"`
+	Tokens       []AccessToken `json:"tokens,omitempty"`
+
+	// Wildcard associations derive the owner of a subdomain from its label.
+	OwnerTemplate string   `json:"ownerTemplate,omitempty"` // owner with WildcardLabel replaced; WildcardLabel if empty
+	Labels        []string `json:"labels,omitempty"`        // subdomain labels served; all if empty
+
+	// Aliases serve the packages of a canonical association under their own
+	// domain and prefix.
+	AliasOf   string `json:"aliasOf,omitempty"` // import path of the canonical association (e.g. "example.com/go")
+	canonical string // import path of the canonical association of a resolved alias (see serving)
+
+	// Metadata is only served once ownership of the domain is verified.
+	VerifyToken    string    `json:"verifyToken,omitempty"`    // token to publish for verification
+	Verified       time.Time `json:"verified"`                 // time of successful verification
+	VerifiedDomain string    `json:"verifiedDomain,omitempty"` // domain at the time of verification
 }
 
-func GetDomainAssocsGitHubLogin(c appengine.Context, login string) ([]DomainAssoc, error) {
-	var assocs []DomainAssoc
-	q := datastore.NewQuery("DomainAssocs").Filter("GitHubLogin = ", login)
-	keys, err := q.GetAll(c, &assocs)
-	if err != nil {
-		return assocs, err
+// Package is a root package registered with a DomainAssoc.  Its settings
+// take precedence over those of the association.  Registered packages are
+// listed in the sitemap of the domain unless they are hidden.
+type Package struct {
+	Root        string    `json:"root"`                  // path of the package beneath the domain (e.g. "gopherpath")
+	Repo        string    `json:"repo,omitempty"`        // repository name, if it differs from Root, or full repository URL
+	Subdir      string    `json:"subdir,omitempty"`      // repository subdirectory containing the package
+	Owner       string    `json:"owner,omitempty"`       // repository owner, if it differs from the association's
+	Provider    string    `json:"provider,omitempty"`    // provider, if it differs from the association's
+	ProviderURL string    `json:"providerURL,omitempty"` // base URL of a self-hosted provider
+	VCS         string    `json:"vcs,omitempty"`         // version control system, if it differs from the provider's
+	Hidden      bool      `json:"hidden,omitempty"`      // served but left out of the sitemap
+	Private     bool      `json:"private,omitempty"`     // served only to authenticated clients and left out of the sitemap
+	Disabled    bool      `json:"disabled,omitempty"`    // not served at all
+	Modified    time.Time `json:"modified"`
+}
+
+// VCSs holds the version control systems understood by the go command.
+var VCSs = []string{"git", "hg", "svn", "bzr", "fossil"}
+
+// Package returns the registered package with the given root, or nil if
+// there is no such package.
+func (assoc *DomainAssoc) Package(root string) *Package {
+	for i := range assoc.Packages {
+		if assoc.Packages[i].Root == root {
+			return &assoc.Packages[i]
+		}
 	}
-	for i := range keys {
-		assocs[i].Key = keys[i]
+	return nil
+}
+
+// Path returns the import path beneath which assoc serves packages.
+func (assoc *DomainAssoc) Path() string {
+	return path.Join(assoc.Domain, assoc.Prefix)
+}
+
+// hasPath returns true if rel, a path beneath the domain without a leading
+// slash, is the prefix of assoc or beneath it.
+func (assoc *DomainAssoc) hasPath(rel string) bool {
+	return assoc.Prefix == "" || rel == assoc.Prefix || strings.HasPrefix(rel, assoc.Prefix+"/")
+}
+
+// relPath returns reqpath relative to the prefix of assoc, without a leading
+// slash.
+func (assoc *DomainAssoc) relPath(reqpath string) string {
+	rel := strings.TrimPrefix(path.Clean("/"+reqpath), "/")
+	if assoc.Prefix == "" {
+		return rel
 	}
-	return assocs, nil
+	return strings.TrimPrefix(strings.TrimPrefix(rel, assoc.Prefix), "/")
 }
 
-func GetDomainAssocs(c appengine.Context, domain string) ([]DomainAssoc, error) {
-	var assocs []DomainAssoc
-	q := datastore.NewQuery("DomainAssocs").
-		Filter("Domain = ", domain)
-	keys, err := q.GetAll(c, &assocs)
-	if err != nil {
-		return assocs, err
+// ValidationError describes an invalid field of an association.  Field is
+// the JSON name of the field, qualified for nested values (e.g.
+// "packages[1].subdir").
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (err *ValidationError) Error() string {
+	return err.Field + ": " + err.Message
+}
+
+// prefix returns a copy of err with its field qualified by prefix.
+func (err *ValidationError) prefix(prefix string) *ValidationError {
+	return &ValidationError{Field: prefix + "." + err.Field, Message: err.Message}
+}
+
+// validatePackage returns a *ValidationError if pkg cannot be served.
+func validatePackage(pkg *Package) error {
+	if pkg.Root == "" || strings.ContainsAny(pkg.Root, "/ ") {
+		return &ValidationError{"root", fmt.Sprintf("invalid package root %q", pkg.Root)}
+	}
+	if isRepoURL(pkg.Repo) {
+		if strings.ContainsAny(pkg.Repo, " \t\n") {
+			return &ValidationError{"repo", fmt.Sprintf("invalid repository url %q for package %q", pkg.Repo, pkg.Root)}
+		}
+		if u, _ := url.Parse(pkg.Repo); u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				// the url is served to every client of the package.
+				return &ValidationError{"repo", fmt.Sprintf("repository url for package %q contains a password", pkg.Root)}
+			}
+		}
+	} else if strings.ContainsAny(pkg.Repo, "/ ") {
+		return &ValidationError{"repo", fmt.Sprintf("invalid repository name %q for package %q", pkg.Repo, pkg.Root)}
 	}
-	for i := range keys {
-		assocs[i].Key = keys[i]
+	if pkg.Subdir != "" {
+		subdir := pkg.Subdir
+		if strings.ContainsAny(subdir, " \t\n") || path.IsAbs(subdir) || path.Clean(subdir) != subdir ||
+			subdir == "." || subdir == ".." || strings.HasPrefix(subdir, "../") {
+			return &ValidationError{"subdir", fmt.Sprintf("invalid subdirectory %q for package %q", subdir, pkg.Root)}
+		}
 	}
-	return assocs, nil
+	if pkg.Provider != "" && Providers[pkg.Provider] == nil {
+		return &ValidationError{"provider", fmt.Sprintf("unknown provider %q for package %q", pkg.Provider, pkg.Root)}
+	}
+	if pkg.VCS != "" && !containsString(VCSs, pkg.VCS) {
+		return &ValidationError{"vcs", fmt.Sprintf("unknown vcs %q for package %q (expected one of %s)",
+			pkg.VCS, pkg.Root, strings.Join(VCSs, ", "))}
+	}
+	return nil
 }
 
-func PutDomainAssoc(c appengine.Context, assoc *DomainAssoc) error {
+// isRepoURL returns true if repo is a full repository URL rather than a name.
+func isRepoURL(repo string) bool {
+	u, err := url.Parse(repo)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validateDomainAssoc returns a *ValidationError if assoc cannot be stored.
+func validateDomainAssoc(assoc *DomainAssoc) error {
 	//if assoc.GitHubLogin == "" {
 	//	return fmt.Errorf("unknown github login for association")
 	//}
 	if assoc.Domain == "" {
-		return fmt.Errorf("unknown domain for association")
+		return &ValidationError{"domain", "unknown domain for association"}
 	}
-
-	var key *datastore.Key
-	if assoc.Key != nil {
-		key = assoc.Key
-	} else {
-		key = datastore.NewIncompleteKey(c, "DomainAssocs", nil)
+	if strings.ContainsAny(assoc.Domain, "/ ") {
+		return &ValidationError{"domain", fmt.Sprintf("invalid domain %q", assoc.Domain)}
+	}
+	if d, err := normalizeDomain(assoc.Domain); err != nil {
+		return &ValidationError{"domain", fmt.Sprintf("invalid domain %q", assoc.Domain)}
+	} else if d != assoc.Domain {
+		return &ValidationError{"domain", fmt.Sprintf("domain %q is not normalized (expected %q)", assoc.Domain, d)}
+	}
+	err := validateWildcard(assoc)
+	if err == nil {
+		err = validateAlias(assoc)
 	}
-	// XXX this is not safe UNLESS assoc.domain has already been verified as belonging to assoc.GitHubLogin
-	key, err := datastore.Put(c, key, assoc)
 	if err != nil {
 		return err
 	}
-	assoc.Key = key
+	if prefix := assoc.Prefix; prefix != "" {
+		if strings.ContainsAny(prefix, " \t\n?#") || path.IsAbs(prefix) || path.Clean(prefix) != prefix ||
+			prefix == "." || prefix == ".." || strings.HasPrefix(prefix, "../") || strings.HasPrefix(prefix, "_gopherpath") {
+			return &ValidationError{"prefix", fmt.Sprintf("invalid path prefix %q", prefix)}
+		}
+	}
+	if !assoc.isWildcard() {
+		err = validateProvider(assoc)
+		if err != nil {
+			return err
+		}
+	}
+	roots := make(map[string]bool)
+	for i := range assoc.Packages {
+		field := fmt.Sprintf("packages[%d]", i)
+		err := validatePackage(&assoc.Packages[i])
+		if err == nil {
+			err = validatePackageProvider(assoc, &assoc.Packages[i])
+		}
+		if err != nil {
+			return err.(*ValidationError).prefix(field)
+		}
+		if roots[assoc.Packages[i].Root] {
+			return &ValidationError{field + ".root", fmt.Sprintf("duplicate package root %q", assoc.Packages[i].Root)}
+		}
+		roots[assoc.Packages[i].Root] = true
+	}
+	ids := make(map[string]bool)
+	for i := range assoc.Tokens {
+		field := fmt.Sprintf("tokens[%d]", i)
+		err := validateToken(&assoc.Tokens[i])
+		if err != nil {
+			return err.(*ValidationError).prefix(field)
+		}
+		if ids[assoc.Tokens[i].ID] {
+			return &ValidationError{field + ".id", fmt.Sprintf("duplicate token id %q", assoc.Tokens[i].ID)}
+		}
+		ids[assoc.Tokens[i].ID] = true
+	}
 	return nil
 }
+
+// Validated returns an AssocStore checking associations as the admin API
+// does before they are written to store.  The domain and alias target of an
+// association are normalized, and an invalid association is rejected with a
+// *ValidationError.
+func Validated(store AssocStore) AssocStore {
+	return validatedStore{store}
+}
+
+type validatedStore struct {
+	AssocStore
+}
+
+func (s validatedStore) PutDomainAssoc(c Context, assoc *DomainAssoc) error {
+	assoc.Domain = canonicalDomain(assoc.Domain)
+	assoc.AliasOf = canonicalAssocPath(assoc.AliasOf)
+	err := validateDomainAssoc(assoc)
+	if err == nil {
+		err = checkAliasOf(c, s.AssocStore, assoc)
+	}
+	if err != nil {
+		return err
+	}
+	return s.AssocStore.PutDomainAssoc(c, assoc)
+}
@@ -0,0 +1,352 @@
+package gipspot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Actions of audit entries.
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// Actors of the changes gopherpath makes by itself.  ServerActor issues
+// verification tokens and records verifications requested by anyone, and
+// SetupActor makes the changes of the setup pages.
+const (
+	ServerActor = "gopherpath"
+	SetupActor  = "setup"
+)
+
+// AuditEntry records a change of an association, or of one of its package
+// mappings, by an actor.  Before and After hold the JSON of the changed
+// DomainAssoc, or of the Package if Package is set.
+type AuditEntry struct {
+	Time    time.Time       `json:"time"`
+	Actor   string          `json:"actor"`             // user making the change
+	Action  string          `json:"action"`            // AuditCreate, AuditUpdate or AuditDelete
+	Assoc   string          `json:"assoc"`             // key of the association
+	Path    string          `json:"path"`              // import path of the association
+	Package string          `json:"package,omitempty"` // root of the changed package mapping
+	Before  json.RawMessage `json:"before,omitempty"`  // value before the change; absent for creations
+	After   json.RawMessage `json:"after,omitempty"`   // value after the change; absent for deletions
+}
+
+// AuditQuery selects audit entries.  Empty fields match every entry.
+type AuditQuery struct {
+	Assoc   string
+	Path    string
+	Package string
+	Actor   string
+	Since   time.Time // entries at or after Since
+	Until   time.Time // entries before Until
+	Limit   int       // the most recent entries matching, if positive
+}
+
+func (q *AuditQuery) matches(e *AuditEntry) bool {
+	return (q.Assoc == "" || e.Assoc == q.Assoc) &&
+		(q.Path == "" || e.Path == q.Path) &&
+		(q.Package == "" || e.Package == q.Package) &&
+		(q.Actor == "" || e.Actor == q.Actor) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until))
+}
+
+// filter returns the entries matching q, oldest first.
+func (q *AuditQuery) filter(entries []AuditEntry) []AuditEntry {
+	var match []AuditEntry
+	for i := range entries {
+		if q.matches(&entries[i]) {
+			match = append(match, entries[i])
+		}
+	}
+	if q.Limit > 0 && len(match) > q.Limit {
+		match = match[len(match)-q.Limit:]
+	}
+	return match
+}
+
+// AuditLog is an append-only record of changes.  Entries are never changed
+// or removed through it.
+type AuditLog interface {
+	// AppendAudit adds entries to the end of the log.
+	AppendAudit(c Context, entries ...AuditEntry) error
+
+	// QueryAudit returns the entries matching q, oldest first.
+	QueryAudit(c Context, q AuditQuery) ([]AuditEntry, error)
+}
+
+// storeFor returns the store changes made by actor are written to, recording
+// them in s.Audit.
+func (s *Server) storeFor(actor string) AssocStore {
+	return Audited(s.Store, s.Audit, actor)
+}
+
+// Audited returns an AssocStore recording every change made through store to
+// log as made by actor.  The entries for an update are an AuditUpdate of the
+// association if anything but its packages changed, and one entry per
+// package mapping created, updated or deleted, relative to the stored
+// revision the update replaces.  An update of any other revision fails with
+// ErrConflict.  A change which is stored but can't be recorded is reported
+// with an *AuditError, so no change is made unrecorded without its maker
+// learning of it.  If log is nil store is returned.
+func Audited(store AssocStore, log AuditLog, actor string) AssocStore {
+	if log == nil {
+		return store
+	}
+	return &auditedStore{AssocStore: store, log: log, actor: actor}
+}
+
+// AuditError is returned by an audited store for a change which was stored
+// but couldn't be recorded in its audit log.  The change is not undone.
+type AuditError struct {
+	Err error
+}
+
+func (err *AuditError) Error() string {
+	return "change stored but not recorded in the audit log: " + err.Err.Error()
+}
+
+type auditedStore struct {
+	AssocStore
+	log   AuditLog
+	actor string
+}
+
+func (s *auditedStore) PutDomainAssoc(c Context, assoc *DomainAssoc) error {
+	var before *DomainAssoc
+	if assoc.Key != "" {
+		var err error
+		before, err = s.AssocStore.GetDomainAssoc(c, assoc.Key)
+		if err != nil && err != ErrNoSuchAssoc {
+			return err
+		}
+		// the store only accepts assoc over the revision it was read at, so
+		// a different one read here would record a change never made.
+		if before != nil && before.Revision != assoc.Revision {
+			return ErrConflict
+		}
+	}
+	err := s.AssocStore.PutDomainAssoc(c, assoc)
+	if err != nil {
+		return err
+	}
+	after := copyDomainAssoc(*assoc)
+	return s.record(c, auditEntries(before, &after))
+}
+
+func (s *auditedStore) DeleteDomainAssoc(c Context, key string) error {
+	before, err := s.AssocStore.GetDomainAssoc(c, key)
+	if err != nil {
+		return err
+	}
+	err = s.AssocStore.DeleteDomainAssoc(c, key)
+	if err != nil {
+		return err
+	}
+	return s.record(c, auditEntries(before, nil))
+}
+
+func (s *auditedStore) record(c Context, entries []AuditEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	now := time.Now()
+	for i := range entries {
+		entries[i].Time = now
+		entries[i].Actor = s.actor
+	}
+	err := s.log.AppendAudit(c, entries...)
+	if err != nil {
+		c.Criticalf("unable to record %d audit entries for %v by %v: %v", len(entries), entries[0].Path, s.actor, err)
+		return &AuditError{err}
+	}
+	return nil
+}
+
+// auditEntries returns the entries recording the change of an association
+// from before to after, without their time and actor.  before is nil for a
+// created association and after is nil for a deleted one.
+func auditEntries(before, after *DomainAssoc) []AuditEntry {
+	switch {
+	case before == nil && after == nil:
+		return nil
+	case before == nil:
+		return []AuditEntry{{Action: AuditCreate, Assoc: after.Key, Path: after.Path(), After: auditJSON(after)}}
+	case after == nil:
+		return []AuditEntry{{Action: AuditDelete, Assoc: before.Key, Path: before.Path(), Before: auditJSON(before)}}
+	}
+	var entries []AuditEntry
+	if !bytes.Equal(auditJSON(auditSettings(before)), auditJSON(auditSettings(after))) {
+		entries = append(entries, AuditEntry{
+			Action: AuditUpdate,
+			Assoc:  after.Key,
+			Path:   after.Path(),
+			Before: auditJSON(before),
+			After:  auditJSON(after),
+		})
+	}
+	for i := range before.Packages {
+		old := &before.Packages[i]
+		entry := AuditEntry{Assoc: after.Key, Path: after.Path(), Package: old.Root, Before: auditJSON(old)}
+		pkg := after.Package(old.Root)
+		switch {
+		case pkg == nil:
+			entry.Action = AuditDelete
+		case !samePackage(old, pkg):
+			entry.Action = AuditUpdate
+			entry.After = auditJSON(pkg)
+		default:
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	for i := range after.Packages {
+		pkg := &after.Packages[i]
+		if before.Package(pkg.Root) == nil {
+			entries = append(entries, AuditEntry{
+				Action:  AuditCreate,
+				Assoc:   after.Key,
+				Path:    after.Path(),
+				Package: pkg.Root,
+				After:   auditJSON(pkg),
+			})
+		}
+	}
+	return entries
+}
+
+// auditSettings returns assoc without the fields recorded by package entries
+// or maintained by stores.
+func auditSettings(assoc *DomainAssoc) DomainAssoc {
+	settings := *assoc
+	settings.Packages = nil
+	settings.Modified = time.Time{}
+	settings.Revision = 0
+	settings.Schema = 0
+	return settings
+}
+
+// samePackage returns true if a and b differ at most in their modification
+// time.
+func samePackage(a, b *Package) bool {
+	x, y := *a, *b
+	x.Modified, y.Modified = time.Time{}, time.Time{}
+	return x == y
+}
+
+func auditJSON(v interface{}) json.RawMessage {
+	p, err := json.Marshal(v)
+	if err != nil {
+		// associations and packages always marshal.
+		panic(err)
+	}
+	return p
+}
+
+type byTime []AuditEntry
+
+func (s byTime) Len() int           { return len(s) }
+func (s byTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byTime) Less(i, j int) bool { return s[i].Time.Before(s[j].Time) }
+
+// MemAuditLog is an AuditLog holding entries in memory.  The zero value is
+// an empty log ready to use.
+type MemAuditLog struct {
+	mut     sync.Mutex
+	entries []AuditEntry
+}
+
+func (l *MemAuditLog) AppendAudit(c Context, entries ...AuditEntry) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.entries = append(l.entries, entries...)
+	return nil
+}
+
+func (l *MemAuditLog) QueryAudit(c Context, q AuditQuery) ([]AuditEntry, error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return q.filter(l.entries), nil
+}
+
+// FileAuditLog is an AuditLog appending entries to a file as JSON lines, one
+// entry per line, so the file itself is an export of the log.  Queries read
+// the whole file.
+type FileAuditLog struct {
+	path string
+	mut  sync.Mutex
+}
+
+// OpenFileAuditLog returns a FileAuditLog for the file at path, which is
+// created with the first entry if it does not exist.
+func OpenFileAuditLog(path string) (*FileAuditLog, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &FileAuditLog{path: path}, nil
+}
+
+func (l *FileAuditLog) AppendAudit(c Context, entries ...AuditEntry) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	err = WriteAuditJSONLines(f, entries)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (l *FileAuditLog) QueryAudit(c Context, q AuditQuery) ([]AuditEntry, error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var entry AuditEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", l.path, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return q.filter(entries), nil
+}
+
+// WriteAuditJSONLines writes entries to w as JSON lines.
+func WriteAuditJSONLines(w io.Writer, entries []AuditEntry) error {
+	enc := json.NewEncoder(w)
+	for i := range entries {
+		err := enc.Encode(&entries[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
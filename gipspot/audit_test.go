@@ -0,0 +1,200 @@
+package gipspot
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditEntries(t *testing.T) {
+	assoc := DomainAssoc{Key: "1", Domain: "foo.io", GitHubLogin: "mcfoo", Packages: []Package{
+		{Root: "bar"},
+		{Root: "baz"},
+	}}
+	changed := copyDomainAssoc(assoc)
+	changed.Revision, changed.Modified = 2, time.Now()
+	changed.Packages[0].Modified = time.Now()
+	changed.Packages[1].Repo = "qux"
+	changed.Packages = append(changed.Packages[1:], Package{Root: "new"})
+	renamed := assoc
+	renamed.GitHubLogin = "mcbar"
+
+	for i, test := range []struct {
+		Before, After *DomainAssoc
+		Expect        []string
+	}{
+		{nil, &assoc, []string{"create foo.io"}},
+		{&assoc, nil, []string{"delete foo.io"}},
+		{&assoc, &assoc, nil},
+		{&assoc, &renamed, []string{"update foo.io"}},
+		{&assoc, &changed, []string{"delete foo.io bar", "update foo.io baz", "create foo.io new"}},
+	} {
+		var got []string
+		for _, e := range auditEntries(test.Before, test.After) {
+			got = append(got, strings.TrimSpace(e.Action+" "+e.Path+" "+e.Package))
+		}
+		if strings.Join(got, ", ") != strings.Join(test.Expect, ", ") {
+			t.Errorf("test %d: unexpected entries %q", i, got)
+		}
+	}
+}
+
+func TestAdminAudit(t *testing.T) {
+	s := testServer()
+	s.Authenticate = BearerTokens(map[string]string{"s3cret": "admin"})
+	s.Audit = new(MemAuditLog)
+
+	apiRequest(s, "POST", "/assocs", `{"domain": "foo.io", "githubLogin": "mcfoo"}`)
+	apiRequest(s, "PUT", "/assocs/1/packages/bar", `{"repo": "baz"}`)
+	apiRequest(s, "DELETE", "/assocs/1/packages/bar", ``)
+	apiRequest(s, "DELETE", "/assocs/1", ``)
+
+	resp := apiRequest(s, "GET", "/audit", "")
+	var entries []AuditEntry
+	decodeAPI(t, resp, &entries)
+	if len(entries) != 4 {
+		t.Fatalf("unexpected entries: %q", resp.Body.String())
+	}
+	for i, action := range []string{AuditCreate, AuditCreate, AuditDelete, AuditDelete} {
+		if e := entries[i]; e.Action != action || e.Actor != "admin" || e.Assoc != "1" || e.Path != "foo.io" {
+			t.Errorf("entry %d: unexpected entry: %#v", i, e)
+		}
+	}
+	var pkg Package
+	if err := json.Unmarshal(entries[1].After, &pkg); err != nil || entries[1].Package != "bar" || pkg.Repo != "baz" {
+		t.Errorf("unexpected package entry: %#v %v", entries[1], err)
+	}
+
+	resp = apiRequest(s, "GET", "/audit?package=bar&limit=1", "")
+	decodeAPI(t, resp, &entries)
+	if len(entries) != 1 || entries[0].Action != AuditDelete || entries[0].Package != "bar" {
+		t.Errorf("unexpected queried entries: %q", resp.Body.String())
+	}
+
+	resp = apiRequest(s, "GET", "/audit?format=jsonl", "")
+	if lines := strings.Split(strings.TrimSpace(resp.Body.String()), "\n"); len(lines) != 4 || !strings.HasPrefix(lines[0], "{") {
+		t.Errorf("unexpected json lines: %q", resp.Body.String())
+	}
+	if resp := apiRequest(s, "GET", "/audit?since=yesterday", ""); resp.Code != http.StatusBadRequest {
+		t.Errorf("invalid query accepted: %d", resp.Code)
+	}
+}
+
+func TestFileAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gipspot-audit-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "audit.jsonl")
+	l, err := OpenFileAuditLog(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := Audited(NewMemStore(), l, "alice")
+	assoc := DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo"}
+	store.PutDomainAssoc(testContext, &assoc)
+	assoc.Packages = []Package{{Root: "bar"}}
+	store.PutDomainAssoc(testContext, &assoc)
+
+	// reopening the log appends to it.
+	l, err = OpenFileAuditLog(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Audited(NewMemStore(assoc), l, "bob").DeleteDomainAssoc(testContext, "1")
+
+	entries, err := l.QueryAudit(testContext, AuditQuery{Actor: "alice"})
+	if err != nil || len(entries) != 2 || entries[1].Package != "bar" {
+		t.Errorf("unexpected entries: %#v %v", entries, err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); lines++ {
+	}
+	if lines != 3 {
+		t.Errorf("log has %d lines", lines)
+	}
+}
+
+// brokenAuditLog is an AuditLog failing to append.
+type brokenAuditLog struct {
+	MemAuditLog
+}
+
+func (l *brokenAuditLog) AppendAudit(c Context, entries ...AuditEntry) error {
+	return errors.New("disk full")
+}
+
+func TestAuditFailure(t *testing.T) {
+	s := testServer()
+	s.Authenticate = BearerTokens(map[string]string{"s3cret": "admin"})
+	s.Audit = new(brokenAuditLog)
+
+	resp := apiRequest(s, "POST", "/assocs", `{"domain": "foo.io", "githubLogin": "mcfoo"}`)
+	if resp.Code != http.StatusInternalServerError || !strings.Contains(resp.Body.String(), "audit log") {
+		t.Errorf("audit failure not reported: %d %q", resp.Code, resp.Body.String())
+	}
+	// the change itself is kept.
+	if _, err := s.Store.GetDomainAssoc(testContext, "1"); err != nil {
+		t.Errorf("change not stored: %v", err)
+	}
+	err := Audited(s.Store, s.Audit, "admin").DeleteDomainAssoc(testContext, "1")
+	if _, ok := err.(*AuditError); !ok {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// laxStore is a MemStore overwriting associations whatever revision they
+// were read at.
+type laxStore struct {
+	*MemStore
+}
+
+func (s laxStore) PutDomainAssoc(c Context, assoc *DomainAssoc) error {
+	if stored, err := s.MemStore.GetDomainAssoc(c, assoc.Key); err == nil {
+		assoc.Revision = stored.Revision
+	}
+	return s.MemStore.PutDomainAssoc(c, assoc)
+}
+
+func TestAuditedConflict(t *testing.T) {
+	store := laxStore{NewMemStore(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo"})}
+	log := new(MemAuditLog)
+	audited := Audited(store, log, "admin")
+
+	stale, _ := store.GetDomainAssoc(testContext, "1")
+	fresh, _ := store.GetDomainAssoc(testContext, "1")
+	fresh.GitHubLogin = "mcbar"
+	if err := audited.PutDomainAssoc(testContext, fresh); err != nil {
+		t.Fatal(err)
+	}
+	// a change made to a replaced revision would be recorded as a change
+	// of the one replacing it.
+	stale.GitHubLogin = "mcbaz"
+	if err := audited.PutDomainAssoc(testContext, stale); err != ErrConflict {
+		t.Errorf("unexpected error: %v", err)
+	}
+	entries, _ := log.QueryAudit(testContext, AuditQuery{})
+	if len(entries) != 1 {
+		t.Fatalf("unexpected entries: %#v", entries)
+	}
+	var before DomainAssoc
+	if err := json.Unmarshal(entries[0].Before, &before); err != nil || before.GitHubLogin != "mcfoo" || before.Revision != 1 {
+		t.Errorf("unexpected predecessor: %#v %v", before, err)
+	}
+	if assoc, _ := store.GetDomainAssoc(testContext, "1"); assoc.GitHubLogin != "mcbar" {
+		t.Errorf("stale change stored: %#v", assoc)
+	}
+}
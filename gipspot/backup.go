@@ -0,0 +1,250 @@
+package gipspot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// BackupVersion is the version of the Backup documents written by
+// ExportBackup.  ReadBackup accepts documents of this version or older.
+const BackupVersion = 1
+
+// Backup is a versioned document holding every association of a store,
+// including package mappings, aliases, access tokens, settings and
+// verification state.  It is independent of the store backend, so a backup
+// of the datastore may be restored to a file store and the other way round.
+type Backup struct {
+	Version int           `json:"version"`
+	Created time.Time     `json:"created"`
+	Assocs  []DomainAssoc `json:"assocs"`
+}
+
+// Modes of ImportBackup.
+const (
+	ImportMerge   = "merge"   // associations of the backup replace those with the same path; others are kept
+	ImportReplace = "replace" // associations missing from the backup are also deleted
+)
+
+// ImportOptions control ImportBackup.
+type ImportOptions struct {
+	Mode   string // ImportMerge if empty
+	DryRun bool   // return the changes without making them
+}
+
+// BackupChange describes a change ImportBackup makes to an association,
+// identified by its import path.
+type BackupChange struct {
+	Action string       `json:"action"` // AuditCreate, AuditUpdate or AuditDelete
+	Path   string       `json:"path"`
+	Before *DomainAssoc `json:"before,omitempty"`
+	After  *DomainAssoc `json:"after,omitempty"`
+}
+
+// ExportBackup returns a Backup of every association of store.
+func ExportBackup(c Context, store AssocStore) (*Backup, error) {
+	assocs, err := store.ListDomainAssocs(c)
+	if err != nil {
+		return nil, err
+	}
+	if assocs == nil {
+		assocs = []DomainAssoc{}
+	}
+	sort.Sort(byPath(assocs))
+	return &Backup{Version: BackupVersion, Created: time.Now(), Assocs: assocs}, nil
+}
+
+// ReadBackup decodes a Backup from r.  An error is returned if the document
+// has no version or a version newer than BackupVersion.  Associations of an
+// older schema are upgraded.
+func ReadBackup(r io.Reader) (*Backup, error) {
+	b := new(Backup)
+	err := json.NewDecoder(r).Decode(b)
+	if err != nil {
+		return nil, err
+	}
+	if b.Version < 1 || b.Version > BackupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d (expected 1 to %d)", b.Version, BackupVersion)
+	}
+	for i := range b.Assocs {
+		upgradeAssoc(&b.Assocs[i])
+	}
+	return b, nil
+}
+
+// ImportBackup restores the associations of b to store, matching them with
+// stored associations by import path, and returns the changes made.  Stores
+// assign keys of their own, so the keys in b are ignored.  Every association
+// of b is validated before anything is changed.  An association equal to the
+// stored one but for its key, revision and modification times is left
+// alone, so an import which fails part way can be run again.
+func ImportBackup(c Context, store AssocStore, b *Backup, opts ImportOptions) ([]BackupChange, error) {
+	changes, err := planImport(c, store, b, opts)
+	if err != nil || opts.DryRun {
+		return changes, err
+	}
+	for i := range changes {
+		ch := &changes[i]
+		switch ch.Action {
+		case AuditDelete:
+			err = store.DeleteDomainAssoc(c, ch.Before.Key)
+			if err == ErrNoSuchAssoc {
+				err = nil
+			}
+		default:
+			after := copyDomainAssoc(*ch.After)
+			err = store.PutDomainAssoc(c, &after)
+			ch.After = &after
+		}
+		if err != nil {
+			return changes[:i], fmt.Errorf("%v: %v", ch.Path, err)
+		}
+	}
+	return changes, nil
+}
+
+// planImport returns the changes importing b makes to store.  Deletions come
+// last so nothing is lost if an import fails part way.
+func planImport(c Context, store AssocStore, b *Backup, opts ImportOptions) ([]BackupChange, error) {
+	switch opts.Mode {
+	case "", ImportMerge, ImportReplace:
+	default:
+		return nil, fmt.Errorf("unknown import mode %q", opts.Mode)
+	}
+	seen := make(map[string]bool)
+	for i := range b.Assocs {
+		assoc := &b.Assocs[i]
+		err := validateDomainAssoc(assoc)
+		if err != nil {
+			return nil, err.(*ValidationError).prefix(fmt.Sprintf("assocs[%d]", i))
+		}
+		if seen[assoc.Path()] {
+			return nil, &ValidationError{fmt.Sprintf("assocs[%d].domain", i), fmt.Sprintf("duplicate association for %v", assoc.Path())}
+		}
+		seen[assoc.Path()] = true
+	}
+
+	assocs, err := store.ListDomainAssocs(c)
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]*DomainAssoc)
+	for i := range assocs {
+		assoc := &assocs[i]
+		if other := stored[assoc.Path()]; other != nil {
+			return nil, &ConflictError{Domain: assoc.Domain, Prefix: assoc.Prefix, Keys: []string{other.Key, assoc.Key}}
+		}
+		stored[assoc.Path()] = assoc
+	}
+
+	var changes []BackupChange
+	for i := range b.Assocs {
+		after := copyDomainAssoc(b.Assocs[i])
+		after.Key, after.Revision = "", 0
+		ch := BackupChange{Action: AuditCreate, Path: after.Path(), After: &after}
+		if before := stored[ch.Path]; before != nil {
+			if sameBackupAssoc(before, &after) {
+				continue
+			}
+			after.Key, after.Revision = before.Key, before.Revision
+			ch.Action, ch.Before = AuditUpdate, before
+		}
+		changes = append(changes, ch)
+	}
+	if opts.Mode == ImportReplace {
+		sort.Sort(byPath(assocs))
+		for i := range assocs {
+			if !seen[assocs[i].Path()] {
+				changes = append(changes, BackupChange{Action: AuditDelete, Path: assocs[i].Path(), Before: &assocs[i]})
+			}
+		}
+	}
+	return changes, nil
+}
+
+// sameBackupAssoc returns true if a and b differ at most in the fields stores
+// maintain.
+func sameBackupAssoc(a, b *DomainAssoc) bool {
+	return bytes.Equal(auditJSON(backupSettings(a)), auditJSON(backupSettings(b)))
+}
+
+func backupSettings(assoc *DomainAssoc) DomainAssoc {
+	settings := auditSettings(assoc)
+	settings.Key = ""
+	settings.Packages = append([]Package(nil), assoc.Packages...)
+	for i := range settings.Packages {
+		settings.Packages[i].Modified = time.Time{}
+	}
+	return settings
+}
+
+// DiffAssocs describes the differences of the settings of a and b, either of
+// which may be nil, as lines of the form "-field: value" and "+field: value".
+// Packages are compared by root as fields "packages[root]".
+func DiffAssocs(a, b *DomainAssoc) []string {
+	fa, fb := diffFields(a), diffFields(b)
+	var names []string
+	for name := range fa {
+		names = append(names, name)
+	}
+	for name := range fb {
+		if _, ok := fa[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, name := range names {
+		va, vb := fa[name], fb[name]
+		if va == vb {
+			continue
+		}
+		if va != "" {
+			lines = append(lines, fmt.Sprintf("-%s: %s", name, va))
+		}
+		if vb != "" {
+			lines = append(lines, fmt.Sprintf("+%s: %s", name, vb))
+		}
+	}
+	return lines
+}
+
+// diffFields returns the JSON of the fields of assoc compared by DiffAssocs.
+// Empty fields are left out.
+func diffFields(assoc *DomainAssoc) map[string]string {
+	fields := make(map[string]string)
+	if assoc == nil {
+		return fields
+	}
+	settings := backupSettings(assoc)
+	pkgs := settings.Packages
+	settings.Packages = nil
+	var m map[string]json.RawMessage
+	json.Unmarshal(auditJSON(settings), &m)
+	for name, v := range m {
+		switch string(v) {
+		case "null", `""`, "false", "0", `"0001-01-01T00:00:00Z"`, "[]":
+			continue
+		}
+		if name == "key" || name == "revision" || name == "modified" {
+			continue
+		}
+		fields[name] = string(v)
+	}
+	for i := range pkgs {
+		var pm map[string]json.RawMessage
+		json.Unmarshal(auditJSON(&pkgs[i]), &pm)
+		delete(pm, "modified")
+		fields["packages["+pkgs[i].Root+"]"] = string(auditJSON(pm))
+	}
+	return fields
+}
+
+type byPath []DomainAssoc
+
+func (s byPath) Len() int           { return len(s) }
+func (s byPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byPath) Less(i, j int) bool { return s[i].Path() < s[j].Path() }
@@ -0,0 +1,103 @@
+package gipspot
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	src := NewMemStore(
+		verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo", Packages: []Package{{Root: "bar", Private: true}}}),
+		verified(DomainAssoc{Domain: "go.foo.io", AliasOf: "foo.io"}),
+	)
+	b, err := ExportBackup(testContext, src)
+	if err != nil || b.Version != BackupVersion || len(b.Assocs) != 2 {
+		t.Fatalf("unexpected backup: %#v %v", b, err)
+	}
+	p, _ := json.Marshal(b)
+	b, err = ReadBackup(bytes.NewReader(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := NewMemStore(
+		DomainAssoc{Domain: "foo.io", GitHubLogin: "mcbar"},
+		DomainAssoc{Domain: "qux.io", GitHubLogin: "mcqux"},
+	)
+	changes, err := ImportBackup(testContext, dst, b, ImportOptions{DryRun: true})
+	if err != nil || len(changes) != 2 || changes[0].Action != AuditUpdate || changes[1].Action != AuditCreate {
+		t.Fatalf("unexpected dry run: %#v %v", changes, err)
+	}
+	if assoc, _ := dst.GetDomainAssoc(testContext, "1"); assoc.GitHubLogin != "mcbar" {
+		t.Errorf("dry run changed the store: %#v", assoc)
+	}
+	if diff := strings.Join(DiffAssocs(changes[0].Before, changes[0].After), "\n"); !strings.Contains(diff, `-githubLogin: "mcbar"`) ||
+		!strings.Contains(diff, `+githubLogin: "mcfoo"`) || !strings.Contains(diff, `+packages[bar]: {"private":true,"root":"bar"}`) {
+		t.Errorf("unexpected diff: %s", diff)
+	}
+
+	changes, err = ImportBackup(testContext, dst, b, ImportOptions{Mode: ImportMerge})
+	if err != nil || len(changes) != 2 {
+		t.Fatalf("unexpected merge: %#v %v", changes, err)
+	}
+	assoc, _ := dst.GetDomainAssoc(testContext, "1")
+	if assoc.GitHubLogin != "mcfoo" || !assoc.IsActive() || len(assoc.Packages) != 1 {
+		t.Errorf("association not restored: %#v", assoc)
+	}
+	if assocs, _ := dst.ListDomainAssocs(testContext); len(assocs) != 3 {
+		t.Errorf("merge left %d associations", len(assocs))
+	}
+
+	changes, err = ImportBackup(testContext, dst, b, ImportOptions{Mode: ImportReplace})
+	if err != nil || len(changes) != 1 || changes[0].Action != AuditDelete || changes[0].Path != "qux.io" {
+		t.Fatalf("unexpected replace: %#v %v", changes, err)
+	}
+	changes, err = ImportBackup(testContext, dst, b, ImportOptions{Mode: ImportReplace})
+	if err != nil || len(changes) != 0 {
+		t.Errorf("repeated import made changes: %#v %v", changes, err)
+	}
+
+	for i, doc := range []string{
+		`{"assocs": []}`,
+		`{"version": 99, "assocs": []}`,
+	} {
+		if _, err := ReadBackup(strings.NewReader(doc)); err == nil {
+			t.Errorf("test %d: unsupported backup read", i)
+		}
+	}
+	bad := &Backup{Version: BackupVersion, Assocs: []DomainAssoc{{Domain: "ok.io"}, {Domain: "Bad.io"}}}
+	_, err = ImportBackup(testContext, dst, bad, ImportOptions{})
+	if verr, ok := err.(*ValidationError); !ok || verr.Field != "assocs[1].domain" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if assocs, _ := dst.GetDomainAssocs(testContext, "ok.io"); len(assocs) != 0 {
+		t.Errorf("invalid backup partially imported")
+	}
+}
+
+func TestAdminBackup(t *testing.T) {
+	s := testServer(verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo"}))
+	s.Authenticate = BearerTokens(map[string]string{"s3cret": "admin"})
+
+	resp := apiRequest(s, "GET", "/backup", "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("export: %d %q", resp.Code, resp.Body.String())
+	}
+	backup := strings.Replace(resp.Body.String(), "mcfoo", "mcbar", -1)
+	resp = apiRequest(s, "POST", "/backup?dryRun=true", backup)
+	var changes []BackupChange
+	decodeAPI(t, resp, &changes)
+	if len(changes) != 1 || changes[0].Action != AuditUpdate || changes[0].After.GitHubLogin != "mcbar" {
+		t.Errorf("unexpected dry run: %q", resp.Body.String())
+	}
+	if resp := apiRequest(s, "POST", "/backup?mode=append", backup); resp.Code != http.StatusBadRequest {
+		t.Errorf("unknown mode accepted: %d", resp.Code)
+	}
+	apiRequest(s, "POST", "/backup", backup)
+	if assoc, _ := s.Store.GetDomainAssoc(testContext, "1"); assoc.GitHubLogin != "mcbar" {
+		t.Errorf("backup not imported: %#v", assoc)
+	}
+}
@@ -0,0 +1,156 @@
+package gipspot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AdminClient is an AssocStore backed by the admin API of a running server,
+// so tools written against a store also manage remote deployments.  Errors
+// of the API are returned as the store errors they were made from.  Only
+// the fields of an association the API accepts are written; verification
+// state is changed with Verify.
+type AdminClient struct {
+	URL    string       // base URL of the server (e.g. https://example.com)
+	Token  string       // bearer token of an admin API user
+	Client *http.Client // http.DefaultClient if nil
+}
+
+func (cl *AdminClient) GetDomainAssoc(c Context, key string) (*DomainAssoc, error) {
+	assoc := new(DomainAssoc)
+	err := cl.do("GET", "/assocs/"+url.PathEscape(key), nil, assoc)
+	if err != nil {
+		return nil, err
+	}
+	return assoc, nil
+}
+
+func (cl *AdminClient) GetDomainAssocs(c Context, domain string) ([]DomainAssoc, error) {
+	return cl.list("domain", domain)
+}
+
+func (cl *AdminClient) GetDomainAssocsGitHubLogin(c Context, login string) ([]DomainAssoc, error) {
+	return cl.list("login", login)
+}
+
+func (cl *AdminClient) GetDomainAssocsAliasOf(c Context, p string) ([]DomainAssoc, error) {
+	return cl.list("aliasOf", p)
+}
+
+func (cl *AdminClient) ListDomainAssocs(c Context) ([]DomainAssoc, error) {
+	return cl.list("", "")
+}
+
+func (cl *AdminClient) list(param, value string) ([]DomainAssoc, error) {
+	p := "/assocs"
+	if param != "" {
+		if value == "" {
+			// the api lists everything for an empty parameter.
+			return nil, nil
+		}
+		p += "?" + url.Values{param: {value}}.Encode()
+	}
+	var assocs []DomainAssoc
+	err := cl.do("GET", p, nil, &assocs)
+	if err != nil {
+		return nil, err
+	}
+	return assocs, nil
+}
+
+// PutDomainAssoc creates assoc if its Key is empty and updates it otherwise.
+// assoc is replaced by the association stored, whose key and verification
+// token are chosen by the server when it is created.
+func (cl *AdminClient) PutDomainAssoc(c Context, assoc *DomainAssoc) error {
+	if assoc.Key == "" {
+		return cl.do("POST", "/assocs", assoc, assoc)
+	}
+	return cl.do("PUT", "/assocs/"+url.PathEscape(assoc.Key), assoc, assoc)
+}
+
+func (cl *AdminClient) DeleteDomainAssoc(c Context, key string) error {
+	return cl.do("DELETE", "/assocs/"+url.PathEscape(key), nil, nil)
+}
+
+// Verify asks the server to check the verification challenges of the
+// association identified by key, and returns the association if they hold.
+func (cl *AdminClient) Verify(c Context, key string) (*DomainAssoc, error) {
+	assoc := new(DomainAssoc)
+	err := cl.do("POST", "/assocs/"+url.PathEscape(key)+"/verify", nil, assoc)
+	if err != nil {
+		return nil, err
+	}
+	return assoc, nil
+}
+
+// do makes an admin API request for the endpoint p with the JSON of body,
+// if not nil, and decodes the response into v, if not nil.
+func (cl *AdminClient) do(method, p string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(cl.URL, "/")+AdminAPIPath+p, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if method != "GET" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cl.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cl.Token)
+	}
+	client := cl.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return apiResponseError(req, resp)
+	}
+	if v == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("%v %v: invalid response: %v", method, req.URL.Path, err)
+	}
+	return nil
+}
+
+// apiResponseError returns the store error an admin API error response was
+// made from.  See apiStoreError.
+func apiResponseError(req *http.Request, resp *http.Response) error {
+	p, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxAdminBody))
+	var body apiError
+	if json.Unmarshal(p, &body) != nil || body.Error == "" {
+		return fmt.Errorf("%v %v: %v", req.Method, req.URL.Path, resp.Status)
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound && body.Error == ErrNoSuchAssoc.Error():
+		return ErrNoSuchAssoc
+	case resp.StatusCode == http.StatusConflict && body.Field == "domain" && body.Error == ErrDomainTaken.Error():
+		return ErrDomainTaken
+	case (resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusPreconditionFailed) &&
+		body.Error == ErrConflict.Error():
+		return ErrConflict
+	case body.Field != "":
+		return &ValidationError{body.Field, body.Error}
+	}
+	return fmt.Errorf("%v %v: %v", req.Method, req.URL.Path, body.Error)
+}
@@ -0,0 +1,92 @@
+package gipspot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminClient(t *testing.T) {
+	s := testServer(verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo"}))
+	s.Authenticate = BearerTokens(map[string]string{"s3cret": "admin"})
+	s.Verifier = &Verifier{
+		Resolver: fakeDNS{"_gopherpath-challenge.go.foo.io": {"gopherpath-verify=s3cret"}},
+		Client:   func(Context) *http.Client { return &http.Client{Transport: failTransport{}} },
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	cl := &AdminClient{URL: srv.URL, Token: "s3cret"}
+
+	assoc := &DomainAssoc{Domain: "GO.foo.io", VerifyToken: "ignored", Verified: time.Now()}
+	if err := cl.PutDomainAssoc(testContext, assoc); err != nil {
+		t.Fatal(err)
+	}
+	if assoc.Key != "2" || assoc.Domain != "go.foo.io" || assoc.VerifyToken == "ignored" || assoc.IsVerified() {
+		t.Errorf("unexpected association created: %#v", assoc)
+	}
+	err := cl.PutDomainAssoc(testContext, &DomainAssoc{Domain: "go.foo.io"})
+	if err != ErrDomainTaken {
+		t.Errorf("unexpected error: %v", err)
+	}
+	alias := &DomainAssoc{Domain: "bar.io", AliasOf: "qux.io"}
+	err = cl.PutDomainAssoc(testContext, alias)
+	if verr, ok := err.(*ValidationError); !ok || verr.Field != "aliasOf" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	stale := *assoc
+	assoc.Packages = []Package{{Root: "bar"}}
+	if err := cl.PutDomainAssoc(testContext, assoc); err != nil || assoc.Revision != 2 {
+		t.Fatalf("update failed: %#v %v", assoc, err)
+	}
+	if err := cl.PutDomainAssoc(testContext, &stale); err != ErrConflict {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assocs, err := cl.GetDomainAssocs(testContext, "go.foo.io")
+	if err != nil || len(assocs) != 1 || len(assocs[0].Packages) != 1 {
+		t.Errorf("unexpected associations: %#v %v", assocs, err)
+	}
+
+	stored, _ := s.Store.GetDomainAssoc(testContext, "2")
+	stored.VerifyToken = "s3cret"
+	s.Store.PutDomainAssoc(testContext, stored)
+	assoc, err = cl.Verify(testContext, "2")
+	if err != nil || !assoc.IsVerified() {
+		t.Errorf("verification failed: %#v %v", assoc, err)
+	}
+	if _, err := cl.Verify(testContext, "1"); err == nil {
+		t.Errorf("association verified without a challenge")
+	}
+
+	if err := cl.DeleteDomainAssoc(testContext, "2"); err != nil {
+		t.Error(err)
+	}
+	if _, err := cl.GetDomainAssoc(testContext, "2"); err != ErrNoSuchAssoc {
+		t.Errorf("unexpected error: %v", err)
+	}
+	cl.Token = "bad"
+	if _, err := cl.ListDomainAssocs(testContext); err == nil {
+		t.Errorf("request with a bad token succeeded")
+	}
+}
+
+func TestValidated(t *testing.T) {
+	store := Validated(NewMemStore(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo"}))
+	assoc := DomainAssoc{Domain: "Go.Foo.io.", AliasOf: "FOO.io/"}
+	if err := store.PutDomainAssoc(testContext, &assoc); err != nil || assoc.Domain != "go.foo.io" || assoc.AliasOf != "foo.io" {
+		t.Errorf("unexpected association: %#v %v", assoc, err)
+	}
+	for i, bad := range []DomainAssoc{
+		{Domain: "bar.io", Packages: []Package{{Root: "a/b"}}},
+		{Domain: "bar.io", AliasOf: "qux.io"},
+		{Domain: "bar.io", AliasOf: "go.foo.io"},
+	} {
+		if err := store.PutDomainAssoc(testContext, &bad); err == nil {
+			t.Errorf("test %d: invalid association stored", i)
+		}
+	}
+	if a, err := GetAssocByPath(testContext, store, "GO.foo.io"); err != nil || a.Key != "2" {
+		t.Errorf("unexpected lookup: %#v %v", a, err)
+	}
+}
@@ -0,0 +1,286 @@
+package gipspot
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ErrDomainTaken is returned by an AssocStore when an association would be
+// stored for a domain and prefix which already have a different association.
+// There is at most one association per domain and prefix.
+var ErrDomainTaken = fmt.Errorf("domain already has an association")
+
+// checkDomainFree returns ErrDomainTaken if assoc would be created in store,
+// or moved to another domain or prefix, while another association has its
+// domain and prefix.  Updates leaving both alone are allowed even if the
+// domain has conflicting associations, so they can be merged.
+func checkDomainFree(c Context, store AssocStore, assoc *DomainAssoc) error {
+	if assoc.Key != "" {
+		current, err := store.GetDomainAssoc(c, assoc.Key)
+		if err == nil && current.Domain == assoc.Domain && current.Prefix == assoc.Prefix {
+			return nil
+		}
+		if err != nil && err != ErrNoSuchAssoc {
+			return err
+		}
+	}
+	others, err := store.GetDomainAssocs(c, assoc.Domain)
+	if err != nil {
+		return err
+	}
+	for _, other := range others {
+		if other.Prefix == assoc.Prefix && other.Key != assoc.Key {
+			return ErrDomainTaken
+		}
+	}
+	return nil
+}
+
+// ConflictError is returned by lookups of a domain with more than one
+// association, which stores created before associations were unique per
+// domain may hold.  Nothing is served for the domain until all but one of
+// the associations are deleted, by hand or with ResolveConflicts.
+type ConflictError struct {
+	Domain string
+	Prefix string
+	Keys   []string
+}
+
+func (err *ConflictError) Error() string {
+	return fmt.Sprintf("conflicting associations for %v: %v", path.Join(err.Domain, err.Prefix), strings.Join(err.Keys, ", "))
+}
+
+// lookupDomainAssoc returns the association serving reqpath on domain, the
+// one with the longest path prefix containing reqpath.  If there is none
+// ErrNoSuchAssoc is returned and if there are several a *ConflictError is.
+//
+// Associations of domain itself take precedence over wildcards.  Only if
+// domain has none is the wildcard association of its parent domain looked
+// up, and it serves domain only if it allows the subdomain label.  The
+// stored association is returned; forHost derives the one serving domain.
+func lookupDomainAssoc(c Context, store AssocStore, domain, reqpath string) (*DomainAssoc, error) {
+	assocs, err := store.GetDomainAssocs(c, domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(assocs) > 0 {
+		return matchDomainAssoc(c, assocs, domain, reqpath)
+	}
+	wildcard, label, ok := wildcardDomain(domain)
+	if !ok {
+		return nil, ErrNoSuchAssoc
+	}
+	assocs, err = store.GetDomainAssocs(c, wildcard)
+	if err != nil {
+		return nil, err
+	}
+	assoc, err := matchDomainAssoc(c, assocs, wildcard, reqpath)
+	if err == nil && !assoc.allowsLabel(label) {
+		c.Infof("label %q is not served by %v", label, wildcard)
+		return nil, ErrNoSuchAssoc
+	}
+	return assoc, err
+}
+
+// matchDomainAssoc returns the association of assocs, all for domain, with
+// the longest path prefix containing reqpath.
+func matchDomainAssoc(c Context, assocs []DomainAssoc, domain, reqpath string) (*DomainAssoc, error) {
+	rel := strings.TrimPrefix(path.Clean("/"+reqpath), "/")
+	var match []DomainAssoc
+	for _, assoc := range assocs {
+		if !assoc.hasPath(rel) {
+			continue
+		}
+		if len(match) > 0 && len(assoc.Prefix) < len(match[0].Prefix) {
+			continue
+		}
+		if len(match) > 0 && len(assoc.Prefix) > len(match[0].Prefix) {
+			match = match[:0]
+		}
+		match = append(match, assoc)
+	}
+	switch len(match) {
+	case 0:
+		return nil, ErrNoSuchAssoc
+	case 1:
+		return &match[0], nil
+	}
+	err := &ConflictError{Domain: domain, Prefix: match[0].Prefix, Keys: assocKeys(match)}
+	c.Criticalf("%v", err)
+	return nil, err
+}
+
+// writeConflict writes the error response for a domain whose associations
+// conflict.
+func writeConflict(resp http.ResponseWriter, err *ConflictError) {
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	resp.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintln(resp, err)
+	fmt.Fprintln(resp)
+	fmt.Fprintln(resp, "nothing is served for the domain until all but one of the associations are deleted.")
+}
+
+func assocKeys(assocs []DomainAssoc) []string {
+	keys := make([]string, len(assocs))
+	for i := range assocs {
+		keys[i] = assocs[i].Key
+	}
+	return keys
+}
+
+// Conflict describes a domain with more than one association.
+type Conflict struct {
+	Domain   string   `json:"domain"`
+	Prefix   string   `json:"prefix,omitempty"`
+	Keys     []string `json:"keys"`             // keys of the conflicting associations
+	Resolved bool     `json:"resolved"`         // the associations were (or can be) merged
+	Kept     string   `json:"kept,omitempty"`   // key of the association kept by a merge
+	Reason   string   `json:"reason,omitempty"` // why the conflict must be resolved by hand
+}
+
+// FindConflicts returns the domains of store with more than one association,
+// describing how ResolveConflicts would resolve each.
+func FindConflicts(c Context, store AssocStore) ([]Conflict, error) {
+	conflicts, _, err := planConflicts(c, store)
+	return conflicts, err
+}
+
+// ResolveConflicts merges the associations of each domain with more than one
+// association where that is safe and returns every conflict found.  A merge
+// keeps the active association, or the only verified one, adding the
+// packages it does not have from others of the same owner, and deletes the
+// others.  Associations of different owners which are both verified are left
+// for an admin to resolve and lookups of their domain keep failing.
+//
+// ResolveConflicts is idempotent.  If it fails part way it can be run again.
+func ResolveConflicts(c Context, store AssocStore) ([]Conflict, error) {
+	conflicts, merges, err := planConflicts(c, store)
+	if err != nil {
+		return conflicts, err
+	}
+	for _, m := range merges {
+		keep := m.keep
+		for _, other := range m.others {
+			if !sameOwner(keep, &other) {
+				// an unverified claim. its packages name other repositories.
+				continue
+			}
+			for _, pkg := range other.Packages {
+				if keep.Package(pkg.Root) == nil {
+					keep.Packages = append(keep.Packages, pkg)
+				}
+			}
+		}
+		// the kept association is stored before the others are removed so
+		// no package is lost if the merge fails part way.
+		err := store.PutDomainAssoc(c, keep)
+		if err != nil {
+			return conflicts, fmt.Errorf("%v: %v", keep.Domain, err)
+		}
+		for _, other := range m.others {
+			err := store.DeleteDomainAssoc(c, other.Key)
+			if err != nil && err != ErrNoSuchAssoc {
+				return conflicts, fmt.Errorf("%v: %v", keep.Domain, err)
+			}
+		}
+		c.Infof("merged associations %v of %v into %v", strings.Join(assocKeys(m.others), ", "), keep.Domain, keep.Key)
+	}
+	return conflicts, nil
+}
+
+// merge is a planned resolution of a conflict.
+type merge struct {
+	keep   *DomainAssoc
+	others []DomainAssoc
+}
+
+// planConflicts finds the conflicts in store and the merges resolving them.
+func planConflicts(c Context, store AssocStore) ([]Conflict, []merge, error) {
+	assocs, err := store.ListDomainAssocs(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	// associations conflict if they have the same domain and prefix.
+	byPath := make(map[string][]DomainAssoc)
+	var paths []string
+	for _, assoc := range assocs {
+		p := path.Join(assoc.Domain, assoc.Prefix)
+		if byPath[p] == nil {
+			paths = append(paths, p)
+		}
+		byPath[p] = append(byPath[p], assoc)
+	}
+	sort.Strings(paths)
+
+	var conflicts []Conflict
+	var merges []merge
+	for _, p := range paths {
+		group := byPath[p]
+		if len(group) < 2 {
+			continue
+		}
+		sort.Sort(byKey(group))
+		conflict := Conflict{Domain: group[0].Domain, Prefix: group[0].Prefix, Keys: assocKeys(group)}
+		keep, reason := chooseAssoc(group)
+		if keep < 0 {
+			conflict.Reason = reason
+			conflicts = append(conflicts, conflict)
+			continue
+		}
+		conflict.Resolved = true
+		conflict.Kept = group[keep].Key
+		conflicts = append(conflicts, conflict)
+		m := merge{keep: &group[keep]}
+		for i := range group {
+			if i != keep {
+				m.others = append(m.others, group[i])
+			}
+		}
+		merges = append(merges, m)
+	}
+	return conflicts, merges, nil
+}
+
+// chooseAssoc returns the index of the association of group which may
+// replace the others.  If there is none it returns -1 and the reason.
+func chooseAssoc(group []DomainAssoc) (int, string) {
+	// prefer active associations, then verified ones, then those with an
+	// owner.  the first association of the best kind is kept.
+	rank := func(assoc *DomainAssoc) int {
+		switch {
+		case assoc.IsActive():
+			return 3
+		case assoc.IsVerified():
+			return 2
+		case assoc.GitHubLogin != "":
+			return 1
+		}
+		return 0
+	}
+	keep := 0
+	for i := range group {
+		if rank(&group[i]) > rank(&group[keep]) {
+			keep = i
+		}
+	}
+	for i := range group {
+		other := &group[i]
+		if i == keep || !other.IsVerified() {
+			continue
+		}
+		if !sameOwner(&group[keep], other) {
+			return -1, fmt.Sprintf("associations %v and %v are verified for different owners", group[keep].Key, other.Key)
+		}
+	}
+	return keep, ""
+}
+
+// sameOwner returns true if a and b serve repositories of the same owner.
+func sameOwner(a, b *DomainAssoc) bool {
+	return a.GitHubLogin == b.GitHubLogin &&
+		providerName(a.Provider) == providerName(b.Provider) &&
+		strings.TrimSuffix(a.ProviderURL, "/") == strings.TrimSuffix(b.ProviderURL, "/")
+}
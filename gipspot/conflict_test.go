@@ -0,0 +1,159 @@
+package gipspot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// conflictStore returns a MemStore holding assocs, which may share domains as
+// stores written before associations were unique per domain can.
+func conflictStore(assocs ...DomainAssoc) *MemStore {
+	s := &MemStore{assocs: make(map[string]DomainAssoc)}
+	for i, assoc := range assocs {
+		s.nextKey++
+		assoc.Key = strconv.Itoa(i + 1)
+		assoc.Revision = 1
+		s.assocs[assoc.Key] = assoc
+	}
+	return s
+}
+
+func TestConflictLookup(t *testing.T) {
+	s := testServer()
+	s.Store = conflictStore(
+		verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo"}),
+		verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcbar"}),
+	)
+
+	req, _ := http.NewRequest("GET", "http://foo.io/bar?go-get=1", nil)
+	_, err := s.ImportMetas(req)
+	if cerr, ok := err.(*ConflictError); !ok || cerr.Domain != "foo.io" || len(cerr.Keys) != 2 {
+		t.Errorf("unexpected error for conflicting associations: %v", err)
+	}
+
+	for _, url := range []string{"http://foo.io/", "http://foo.io/sitemap.xml", "http://foo.io/bar?go-get=1"} {
+		resp := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		s.ServeHTTP(resp, req)
+		if resp.Code != http.StatusInternalServerError {
+			t.Errorf("%s: served despite conflicting associations: %d %q", url, resp.Code, resp.Body.String())
+		}
+	}
+	resp := httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://foo.io/", nil)
+	s.ServeHTTP(resp, req)
+	if !strings.Contains(resp.Body.String(), "conflicting associations for foo.io: 1, 2") {
+		t.Errorf("conflict not reported: %q", resp.Body.String())
+	}
+}
+
+func TestResolveConflicts(t *testing.T) {
+	store := conflictStore(
+		// merged into the active association, with its own packages first.
+		DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo", Packages: []Package{{Root: "a", Repo: "stale"}, {Root: "b"}}},
+		verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo", Packages: []Package{{Root: "a"}}}),
+		DomainAssoc{Domain: "foo.io", GitHubLogin: "squatter", Packages: []Package{{Root: "c"}}},
+		// verified for different owners.
+		verified(DomainAssoc{Domain: "bar.io", GitHubLogin: "mcbar"}),
+		verified(DomainAssoc{Domain: "bar.io", GitHubLogin: "mcbaz"}),
+		DomainAssoc{Domain: "qux.io", GitHubLogin: "mcqux"},
+	)
+
+	found, err := FindConflicts(testContext, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Fatalf("unexpected conflicts: %#v", found)
+	}
+	if c := found[0]; c.Domain != "bar.io" || c.Resolved || c.Reason == "" {
+		t.Errorf("unexpected conflict: %#v", c)
+	}
+	if c := found[1]; c.Domain != "foo.io" || !c.Resolved || c.Kept != "2" || len(c.Keys) != 3 {
+		t.Errorf("unexpected conflict: %#v", c)
+	}
+	if assocs, _ := store.ListDomainAssocs(testContext); len(assocs) != 6 {
+		t.Errorf("FindConflicts changed the store: %d associations", len(assocs))
+	}
+
+	for i := 0; i < 2; i++ {
+		// the second run finds nothing left to merge.
+		resolved, err := ResolveConflicts(testContext, store)
+		if err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+		if len(resolved) != 2-i {
+			t.Errorf("run %d: unexpected conflicts: %#v", i, resolved)
+		}
+	}
+
+	assoc, err := lookupDomainAssoc(testContext, store, "foo.io", "/")
+	if err != nil {
+		t.Fatalf("conflict not resolved: %v", err)
+	}
+	if assoc.Key != "2" || len(assoc.Packages) != 2 || assoc.Packages[0].Repo != "" || assoc.Packages[1].Root != "b" {
+		t.Errorf("unexpected merged association: %#v", assoc)
+	}
+	if _, err := lookupDomainAssoc(testContext, store, "bar.io", "/"); err == nil {
+		t.Errorf("conflict of verified associations resolved")
+	}
+
+	s := testServer()
+	s.Store = store
+	req, _ := http.NewRequest("GET", "http://foo.io/b?go-get=1", nil)
+	if _, err := s.ImportMetas(req); err != nil {
+		t.Errorf("lookup of merged association: %v", err)
+	}
+}
+
+// checkedStore is a MemStore which checks domains with checkDomainFree before
+// storing associations, as DatastoreStore does.
+type checkedStore struct {
+	*MemStore
+}
+
+func (s checkedStore) PutDomainAssoc(c Context, assoc *DomainAssoc) error {
+	err := checkDomainFree(c, s.MemStore, assoc)
+	if err != nil {
+		return err
+	}
+	return s.MemStore.PutDomainAssoc(c, assoc)
+}
+
+func TestCheckDomainFree(t *testing.T) {
+	store := checkedStore{conflictStore(
+		DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo", Packages: []Package{{Root: "a"}}},
+		verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo"}),
+		DomainAssoc{Domain: "qux.io", GitHubLogin: "mcqux"},
+	)}
+
+	// associations of a conflicted domain can still be edited.
+	assoc, _ := store.GetDomainAssoc(testContext, "1")
+	assoc.Packages = append(assoc.Packages, Package{Root: "b"})
+	if err := store.PutDomainAssoc(testContext, assoc); err != nil {
+		t.Errorf("edit of conflicting association failed: %v", err)
+	}
+	if err := store.PutDomainAssoc(testContext, &DomainAssoc{Domain: "foo.io"}); err != ErrDomainTaken {
+		t.Errorf("unexpected error creating association: %v", err)
+	}
+	assoc, _ = store.GetDomainAssoc(testContext, "3")
+	assoc.Domain = "foo.io"
+	if err := store.PutDomainAssoc(testContext, assoc); err != ErrDomainTaken {
+		t.Errorf("unexpected error moving association: %v", err)
+	}
+
+	p, err := Migrate(testContext, store, MigrateOptions{})
+	if err != nil || p.Migrated != 2 || len(p.Failed) != 0 {
+		t.Errorf("unexpected migration: %#v %v", p, err)
+	}
+	if _, err := ResolveConflicts(testContext, store); err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	assoc, err = lookupDomainAssoc(testContext, store, "foo.io", "/")
+	if err != nil || assoc.Key != "2" || len(assoc.Packages) != 2 {
+		t.Errorf("unexpected merged association: %#v %v", assoc, err)
+	}
+}
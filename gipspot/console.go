@@ -0,0 +1,818 @@
+package gipspot
+
+import (
+	"importmeta"
+	"pat"
+
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConsolePath is the path beneath which the admin console is served.  The
+// console is plain HTML and works without JavaScript.
+const ConsolePath = "/_gopherpath/console"
+
+// Console cookies.  The session cookie holds the signed identity of the
+// logged in user.  The csrf cookie holds a random token which must be
+// submitted with every form (the double submit cookie pattern).
+const (
+	sessionCookie   = "gopherpath_session"
+	csrfCookie      = "gopherpath_csrf"
+	sessionDuration = 12 * time.Hour
+)
+
+// PasswordLogin checks credentials entered in the console login form and
+// returns the identity of the user.
+type PasswordLogin func(user, password string) (string, error)
+
+// TokenLogin returns a PasswordLogin accepting a user's admin token, as given
+// to BearerTokens, as their password.
+func TokenLogin(tokens map[string]string) PasswordLogin {
+	return func(user, password string) (string, error) {
+		for token, u := range tokens {
+			if subtle.ConstantTimeCompare([]byte(password), []byte(token)) == 1 && u == user {
+				return user, nil
+			}
+		}
+		return "", ErrUnauthorized
+	}
+}
+
+var consoleTemplates = template.Must(template.New("console").Funcs(template.FuncMap{
+	"console": func(elem ...string) string {
+		return ConsolePath + "/" + strings.Join(elem, "/")
+	},
+	"join":      strings.Join,
+	"providers": ProviderNames,
+	"vcss":      func() []string { return VCSs },
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+	<head>
+		<title>gopherpath console</title>
+	</head>
+	<body>
+		<p><a href="{{console}}">associations</a>
+		{{if .User}}| {{.User}}
+		<form method="POST" action="{{console "logout"}}" style="display:inline">
+			<input type="hidden" name="csrf" value="{{.CSRF}}">
+			<input type="submit" value="log out">
+		</form>{{end}}</p>
+		{{with .Error}}<p><strong>error: {{.}}</strong></p>{{end}}
+		{{with .Message}}<p><em>{{.}}</em></p>{{end}}
+{{end}}
+
+{{define "footer"}}	</body>
+</html>
+{{end}}
+
+{{define "provider"}}
+			<p><label>provider <select name="provider">
+				{{$name := or .Provider "github"}}{{range providers}}<option{{if eq . $name}} selected{{end}}>{{.}}</option>{{end}}
+			</select></label></p>
+			<p><label>provider url (self-hosted only) <input type="text" name="providerURL" value="{{.ProviderURL}}"></label></p>
+			<p><label>owner <input type="text" name="githubLogin" value="{{.GitHubLogin}}"></label></p>
+{{end}}
+
+{{define "login"}}{{template "header" .}}
+		<h1>log in</h1>
+		<form method="POST" action="{{console "login"}}">
+			<input type="hidden" name="csrf" value="{{.CSRF}}">
+			<p><label>user <input type="text" name="user"></label></p>
+			<p><label>token <input type="password" name="password"></label></p>
+			<p><input type="submit" value="log in"></p>
+		</form>
+{{template "footer" .}}{{end}}
+
+{{define "index"}}{{template "header" .}}
+		{{with .Conflicts}}
+		<h2>conflicts</h2>
+		<p>nothing is served for these domains until all but one of their associations are deleted.</p>
+		<ul>
+			{{range .}}<li>{{.Domain}}{{with .Prefix}}/{{.}}{{end}}: {{range .Keys}}<a href="{{console "assoc" .}}">{{.}}</a> {{end}}
+			{{if .Resolved}}(can be merged into {{.Kept}}){{else}}({{.Reason}}){{end}}</li>
+			{{end}}
+		</ul>
+		<form method="POST" action="{{console "conflicts"}}">
+			<input type="hidden" name="csrf" value="{{$.CSRF}}">
+			<input type="submit" value="merge conflicting associations">
+		</form>
+		{{end}}
+		<h1>associations</h1>
+		<table>
+			<tr><th>domain</th><th>owner</th><th>status</th></tr>
+			{{range .Assocs}}
+			<tr>
+				<td><a href="{{console "assoc" .Key}}">{{.Path}}</a></td>
+				<td>{{with .OwnerURL}}<a href="{{.}}">{{.}}</a>{{end}}</td>
+				<td>{{with .AliasOf}}alias of {{.}}, {{end}}{{if .IsActive}}active{{else if .IsVerified}}no owner{{else}}unverified{{end}}</td>
+			</tr>
+			{{end}}
+		</table>
+		<h2>claim a domain</h2>
+		<form method="POST" action="{{console "claim"}}">
+			<input type="hidden" name="csrf" value="{{.CSRF}}">
+			<p><label>domain <input type="text" name="domain" value="{{.Assoc.Domain}}"></label></p>
+			<p><label>path prefix (optional) <input type="text" name="prefix" value="{{.Assoc.Prefix}}"></label></p>
+			{{template "provider" .Assoc}}
+			<p><input type="submit" value="claim"></p>
+		</form>
+{{template "footer" .}}{{end}}
+
+{{define "assoc"}}{{template "header" .}}
+		{{$csrf := .CSRF}}{{$assoc := .Assoc}}
+		<h1>{{$assoc.Path}}</h1>
+		{{with $assoc.AliasOf}}<p>alias of {{.}}, whose packages and settings are served under {{$assoc.Path}}.</p>{{end}}
+		<h2>verification</h2>
+		{{if $assoc.IsVerified}}
+		<p>verified {{$assoc.Verified.Format "2006-01-02 15:04 MST"}}</p>
+		{{else}}
+		<p>ownership of {{.VerifyDomain}} has not been verified. publish the DNS TXT record</p>
+		<pre>{{.TXTName}}. TXT "{{.TXTValue}}"</pre>
+		<p>or serve the following content at http://{{.VerifyDomain}}{{.VerifyPath}}</p>
+		<pre>{{$assoc.VerifyToken}}</pre>
+		<form method="POST" action="{{console "assoc" $assoc.Key "verify"}}">
+			<input type="hidden" name="csrf" value="{{$csrf}}">
+			<input type="submit" value="check verification">
+		</form>
+		{{end}}
+
+		<h2>settings</h2>
+		<form method="POST" action="{{console "assoc" $assoc.Key}}">
+			<input type="hidden" name="csrf" value="{{$csrf}}">
+			<input type="hidden" name="revision" value="{{$assoc.Revision}}">
+			{{template "provider" $assoc}}
+			{{if .Wildcard}}
+			<p>the owner of each subdomain is the owner template with {label} replaced by its label. leave the github login empty.</p>
+			<p><label>owner template <input type="text" name="ownerTemplate" value="{{$assoc.OwnerTemplate}}"></label></p>
+			<p><label>labels (comma separated, empty for all) <input type="text" name="labels" value="{{join $assoc.Labels ", "}}"></label></p>
+			{{end}}
+			<p><label>module proxy <input type="text" name="proxy" value="{{$assoc.Proxy}}"></label></p>
+			<p><label><input type="checkbox" name="requireToken" value="on"{{if $assoc.RequireToken}} checked{{end}}> every package requires credentials</label></p>
+			<p><input type="submit" value="save"></p>
+		</form>
+
+		<h2>packages</h2>
+		<table>
+			<tr><th>root</th><th>repository</th><th>subdirectory</th><th>owner</th><th>provider</th><th>vcs</th><th>status</th><th></th></tr>
+			{{range $assoc.Packages}}
+			<tr>
+				<td>{{.Root}}</td><td>{{.Repo}}</td><td>{{.Subdir}}</td>
+				<td>{{.Owner}}</td><td>{{.Provider}} {{.ProviderURL}}</td><td>{{.VCS}}</td>
+				<td>{{if .Disabled}}disabled{{else if .Private}}private{{else if .Hidden}}hidden{{else}}listed{{end}}</td>
+				<td><form method="POST" action="{{console "assoc" $assoc.Key "unmap"}}">
+					<input type="hidden" name="csrf" value="{{$csrf}}">
+					<input type="hidden" name="revision" value="{{$assoc.Revision}}">
+					<input type="hidden" name="root" value="{{.Root}}">
+					<input type="submit" value="remove">
+				</form></td>
+			</tr>
+			{{end}}
+		</table>
+		<h3>map a repository</h3>
+		<form method="POST" action="{{console "assoc" $assoc.Key "map"}}">
+			<input type="hidden" name="csrf" value="{{$csrf}}">
+			<input type="hidden" name="revision" value="{{$assoc.Revision}}">
+			<p><label>root <input type="text" name="root"></label></p>
+			<p><label>repository <input type="text" name="repo"></label></p>
+			<p><label>subdirectory <input type="text" name="subdir"></label></p>
+			<p>leave the following empty to use the settings of {{$assoc.Domain}}.</p>
+			<p><label>owner <input type="text" name="owner"></label></p>
+			<p><label>provider <select name="provider">
+				<option value="" selected></option>{{range providers}}<option>{{.}}</option>{{end}}
+			</select></label></p>
+			<p><label>provider url <input type="text" name="providerURL"></label></p>
+			<p><label>vcs <select name="vcs">
+				<option value="" selected></option>{{range vcss}}<option>{{.}}</option>{{end}}
+			</select></label></p>
+			<p><label><input type="checkbox" name="hidden" value="on"> hidden from the sitemap</label></p>
+			<p><label><input type="checkbox" name="private" value="on"> private (served only to authenticated clients)</label></p>
+			<p><label><input type="checkbox" name="disabled" value="on"> disabled</label></p>
+			<p><input type="submit" value="map"></p>
+		</form>
+
+		<h2>access tokens</h2>
+		{{with .Secret}}<p>give the holder the token below. it is not shown again.</p>
+		<pre>{{.}}</pre>{{end}}
+		<table>
+			<tr><th>id</th><th>holder</th><th>scope</th><th>expires</th><th>status</th><th></th></tr>
+			{{range $assoc.Tokens}}
+			<tr>
+				<td>{{.ID}}</td><td>{{.Name}}</td><td>{{or .Scope "everything"}}</td>
+				<td>{{if .Expires.IsZero}}never{{else}}{{.Expires.Format "2006-01-02 15:04 MST"}}{{end}}</td>
+				<td>{{if not .Revoked.IsZero}}revoked{{else if .IsValid $.Now}}valid{{else}}expired{{end}}</td>
+				<td>{{if .Revoked.IsZero}}<form method="POST" action="{{console "assoc" $assoc.Key "revoke"}}">
+					<input type="hidden" name="csrf" value="{{$csrf}}">
+					<input type="hidden" name="revision" value="{{$assoc.Revision}}">
+					<input type="hidden" name="id" value="{{.ID}}">
+					<input type="submit" value="revoke">
+				</form>{{end}}</td>
+			</tr>
+			{{end}}
+		</table>
+		<h3>issue a token</h3>
+		<form method="POST" action="{{console "assoc" $assoc.Key "issue"}}">
+			<input type="hidden" name="csrf" value="{{$csrf}}">
+			<input type="hidden" name="revision" value="{{$assoc.Revision}}">
+			<p><label>holder <input type="text" name="name"></label></p>
+			<p><label>scope (space separated paths, empty for everything) <input type="text" name="scope"></label></p>
+			<p><label>valid for days (empty for ever) <input type="text" name="days"></label></p>
+			<p><input type="submit" value="issue"></p>
+		</form>
+
+		<h2>preview</h2>
+		<form method="GET" action="{{console "assoc" $assoc.Key}}">
+			<p><label>{{$assoc.Path}}/<input type="text" name="preview" value="{{.Preview}}"></label>
+			<input type="submit" value="preview"></p>
+		</form>
+		{{with .PreviewOutput}}<pre>{{.}}</pre>{{end}}
+
+		<h2>delete</h2>
+		<form method="POST" action="{{console "assoc" $assoc.Key "delete"}}">
+			<input type="hidden" name="csrf" value="{{$csrf}}">
+			<input type="hidden" name="revision" value="{{$assoc.Revision}}">
+			<input type="submit" value="delete {{$assoc.Domain}}">
+		</form>
+{{template "footer" .}}{{end}}
+`))
+
+// consolePage is the context of console templates.
+type consolePage struct {
+	User    string
+	CSRF    string
+	Error   string
+	Message string
+
+	Assocs    []DomainAssoc
+	Conflicts []Conflict
+
+	Assoc        *DomainAssoc
+	Wildcard     bool
+	VerifyDomain string
+	TXTName      string
+	TXTValue     string
+	VerifyPath   string
+	Secret       string
+	Now          time.Time
+
+	SetupPath     string
+	SetupToken    string
+	Preview       string
+	PreviewOutput string
+}
+
+// consoleHandler is a console endpoint for a logged in user.
+type consoleHandler func(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request)
+
+// console returns the handler for requests beneath ConsolePath.
+func (s *Server) console() http.Handler {
+	s.consoleOnce.Do(func() {
+		m := pat.New()
+		m.Get(ConsolePath+"/login", http.HandlerFunc(s.consoleLoginForm))
+		m.Post(ConsolePath+"/login", http.HandlerFunc(s.consoleLogin))
+		m.Post(ConsolePath+"/logout", s.consoleAuth(s.consoleLogout))
+		m.Post(ConsolePath+"/claim", s.consoleAuth(s.consoleClaim))
+		m.Post(ConsolePath+"/conflicts", s.consoleAuth(s.consoleResolveConflicts))
+		m.Get(ConsolePath+"/assoc/:key", s.consoleAuth(s.consoleAssoc))
+		m.Post(ConsolePath+"/assoc/:key", s.consoleAuth(s.consoleUpdate))
+		m.Post(ConsolePath+"/assoc/:key/verify", s.consoleAuth(s.consoleVerify))
+		m.Post(ConsolePath+"/assoc/:key/map", s.consoleAuth(s.consoleMap))
+		m.Post(ConsolePath+"/assoc/:key/unmap", s.consoleAuth(s.consoleUnmap))
+		m.Post(ConsolePath+"/assoc/:key/issue", s.consoleAuth(s.consoleIssue))
+		m.Post(ConsolePath+"/assoc/:key/revoke", s.consoleAuth(s.consoleRevoke))
+		m.Post(ConsolePath+"/assoc/:key/delete", s.consoleAuth(s.consoleDelete))
+		// patterns ending in a slash match every path beneath them.
+		m.Get(ConsolePath+"/", s.consoleAuth(s.consoleIndex))
+		s.consoleMux = m
+	})
+	return s.consoleMux
+}
+
+// consoleAuth requires a logged in user, and a valid csrf token for POST
+// requests, before passing requests to fn.
+func (s *Server) consoleAuth(fn consoleHandler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		c := s.NewContext(req)
+		page := &consolePage{CSRF: csrfToken(resp, req)}
+		page.User = s.consoleUser(req)
+		if page.User == "" {
+			s.consoleLoginRedirect(c, resp, req)
+			return
+		}
+		if req.Method == "POST" && !checkCSRF(req) {
+			c.Warningf("console request from %v with a bad csrf token", page.User)
+			http.Error(resp, "invalid form token. reload the page and try again", http.StatusForbidden)
+			return
+		}
+		fn(c, page, resp, req)
+	})
+}
+
+// consoleLoginRedirect sends the client to log in.
+func (s *Server) consoleLoginRedirect(c Context, resp http.ResponseWriter, req *http.Request) {
+	switch {
+	case s.LoginURL != nil:
+		dest := ConsolePath + "/"
+		if req.Method == "GET" {
+			dest = req.URL.RequestURI()
+		}
+		loginURL, err := s.LoginURL(req, dest)
+		if err != nil {
+			c.Errorf("console login url: %v", err)
+			http.Error(resp, "an error occurred", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(resp, req, loginURL, http.StatusSeeOther)
+	case s.ConsoleLogin != nil:
+		http.Redirect(resp, req, ConsolePath+"/login", http.StatusSeeOther)
+	default:
+		http.Error(resp, "the console is disabled", http.StatusNotFound)
+	}
+}
+
+// consoleUser returns the user logged in to the console, or the empty string.
+func (s *Server) consoleUser(req *http.Request) string {
+	if cookie, err := req.Cookie(sessionCookie); err == nil {
+		if user, ok := s.checkSession(cookie.Value, time.Now()); ok {
+			return user
+		}
+	}
+	if s.Authenticate != nil {
+		if user, err := s.Authenticate(req); err == nil {
+			return user
+		}
+	}
+	return ""
+}
+
+func (s *Server) consoleLoginForm(resp http.ResponseWriter, req *http.Request) {
+	if s.ConsoleLogin == nil {
+		http.Error(resp, "the console is disabled", http.StatusNotFound)
+		return
+	}
+	s.renderConsole(resp, http.StatusOK, "login", &consolePage{CSRF: csrfToken(resp, req)})
+}
+
+func (s *Server) consoleLogin(resp http.ResponseWriter, req *http.Request) {
+	c := s.NewContext(req)
+	if s.ConsoleLogin == nil {
+		http.Error(resp, "the console is disabled", http.StatusNotFound)
+		return
+	}
+	page := &consolePage{CSRF: csrfToken(resp, req)}
+	if !checkCSRF(req) {
+		page.Error = "invalid form token. try again"
+		s.renderConsole(resp, http.StatusForbidden, "login", page)
+		return
+	}
+	user, err := s.ConsoleLogin(req.PostFormValue("user"), req.PostFormValue("password"))
+	if err != nil {
+		c.Warningf("console login failed for %q: %v", req.PostFormValue("user"), err)
+		page.Error = "invalid user or token"
+		s.renderConsole(resp, http.StatusUnauthorized, "login", page)
+		return
+	}
+	http.SetCookie(resp, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    s.newSession(user, time.Now().Add(sessionDuration)),
+		Path:     ConsolePath,
+		Secure:   req.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	c.Infof("%v logged in to the console", user)
+	http.Redirect(resp, req, ConsolePath+"/", http.StatusSeeOther)
+}
+
+func (s *Server) consoleLogout(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request) {
+	http.SetCookie(resp, &http.Cookie{Name: sessionCookie, Path: ConsolePath, MaxAge: -1})
+	http.Redirect(resp, req, ConsolePath+"/login", http.StatusSeeOther)
+}
+
+func (s *Server) consoleIndex(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != ConsolePath+"/" {
+		http.NotFound(resp, req)
+		return
+	}
+	page.Message = req.URL.Query().Get("msg")
+	s.renderIndex(c, page, resp, http.StatusOK)
+}
+
+// renderIndex renders the list of associations and the claim form.
+func (s *Server) renderIndex(c Context, page *consolePage, resp http.ResponseWriter, code int) {
+	assocs, err := s.Store.ListDomainAssocs(c)
+	if err != nil {
+		c.Errorf("console: %v", err)
+		http.Error(resp, "an error occurred", http.StatusInternalServerError)
+		return
+	}
+	page.Assocs = assocs
+	page.Conflicts, err = FindConflicts(c, s.Store)
+	if err != nil {
+		c.Errorf("console: %v", err)
+	}
+	if page.Assoc == nil {
+		// the claim form.
+		page.Assoc = new(DomainAssoc)
+	}
+	s.renderConsole(resp, code, "index", page)
+}
+
+func (s *Server) consoleClaim(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request) {
+	assoc := DomainAssoc{
+		Domain: canonicalDomain(req.PostFormValue("domain")),
+		Prefix: strings.Trim(strings.TrimSpace(req.PostFormValue("prefix")), "/"),
+	}
+	setProviderForm(&assoc, req)
+	err := s.issueVerifyToken(c, page.User, &assoc)
+	if err != nil {
+		page.Assoc = &assoc
+		s.consoleError(c, page, resp, req, err)
+		return
+	}
+	c.Infof("%v claimed %v in the console", page.User, assoc.Domain)
+	consoleRedirect(resp, req, assoc.Key, "claimed "+assoc.Domain+". verify ownership to activate it")
+}
+
+func (s *Server) consoleResolveConflicts(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request) {
+	conflicts, err := ResolveConflicts(c, s.storeFor(page.User))
+	if err != nil {
+		s.consoleError(c, page, resp, req, err)
+		return
+	}
+	var merged, left int
+	for _, conflict := range conflicts {
+		if conflict.Resolved {
+			merged++
+		} else {
+			left++
+		}
+	}
+	c.Infof("%v resolved conflicting associations in the console", page.User)
+	msg := fmt.Sprintf("merged the associations of %d domains. %d conflicts must be resolved by hand", merged, left)
+	http.Redirect(resp, req, ConsolePath+"/?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
+
+func (s *Server) consoleAssoc(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request) {
+	assoc, err := s.Store.GetDomainAssoc(c, req.URL.Query().Get(":key"))
+	if err != nil {
+		s.consoleError(c, page, resp, req, err)
+		return
+	}
+	page.Message = req.URL.Query().Get("msg")
+	s.renderAssoc(c, page, resp, req, assoc, http.StatusOK)
+}
+
+// renderAssoc renders the page of assoc.
+func (s *Server) renderAssoc(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request, assoc *DomainAssoc, code int) {
+	page.Assoc = assoc
+	page.Now = time.Now()
+	page.Wildcard = assoc.isWildcard()
+	page.VerifyDomain = assoc.verifyDomain()
+	page.TXTName = VerifyTXTPrefix + page.VerifyDomain
+	page.TXTValue = VerifyTXTValue(assoc.VerifyToken)
+	page.VerifyPath = VerifyPath
+	page.Preview = strings.Trim(req.URL.Query().Get("preview"), "/")
+	if page.Preview != "" {
+		var metas []importmeta.ImportMeta
+		served, err := s.serving(c, assoc, assoc.sampleHost())
+		if err == nil {
+			metas, err = assocImportMetas(served, served.Domain, path.Join("/", assoc.Prefix, page.Preview))
+		}
+		buf := new(bytes.Buffer)
+		if err == nil {
+			err = importmeta.MetasTemplate.Execute(buf, importmeta.Metas(metas))
+		}
+		if err != nil {
+			page.Error = err.Error()
+		}
+		page.PreviewOutput = strings.TrimSpace(buf.String())
+	}
+	s.renderConsole(resp, code, "assoc", page)
+}
+
+func (s *Server) consoleUpdate(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request) {
+	assoc, ok := s.consoleModify(c, page, resp, req, func(assoc *DomainAssoc) error {
+		setProviderForm(assoc, req)
+		assoc.Proxy = strings.TrimSpace(req.PostFormValue("proxy"))
+		assoc.RequireToken = req.PostFormValue("requireToken") == "on"
+		if assoc.isWildcard() {
+			assoc.OwnerTemplate = strings.TrimSpace(req.PostFormValue("ownerTemplate"))
+			assoc.Labels = nil
+			for _, label := range strings.Split(req.PostFormValue("labels"), ",") {
+				if label = strings.ToLower(strings.TrimSpace(label)); label != "" {
+					assoc.Labels = append(assoc.Labels, label)
+				}
+			}
+		}
+		return nil
+	})
+	if ok {
+		c.Infof("%v updated association %v in the console", page.User, assoc.Key)
+		consoleRedirect(resp, req, assoc.Key, "saved")
+	}
+}
+
+func (s *Server) consoleVerify(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request) {
+	assoc, err := s.Store.GetDomainAssoc(c, req.URL.Query().Get(":key"))
+	if err != nil {
+		s.consoleError(c, page, resp, req, err)
+		return
+	}
+	err = s.issueVerifyToken(c, page.User, assoc)
+	if err == nil {
+		err = s.verifier().Verify(c, assoc)
+	}
+	if err == nil {
+		err = s.storeFor(page.User).PutDomainAssoc(c, assoc)
+	}
+	if err != nil {
+		s.consoleError(c, page, resp, req, err)
+		return
+	}
+	c.Infof("%v verified ownership of %v in the console", page.User, assoc.Domain)
+	consoleRedirect(resp, req, assoc.Key, assoc.Domain+" is verified")
+}
+
+func (s *Server) consoleMap(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request) {
+	pkg := Package{
+		Root:        strings.Trim(strings.TrimSpace(req.PostFormValue("root")), "/"),
+		Repo:        strings.TrimSpace(req.PostFormValue("repo")),
+		Subdir:      strings.Trim(strings.TrimSpace(req.PostFormValue("subdir")), "/"),
+		Owner:       strings.Trim(strings.TrimSpace(req.PostFormValue("owner")), "/"),
+		Provider:    req.PostFormValue("provider"),
+		ProviderURL: strings.TrimSpace(req.PostFormValue("providerURL")),
+		VCS:         req.PostFormValue("vcs"),
+		Hidden:      req.PostFormValue("hidden") == "on",
+		Private:     req.PostFormValue("private") == "on",
+		Disabled:    req.PostFormValue("disabled") == "on",
+		Modified:    time.Now(),
+	}
+	assoc, ok := s.consoleModify(c, page, resp, req, func(assoc *DomainAssoc) error {
+		if p := assoc.Package(pkg.Root); p != nil {
+			*p = pkg
+			return nil
+		}
+		assoc.Packages = append(assoc.Packages, pkg)
+		return nil
+	})
+	if ok {
+		c.Infof("%v mapped package %v of association %v in the console", page.User, pkg.Root, assoc.Key)
+		consoleRedirect(resp, req, assoc.Key, "mapped "+pkg.Root)
+	}
+}
+
+func (s *Server) consoleUnmap(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request) {
+	root := req.PostFormValue("root")
+	assoc, ok := s.consoleModify(c, page, resp, req, func(assoc *DomainAssoc) error {
+		for i := range assoc.Packages {
+			if assoc.Packages[i].Root == root {
+				assoc.Packages = append(assoc.Packages[:i], assoc.Packages[i+1:]...)
+				return nil
+			}
+		}
+		return errNoSuchPackage
+	})
+	if ok {
+		c.Infof("%v unmapped package %v of association %v in the console", page.User, root, assoc.Key)
+		consoleRedirect(resp, req, assoc.Key, "removed "+root)
+	}
+}
+
+func (s *Server) consoleIssue(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request) {
+	name := strings.TrimSpace(req.PostFormValue("name"))
+	var expires time.Time
+	if days := strings.TrimSpace(req.PostFormValue("days")); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			s.consoleError(c, page, resp, req, &ValidationError{"days", fmt.Sprintf("invalid number of days %q", days)})
+			return
+		}
+		expires = time.Now().AddDate(0, 0, n)
+	}
+	if name == "" {
+		s.consoleError(c, page, resp, req, &ValidationError{"name", "the token holder must be named"})
+		return
+	}
+	tok, secret, err := NewAccessToken(name, req.PostFormValue("scope"), expires)
+	if err != nil {
+		s.consoleError(c, page, resp, req, err)
+		return
+	}
+	assoc, ok := s.consoleModify(c, page, resp, req, func(assoc *DomainAssoc) error {
+		assoc.Tokens = append(assoc.Tokens, *tok)
+		return nil
+	})
+	if ok {
+		c.Infof("%v issued token %v to %v for association %v in the console", page.User, tok.ID, tok.Name, assoc.Key)
+		// the secret is rendered rather than redirected so it stays out of urls.
+		page.Message = "issued token " + tok.ID + " to " + tok.Name
+		page.Secret = secret
+		s.renderAssoc(c, page, resp, req, assoc, http.StatusOK)
+	}
+}
+
+func (s *Server) consoleRevoke(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request) {
+	id := req.PostFormValue("id")
+	assoc, ok := s.consoleModify(c, page, resp, req, func(assoc *DomainAssoc) error {
+		return revokeToken(assoc, id)
+	})
+	if ok {
+		c.Infof("%v revoked token %v of association %v in the console", page.User, id, assoc.Key)
+		consoleRedirect(resp, req, assoc.Key, "revoked token "+id)
+	}
+}
+
+func (s *Server) consoleDelete(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request) {
+	assoc, err := s.Store.GetDomainAssoc(c, req.URL.Query().Get(":key"))
+	if err == nil && strconv.FormatInt(assoc.Revision, 10) != req.PostFormValue("revision") {
+		err = ErrConflict
+	}
+	if err == nil {
+		err = s.storeFor(page.User).DeleteDomainAssoc(c, assoc.Key)
+	}
+	if err != nil {
+		s.consoleError(c, page, resp, req, err)
+		return
+	}
+	c.Infof("%v deleted association %v in the console", page.User, assoc.Key)
+	http.Redirect(resp, req, ConsolePath+"/?msg="+url.QueryEscape("deleted "+assoc.Domain), http.StatusSeeOther)
+}
+
+// consoleModify applies fn to the association named in the url of req and
+// stores it.  The revision submitted with the form must be current.
+func (s *Server) consoleModify(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request, fn func(*DomainAssoc) error) (*DomainAssoc, bool) {
+	assoc, err := s.Store.GetDomainAssoc(c, req.URL.Query().Get(":key"))
+	if err == nil {
+		assoc.Revision, err = strconv.ParseInt(req.PostFormValue("revision"), 10, 64)
+		if err != nil {
+			err = ErrConflict
+		}
+	}
+	if err == nil {
+		err = fn(assoc)
+	}
+	if err == nil {
+		err = s.storeFor(page.User).PutDomainAssoc(c, assoc)
+	}
+	if err != nil {
+		s.consoleError(c, page, resp, req, err)
+		return nil, false
+	}
+	return assoc, true
+}
+
+// consoleError renders the page for err.  If the request concerns an
+// association that still exists its page is rendered with the error.
+func (s *Server) consoleError(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request, err error) {
+	code := http.StatusUnprocessableEntity
+	switch err {
+	case ErrNoSuchAssoc:
+		http.Error(resp, "no such association", http.StatusNotFound)
+		return
+	case ErrConflict:
+		code = http.StatusConflict
+		err = fmt.Errorf("the association was changed by someone else. review it and try again")
+	case ErrDomainTaken:
+		code = http.StatusConflict
+	case ErrNotVerified, errNoSuchPackage, errNoSuchToken:
+	default:
+		switch err.(type) {
+		case *ValidationError:
+		case *AuditError:
+			code = http.StatusInternalServerError
+		default:
+			c.Errorf("console: %v", err)
+			http.Error(resp, "an error occurred", http.StatusInternalServerError)
+			return
+		}
+	}
+	page.Error = err.Error()
+	key := req.URL.Query().Get(":key")
+	if key == "" {
+		s.renderIndex(c, page, resp, code)
+		return
+	}
+	assoc, gerr := s.Store.GetDomainAssoc(c, key)
+	if gerr != nil {
+		http.Error(resp, page.Error, code)
+		return
+	}
+	s.renderAssoc(c, page, resp, req, assoc, code)
+}
+
+// setProviderForm sets the provider fields of assoc from the form of req.
+func setProviderForm(assoc *DomainAssoc, req *http.Request) {
+	assoc.Provider = strings.TrimSpace(req.PostFormValue("provider"))
+	if assoc.Provider == DefaultProvider {
+		assoc.Provider = ""
+	}
+	assoc.ProviderURL = strings.TrimSpace(req.PostFormValue("providerURL"))
+	assoc.GitHubLogin = strings.Trim(strings.TrimSpace(req.PostFormValue("githubLogin")), "/")
+}
+
+func consoleRedirect(resp http.ResponseWriter, req *http.Request, key, msg string) {
+	http.Redirect(resp, req, ConsolePath+"/assoc/"+key+"?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
+
+func (s *Server) renderConsole(resp http.ResponseWriter, code int, name string, page *consolePage) {
+	buf := new(bytes.Buffer)
+	err := consoleTemplates.ExecuteTemplate(buf, name, page)
+	if err != nil {
+		http.Error(resp, "an error occurred", http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header().Set("X-Frame-Options", "DENY")
+	resp.WriteHeader(code)
+	buf.WriteTo(resp)
+}
+
+// csrfToken returns the csrf token of the client, setting a new one if the
+// client has none.
+func csrfToken(resp http.ResponseWriter, req *http.Request) string {
+	if cookie, err := req.Cookie(csrfCookie); err == nil && len(cookie.Value) == 32 {
+		return cookie.Value
+	}
+	p := make([]byte, 16)
+	io.ReadFull(rand.Reader, p)
+	token := hex.EncodeToString(p)
+	http.SetCookie(resp, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     ConsolePath,
+		Secure:   req.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	// the cookie also applies to the current request.
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: token})
+	return token
+}
+
+// checkCSRF returns true if the form token of req matches its csrf cookie.
+func checkCSRF(req *http.Request) bool {
+	cookie, err := req.Cookie(csrfCookie)
+	if err != nil || len(cookie.Value) != 32 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(req.PostFormValue("csrf")), []byte(cookie.Value)) == 1
+}
+
+// newSession returns a session cookie value for user expiring at expires.
+func (s *Server) newSession(user string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(user)) + "|" + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "|" + s.sessionMAC(payload)
+}
+
+// checkSession returns the user of a session cookie value that is valid at
+// time now.
+func (s *Server) checkSession(value string, now time.Time) (string, bool) {
+	i := strings.LastIndex(value, "|")
+	if i < 0 {
+		return "", false
+	}
+	payload, mac := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(mac), []byte(s.sessionMAC(payload))) {
+		return "", false
+	}
+	fields := strings.SplitN(payload, "|", 2)
+	if len(fields) != 2 {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return "", false
+	}
+	user, err := base64.RawURLEncoding.DecodeString(fields[0])
+	if err != nil {
+		return "", false
+	}
+	return string(user), true
+}
+
+func (s *Server) sessionMAC(payload string) string {
+	s.sessionKeyOnce.Do(func() {
+		if len(s.SessionKey) == 0 {
+			s.SessionKey = make([]byte, 32)
+			io.ReadFull(rand.Reader, s.SessionKey)
+		}
+	})
+	mac := hmac.New(sha256.New, s.SessionKey)
+	io.WriteString(mac, payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,180 @@
+package gipspot
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// consoleClient sends console requests to a Server, keeping cookies between
+// requests like a browser.
+type consoleClient struct {
+	s       *Server
+	cookies map[string]*http.Cookie
+}
+
+func newConsoleClient(s *Server) *consoleClient {
+	return &consoleClient{s: s, cookies: make(map[string]*http.Cookie)}
+}
+
+func (cl *consoleClient) do(method, path string, form url.Values) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "http://foo.io"+ConsolePath+path, strings.NewReader(form.Encode()))
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for _, cookie := range cl.cookies {
+		req.AddCookie(cookie)
+	}
+	resp := httptest.NewRecorder()
+	cl.s.ServeHTTP(resp, req)
+	for _, cookie := range (&http.Response{Header: resp.Header()}).Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(cl.cookies, cookie.Name)
+			continue
+		}
+		cl.cookies[cookie.Name] = cookie
+	}
+	return resp
+}
+
+// post submits form with the client's csrf token.
+func (cl *consoleClient) post(path string, form url.Values) *httptest.ResponseRecorder {
+	if cl.cookies[csrfCookie] == nil {
+		cl.do("GET", "/login", nil)
+	}
+	form.Set("csrf", cl.cookies[csrfCookie].Value)
+	return cl.do("POST", path, form)
+}
+
+func (cl *consoleClient) login(t *testing.T) {
+	resp := cl.post("/login", url.Values{"user": {"admin"}, "password": {"s3cret"}})
+	if resp.Code != http.StatusSeeOther {
+		t.Fatalf("login failed: %d %q", resp.Code, resp.Body.String())
+	}
+}
+
+func encodeUser(user string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(user))
+}
+
+func TestConsoleLogin(t *testing.T) {
+	s := testServer()
+	cl := newConsoleClient(s)
+	if resp := cl.do("GET", "/", nil); resp.Code != http.StatusNotFound {
+		t.Errorf("console served without a login method: %d", resp.Code)
+	}
+
+	s.ConsoleLogin = TokenLogin(map[string]string{"s3cret": "admin"})
+	if resp := cl.do("GET", "/", nil); resp.Code != http.StatusSeeOther {
+		t.Errorf("console served without a session: %d", resp.Code)
+	}
+	if resp := cl.post("/login", url.Values{"user": {"admin"}, "password": {"guess"}}); resp.Code != http.StatusUnauthorized {
+		t.Errorf("login with a bad password: %d", resp.Code)
+	}
+	resp := cl.do("POST", "/login", url.Values{"user": {"admin"}, "password": {"s3cret"}, "csrf": {"forged"}})
+	if resp.Code != http.StatusForbidden {
+		t.Errorf("login with a forged csrf token: %d", resp.Code)
+	}
+	cl.login(t)
+	if resp := cl.do("GET", "/", nil); resp.Code != http.StatusOK {
+		t.Errorf("console denied a session: %d", resp.Code)
+	}
+
+	// forms without the csrf token are rejected.
+	resp = cl.do("POST", "/claim", url.Values{"domain": {"foo.io"}})
+	if resp.Code != http.StatusForbidden {
+		t.Errorf("claim without a csrf token: %d", resp.Code)
+	}
+
+	cl.post("/logout", url.Values{})
+	if resp := cl.do("GET", "/", nil); resp.Code != http.StatusSeeOther {
+		t.Errorf("console served after logout: %d", resp.Code)
+	}
+
+	// sessions expire and can't be forged.
+	now := time.Now()
+	value := s.newSession("admin", now.Add(time.Hour))
+	if user, ok := s.checkSession(value, now); !ok || user != "admin" {
+		t.Errorf("valid session rejected: %q %v", user, ok)
+	}
+	if _, ok := s.checkSession(value, now.Add(2*time.Hour)); ok {
+		t.Errorf("expired session accepted")
+	}
+	if _, ok := s.checkSession(strings.Replace(value, encodeUser("admin"), encodeUser("other"), 1), now); ok {
+		t.Errorf("forged session accepted")
+	}
+}
+
+func TestConsoleAssoc(t *testing.T) {
+	s := testServer()
+	s.ConsoleLogin = TokenLogin(map[string]string{"s3cret": "admin"})
+	s.Verifier = &Verifier{Resolver: fakeDNS{}}
+	cl := newConsoleClient(s)
+	cl.login(t)
+
+	resp := cl.post("/claim", url.Values{"domain": {"foo.io"}, "githubLogin": {"mcfoo"}})
+	if resp.Code != http.StatusSeeOther {
+		t.Fatalf("claim: %d %q", resp.Code, resp.Body.String())
+	}
+	assocs, _ := s.Store.GetDomainAssocs(testContext, "foo.io")
+	if len(assocs) != 1 || assocs[0].VerifyToken == "" || assocs[0].IsVerified() {
+		t.Fatalf("unexpected claimed associations: %#v", assocs)
+	}
+	assoc := assocs[0]
+	path := "/assoc/" + assoc.Key
+
+	resp = cl.post("/claim", url.Values{"domain": {"bar.io"}, "provider": {"gitea"}, "githubLogin": {"mcbar"}})
+	if resp.Code != http.StatusUnprocessableEntity || !strings.Contains(resp.Body.String(), `value="mcbar"`) {
+		t.Errorf("claim without a provider url: %d %q", resp.Code, resp.Body.String())
+	}
+
+	resp = cl.do("GET", path, nil)
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), VerifyTXTValue(assoc.VerifyToken)) {
+		t.Errorf("verification instructions not shown: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp := cl.post(path+"/verify", url.Values{}); resp.Code != http.StatusUnprocessableEntity {
+		t.Errorf("verified without a TXT record: %d", resp.Code)
+	}
+	s.Verifier.Resolver = fakeDNS{VerifyTXTPrefix + "foo.io": {VerifyTXTValue(assoc.VerifyToken)}}
+	if resp := cl.post(path+"/verify", url.Values{}); resp.Code != http.StatusSeeOther {
+		t.Errorf("verify: %d %q", resp.Code, resp.Body.String())
+	}
+
+	// forms carry the revision they were rendered with.
+	stale := url.Values{"revision": {"1"}, "root": {"bar"}, "repo": {"bar.go"}, "subdir": {"src"}}
+	if resp := cl.post(path+"/map", stale); resp.Code != http.StatusConflict {
+		t.Errorf("map with a stale revision: %d", resp.Code)
+	}
+	current, _ := s.Store.GetDomainAssoc(testContext, assoc.Key)
+	stale.Set("revision", "2")
+	if current.Revision != 2 {
+		t.Fatalf("unexpected revision: %d", current.Revision)
+	}
+	if resp := cl.post(path+"/map", stale); resp.Code != http.StatusSeeOther {
+		t.Errorf("map: %d %q", resp.Code, resp.Body.String())
+	}
+	invalid := url.Values{"revision": {"3"}, "root": {"baz"}, "subdir": {"../up"}}
+	if resp := cl.post(path+"/map", invalid); resp.Code != http.StatusUnprocessableEntity {
+		t.Errorf("map with an invalid subdir: %d", resp.Code)
+	}
+
+	resp = cl.do("GET", path+"?preview=bar/qux", nil)
+	expect := `&lt;meta name=&#34;go-import&#34; content=&#34;foo.io/bar git https://github.com/mcfoo/bar.go src&#34;&gt;`
+	if !strings.Contains(resp.Body.String(), expect) {
+		t.Errorf("unexpected preview: %q", resp.Body.String())
+	}
+
+	if resp := cl.post(path+"/unmap", url.Values{"revision": {"3"}, "root": {"bar"}}); resp.Code != http.StatusSeeOther {
+		t.Errorf("unmap: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp := cl.post(path+"/delete", url.Values{"revision": {"4"}}); resp.Code != http.StatusSeeOther {
+		t.Errorf("delete: %d %q", resp.Code, resp.Body.String())
+	}
+	if _, err := s.Store.GetDomainAssoc(testContext, assoc.Key); err != ErrNoSuchAssoc {
+		t.Errorf("association not deleted: %v", err)
+	}
+}
@@ -0,0 +1,263 @@
+//go:build appengine
+// +build appengine
+
+package gipspot
+
+import (
+	"appengine"
+	"appengine/datastore"
+
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DatastoreStore is an AssocStore keeping associations as DomainAssocs
+// entities in the App Engine datastore.  It must be given the
+// appengine.Context of the request.
+type DatastoreStore struct{}
+
+func (DatastoreStore) GetDomainAssoc(c Context, key string) (*DomainAssoc, error) {
+	k, err := datastore.DecodeKey(key)
+	if err != nil {
+		return nil, ErrNoSuchAssoc
+	}
+	assoc := new(DomainAssoc)
+	err = datastore.Get(c.(appengine.Context), k, assoc)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNoSuchAssoc
+	}
+	if err != nil {
+		return nil, err
+	}
+	assoc.Key = key
+	upgradeAssoc(assoc)
+	return assoc, nil
+}
+
+// GetDomainAssocs migrates the datastore (see migrateDatastore) when it finds
+// no association, as entities stored before hosts were normalized aren't
+// found by their normalized domain until they are written again.
+func (DatastoreStore) GetDomainAssocs(c Context, domain string) ([]DomainAssoc, error) {
+	q := datastore.NewQuery("DomainAssocs").
+		Filter("Domain = ", domain)
+	assocs, err := getAllDomainAssocs(c.(appengine.Context), q)
+	if err != nil || len(assocs) > 0 || !migrateDatastore(c) {
+		return assocs, err
+	}
+	return getAllDomainAssocs(c.(appengine.Context), q)
+}
+
+// datastoreMigration is the state of the migration of the datastore by this
+// instance.
+var datastoreMigration struct {
+	sync.Mutex
+	running bool
+	done    bool
+}
+
+// migrateDatastore migrates the associations of the datastore to the current
+// schema, as an admin would with Migrate, unless this instance has done so
+// already or is doing so.  The change is audited as made by ServerActor.  It
+// returns true if any association was written.  A migration which fails is
+// tried again by the next call.
+func migrateDatastore(c Context) bool {
+	datastoreMigration.Lock()
+	if datastoreMigration.running || datastoreMigration.done {
+		datastoreMigration.Unlock()
+		return false
+	}
+	datastoreMigration.running = true
+	datastoreMigration.Unlock()
+
+	p, err := Migrate(c, Audited(DatastoreStore{}, DatastoreAuditLog{}, ServerActor), MigrateOptions{})
+	datastoreMigration.Lock()
+	datastoreMigration.running = false
+	datastoreMigration.done = err == nil
+	datastoreMigration.Unlock()
+	if err != nil {
+		c.Errorf("unable to migrate associations: %v", err)
+		return false
+	}
+	if p.Migrated > 0 || len(p.Failed) > 0 {
+		c.Infof("migrated %d associations to schema %d; failed: %v", p.Migrated, SchemaVersion, p.Failed)
+	}
+	return p.Migrated > 0
+}
+
+func (DatastoreStore) GetDomainAssocsGitHubLogin(c Context, login string) ([]DomainAssoc, error) {
+	q := datastore.NewQuery("DomainAssocs").Filter("GitHubLogin = ", login)
+	return getAllDomainAssocs(c.(appengine.Context), q)
+}
+
+func (DatastoreStore) GetDomainAssocsAliasOf(c Context, p string) ([]DomainAssoc, error) {
+	q := datastore.NewQuery("DomainAssocs").Filter("AliasOf = ", p)
+	return getAllDomainAssocs(c.(appengine.Context), q)
+}
+
+func (DatastoreStore) ListDomainAssocs(c Context) ([]DomainAssoc, error) {
+	return getAllDomainAssocs(c.(appengine.Context), datastore.NewQuery("DomainAssocs"))
+}
+
+func getAllDomainAssocs(c appengine.Context, q *datastore.Query) ([]DomainAssoc, error) {
+	var assocs []DomainAssoc
+	keys, err := q.GetAll(c, &assocs)
+	if err != nil {
+		return assocs, err
+	}
+	for i := range keys {
+		assocs[i].Key = keys[i].Encode()
+		upgradeAssoc(&assocs[i])
+	}
+	return assocs, nil
+}
+
+// PutDomainAssoc stores new associations with their domain and prefix as the
+// key name so no two can be created for a domain and prefix.  Changing either
+// moves the association to its new key.  Entities created before associations
+// were keyed by domain keep their keys.
+func (DatastoreStore) PutDomainAssoc(c Context, assoc *DomainAssoc) error {
+	err := validateDomainAssoc(assoc)
+	if err != nil {
+		return err
+	}
+
+	ac := c.(appengine.Context)
+	var key *datastore.Key
+	if assoc.Key != "" {
+		key, err = datastore.DecodeKey(assoc.Key)
+		if err != nil {
+			return err
+		}
+	}
+	// entities with other keys can't be read in the transaction.  those
+	// keyed by domain name are checked again within it, and a concurrent
+	// change of the domain of assoc fails its revision check.
+	err = checkDomainFree(c, DatastoreStore{}, assoc)
+	if err != nil {
+		return err
+	}
+	domainKey := datastore.NewKey(ac, "DomainAssocs", path.Join(assoc.Domain, assoc.Prefix), 0, nil)
+
+	stored := *assoc
+	var putKey *datastore.Key
+	err = datastore.RunInTransaction(ac, func(tc appengine.Context) error {
+		stored.Revision = 1
+		putKey = domainKey
+		if key != nil {
+			var current DomainAssoc
+			err := datastore.Get(tc, key, &current)
+			if err == nil {
+				if current.Revision != assoc.Revision {
+					return ErrConflict
+				}
+				stored.Revision = current.Revision + 1
+				if current.Domain == assoc.Domain && current.Prefix == assoc.Prefix {
+					putKey = key
+				}
+			} else if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+		}
+		if !putKey.Equal(key) {
+			var current DomainAssoc
+			err := datastore.Get(tc, putKey, &current)
+			if err == nil {
+				return ErrDomainTaken
+			}
+			if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+		}
+		stored.Modified = time.Now()
+		stored.Schema = SchemaVersion
+		_, err := datastore.Put(tc, putKey, &stored)
+		if err == nil && key != nil && !putKey.Equal(key) {
+			err = datastore.Delete(tc, key)
+		}
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return err
+	}
+	*assoc = stored
+	assoc.Key = putKey.Encode()
+	return nil
+}
+
+func (DatastoreStore) DeleteDomainAssoc(c Context, key string) error {
+	k, err := datastore.DecodeKey(key)
+	if err != nil {
+		return ErrNoSuchAssoc
+	}
+	// deleting a missing entity succeeds, so it is looked up first.
+	return datastore.RunInTransaction(c.(appengine.Context), func(tc appengine.Context) error {
+		var props datastore.PropertyList
+		err := datastore.Get(tc, k, &props)
+		if err == datastore.ErrNoSuchEntity {
+			return ErrNoSuchAssoc
+		}
+		if err != nil {
+			return err
+		}
+		return datastore.Delete(tc, k)
+	}, nil)
+}
+
+// DatastoreAuditLog is an AuditLog keeping entries as AuditEntries entities
+// in the App Engine datastore.
+type DatastoreAuditLog struct{}
+
+// datastoreAuditEntry is the entity of an AuditEntry.  Values are stored as
+// unindexed JSON.
+type datastoreAuditEntry struct {
+	Time    time.Time
+	Actor   string
+	Action  string `datastore:",noindex"`
+	Assoc   string
+	Path    string
+	Package string
+	Before  []byte `datastore:",noindex"`
+	After   []byte `datastore:",noindex"`
+}
+
+func (DatastoreAuditLog) AppendAudit(c Context, entries ...AuditEntry) error {
+	ac := c.(appengine.Context)
+	keys := make([]*datastore.Key, len(entries))
+	ents := make([]datastoreAuditEntry, len(entries))
+	for i, e := range entries {
+		keys[i] = datastore.NewIncompleteKey(ac, "AuditEntries", nil)
+		ents[i] = datastoreAuditEntry{e.Time, e.Actor, e.Action, e.Assoc, e.Path, e.Package, e.Before, e.After}
+	}
+	_, err := datastore.PutMulti(ac, keys, ents)
+	return err
+}
+
+// QueryAudit filters entities by the association, path or actor of q, the
+// first of them set, and applies the rest of q in memory so no composite
+// index is needed.
+func (DatastoreAuditLog) QueryAudit(c Context, q AuditQuery) ([]AuditEntry, error) {
+	dq := datastore.NewQuery("AuditEntries")
+	switch {
+	case q.Assoc != "":
+		dq = dq.Filter("Assoc = ", q.Assoc)
+	case q.Path != "":
+		dq = dq.Filter("Path = ", q.Path)
+	case q.Actor != "":
+		dq = dq.Filter("Actor = ", q.Actor)
+	default:
+		dq = dq.Order("Time")
+	}
+	var ents []datastoreAuditEntry
+	_, err := dq.GetAll(c.(appengine.Context), &ents)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]AuditEntry, len(ents))
+	for i, e := range ents {
+		entries[i] = AuditEntry{e.Time, e.Actor, e.Action, e.Assoc, e.Path, e.Package, e.Before, e.After}
+	}
+	sort.Stable(byTime(entries))
+	return q.filter(entries), nil
+}
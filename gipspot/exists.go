@@ -0,0 +1,125 @@
+package gipspot
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RepoChecker checks that repositories exist by requesting their resource in
+// the API of their provider.  Results are cached.  A repository whose
+// existence cannot be determined, because its provider has no known API or
+// the API fails, is assumed to exist.
+//
+// The APIs of most providers report private repositories as missing to
+// clients without credentials.  A Client authenticating its requests can see
+// the repositories its credentials give access to.
+type RepoChecker struct {
+	// Client returns the http client used to request the API.  If nil
+	// http.DefaultClient is used.
+	Client func(c Context) *http.Client
+
+	// TTL is the time for which a repository found to exist is remembered.
+	// If zero DefaultRepoTTL is used.
+	TTL time.Duration
+
+	// NegativeTTL is the time for which a missing repository is remembered.
+	// If zero DefaultNegativeRepoTTL is used.
+	NegativeTTL time.Duration
+
+	mut   sync.Mutex
+	cache map[string]repoCacheEntry
+}
+
+// Default cache times of a RepoChecker.  Missing repositories are forgotten
+// sooner so that newly created ones are served promptly.
+const (
+	DefaultRepoTTL         = time.Hour
+	DefaultNegativeRepoTTL = 5 * time.Minute
+)
+
+// maxRepoCache bounds the number of results cached by a RepoChecker.
+const maxRepoCache = 10000
+
+type repoCacheEntry struct {
+	exists  bool
+	expires time.Time
+}
+
+// Exists returns true if the repository with the API resource api exists.
+// If api is empty true is returned.  If the API fails true is returned with
+// the error.
+func (rc *RepoChecker) Exists(c Context, api string) (bool, error) {
+	if api == "" {
+		return true, nil
+	}
+	now := time.Now()
+	rc.mut.Lock()
+	entry, ok := rc.cache[api]
+	rc.mut.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.exists, nil
+	}
+
+	exists, err := rc.request(c, api)
+	if err != nil {
+		return true, err
+	}
+	ttl := rc.TTL
+	if ttl == 0 {
+		ttl = DefaultRepoTTL
+	}
+	if !exists {
+		ttl = rc.NegativeTTL
+		if ttl == 0 {
+			ttl = DefaultNegativeRepoTTL
+		}
+	}
+	rc.mut.Lock()
+	defer rc.mut.Unlock()
+	if rc.cache == nil || len(rc.cache) >= maxRepoCache {
+		rc.prune(now)
+	}
+	rc.cache[api] = repoCacheEntry{exists, now.Add(ttl)}
+	return exists, nil
+}
+
+// prune removes expired results from the cache, or every result if none has
+// expired.  The caller must hold rc.mut.
+func (rc *RepoChecker) prune(now time.Time) {
+	for api, entry := range rc.cache {
+		if !now.Before(entry.expires) {
+			delete(rc.cache, api)
+		}
+	}
+	if rc.cache == nil || len(rc.cache) >= maxRepoCache {
+		rc.cache = make(map[string]repoCacheEntry)
+	}
+}
+
+// request asks the API whether the repository exists.
+func (rc *RepoChecker) request(c Context, api string) (bool, error) {
+	client := http.DefaultClient
+	if rc.Client != nil {
+		client = rc.Client(c)
+	}
+	req, err := http.NewRequest("GET", api, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return true, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return false, nil
+	}
+	// rate limits and outages say nothing about the repository.
+	return false, fmt.Errorf("%v: http status %v", api, resp.Status)
+}
@@ -0,0 +1,66 @@
+package gipspot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRepoChecker(t *testing.T) {
+	var requests []string
+	broken := false
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.URL.RequestURI())
+		switch {
+		case broken:
+			http.Error(resp, "rate limited", http.StatusForbidden)
+		case req.URL.RequestURI() == "/repos/mcfoo/bar",
+			req.URL.RequestURI() == "/api/v4/projects/group%2Fsub%2Flab":
+			resp.Write([]byte("{}"))
+		default:
+			http.NotFound(resp, req)
+		}
+	}))
+	defer srv.Close()
+
+	s := testServer(verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo", Packages: []Package{
+		{Root: "lab", Provider: "gitlab", Owner: "group/sub"},
+		{Root: "hg", Repo: "https://hg.foo.io/hg", VCS: "hg"},
+	}}))
+	s.RepoChecker = &RepoChecker{Client: redirectClient(srv)}
+	for i, test := range []struct {
+		path   string
+		exists bool
+	}{
+		{"/bar/baz", true},
+		{"/bar", true},
+		{"/qux", false},
+		{"/qux/quux", false},
+		{"/lab", true},
+		{"/hg", true}, // a repository url can't be checked
+	} {
+		req, _ := http.NewRequest("GET", "http://foo.io"+test.path+"?go-get=1", nil)
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		if test.exists && resp.Code != http.StatusOK {
+			t.Errorf("test %d: unexpected response: %d %q", i, resp.Code, resp.Body.String())
+		}
+		if !test.exists && resp.Code != http.StatusNotFound {
+			t.Errorf("test %d: missing repository served: %d %q", i, resp.Code, resp.Body.String())
+		}
+	}
+	// both results are cached.
+	if len(requests) != 3 {
+		t.Errorf("unexpected api requests: %q", requests)
+	}
+
+	// an api failure is not cached and the repository is assumed to exist.
+	broken = true
+	exists, err := s.RepoChecker.Exists(testContext, "https://api.github.com/repos/mcfoo/new")
+	if !exists || err == nil {
+		t.Errorf("unexpected result of a failed request: %v %v", exists, err)
+	}
+	if _, ok := s.RepoChecker.cache["https://api.github.com/repos/mcfoo/new"]; ok {
+		t.Errorf("failed request cached")
+	}
+}
@@ -0,0 +1,59 @@
+package gipspot
+
+import (
+	"importmeta"
+
+	"fmt"
+	"path"
+	"sort"
+)
+
+// StoreEnumerator is an importmeta.Enumerator listing the packages registered
+// with the active associations of Store, so they can be exported to static
+// hosting with importmeta.Export.  Only public packages are listed: private
+// and disabled packages, associations requiring tokens and wildcard
+// associations, whose subdomains can't be listed, are left out.
+type StoreEnumerator struct {
+	Context Context
+	Store   AssocStore
+}
+
+// Enumerate returns the go-import entries of every package listed, ordered
+// by association key and then as registered.
+func (e StoreEnumerator) Enumerate() ([]importmeta.ImportMeta, error) {
+	assocs, err := e.Store.ListDomainAssocs(e.Context)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byKey(assocs))
+	s := &Server{Store: e.Store}
+	var metas []importmeta.ImportMeta
+	for i := range assocs {
+		assoc := &assocs[i]
+		if assoc.isWildcard() {
+			continue
+		}
+		served, err := s.serving(e.Context, assoc, assoc.Domain)
+		if err == ErrNoSuchAssoc {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !served.IsActive() || served.RequireToken {
+			continue
+		}
+		for _, pkg := range served.Packages {
+			if pkg.Private || pkg.Disabled {
+				continue
+			}
+			reqpath := path.Join("/", served.Prefix, pkg.Root)
+			m, err := assocImportMetas(served, served.Domain, reqpath)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", path.Join(served.Domain, reqpath), err)
+			}
+			metas = append(metas, m...)
+		}
+	}
+	return metas, nil
+}
@@ -0,0 +1,41 @@
+package gipspot
+
+import (
+	"testing"
+)
+
+func TestStoreEnumerator(t *testing.T) {
+	store := NewMemStore(
+		verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo", Packages: []Package{
+			{Root: "bar"},
+			{Root: "secret", Private: true},
+			{Root: "gone", Disabled: true},
+			{Root: "lib", Repo: "mono", Subdir: "go/lib", Hidden: true},
+		}}),
+		verified(DomainAssoc{Domain: "alias.io", AliasOf: "foo.io"}),
+		DomainAssoc{Domain: "claimed.io", GitHubLogin: "mcfoo", Packages: []Package{{Root: "bar"}}},
+		verified(DomainAssoc{Domain: "tok.io", GitHubLogin: "mctok", RequireToken: true, Packages: []Package{{Root: "bar"}}}),
+	)
+	metas, err := StoreEnumerator{testContext, store}.Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pkgs []string
+	for _, m := range metas {
+		pkgs = append(pkgs, m.Pkg+" "+m.Repo+" "+m.Subdir)
+	}
+	expect := []string{
+		"foo.io/bar https://github.com/mcfoo/bar ",
+		"foo.io/lib https://github.com/mcfoo/mono go/lib",
+		"alias.io/bar https://github.com/mcfoo/bar ",
+		"alias.io/lib https://github.com/mcfoo/mono go/lib",
+	}
+	if len(pkgs) != len(expect) {
+		t.Fatalf("unexpected packages: %q", pkgs)
+	}
+	for i := range expect {
+		if pkgs[i] != expect[i] {
+			t.Errorf("package %d: expected %q, got %q", i, expect[i], pkgs[i])
+		}
+	}
+}
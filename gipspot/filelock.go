@@ -0,0 +1,28 @@
+//go:build !appengine && !windows
+// +build !appengine,!windows
+
+package gipspot
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockDir takes an exclusive lock on the directory dir, shared with other
+// processes, waiting for it if another holds it.  The lock is released by
+// calling unlock.
+func lockDir(dir string) (unlock func(), err error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
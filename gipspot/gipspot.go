@@ -1,84 +1,431 @@
-package main
+// Package gipspot serves go-get import metadata for domains associated with
+// GitHub logins.  It is independent of the platform it runs on.  The App
+// Engine adapter is built with the appengine build tag and the gopherpath
+// command serves it with net/http.
+package gipspot
 
 import (
 	"importmeta"
 
-	"appengine"
-
 	"fmt"
+	"log"
+	"net"
 	"net/http"
 	"path"
+	"strings"
+	"sync"
+	"time"
 )
 
-func init() {
-	http.HandleFunc("/", HandleRoot)
+// Context provides platform services for the duration of a request.  An
+// appengine.Context satisfies the interface.
+type Context interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	Criticalf(format string, args ...interface{})
 }
 
-var MetaCodec = importmeta.CodecFunc(func(req *http.Request) (importmeta.ImportMeta, error) {
-	var meta importmeta.ImportMeta
-	c := appengine.NewContext(req)
-	host := req.Host
-	assocs, err := GetDomainAssocs(c, host)
+// LogContext returns a Context writing messages to logger.  If logger is nil
+// the standard logger is used.
+func LogContext(logger *log.Logger) Context {
+	return logContext{logger}
+}
+
+type logContext struct {
+	logger *log.Logger
+}
+
+func (c logContext) logf(level, format string, args ...interface{}) {
+	msg := level + ": " + fmt.Sprintf(format, args...)
+	if c.logger == nil {
+		log.Print(msg)
+		return
+	}
+	c.logger.Print(msg)
+}
+
+func (c logContext) Debugf(format string, args ...interface{}) {
+	c.logf("DEBUG", format, args...)
+}
+
+func (c logContext) Infof(format string, args ...interface{}) {
+	c.logf("INFO", format, args...)
+}
+
+func (c logContext) Warningf(format string, args ...interface{}) {
+	c.logf("WARNING", format, args...)
+}
+
+func (c logContext) Errorf(format string, args ...interface{}) {
+	c.logf("ERROR", format, args...)
+}
+
+func (c logContext) Criticalf(format string, args ...interface{}) {
+	c.logf("CRITICAL", format, args...)
+}
+
+// Server serves import metadata, the domain index, sitemap.xml and
+// robots.txt for every domain with an association.  The platform supplies
+// request contexts and association storage.
+type Server struct {
+	// NewContext returns the Context for a request.
+	NewContext func(req *http.Request) Context
+
+	// Store holds the associations served.
+	Store AssocStore
+
+	// Audit records every change made to Store by the admin API, the
+	// console, the setup pages and verification.  If nil changes are only
+	// logged.
+	Audit AuditLog
+
+	// Verifier checks domain ownership.  If nil a zero Verifier is used.
+	Verifier *Verifier
+
+	// Authenticate identifies users of the admin API.  If nil the admin
+	// API is disabled.
+	Authenticate Authenticator
+
+	// ConsoleLogin checks the credentials entered in the console login
+	// form.  Users identified by Authenticate are logged in without a form.
+	// If ConsoleLogin and LoginURL are both nil the console is disabled.
+	ConsoleLogin PasswordLogin
+
+	// LoginURL returns a URL at which the platform logs users in before
+	// returning them to dest.  It is used instead of the console login form.
+	LoginURL func(req *http.Request, dest string) (string, error)
+
+	// ClientAuth identifies go command clients which may resolve every
+	// package requiring credentials.  Clients may also present an access
+	// token of the association serving a package.  See Authorize.
+	ClientAuth Authenticator
+
+	// AccessLog records every resolution of a package requiring
+	// credentials, allowed or denied.  If nil they are logged with the
+	// request Context.
+	AccessLog func(c Context, rec *AccessRecord)
+
+	// RepoChecker checks that the repository of a package exists before its
+	// metadata is served.  If nil repositories are not checked.
+	RepoChecker *RepoChecker
+
+	// TrustedProxies holds the networks of reverse proxies whose
+	// X-Forwarded-Host header names the requested host.  The header is
+	// ignored in requests from other addresses.
+	TrustedProxies []*net.IPNet
+
+	// RateLimit throttles the requests served to anyone, for import
+	// metadata, domain pages, sitemaps, verification and setup, which read
+	// the store.  The admin API and console are not limited.  Clients are
+	// identified as described for TrustedProxies.  If nil requests are not
+	// limited.
+	RateLimit *RateLimiter
+
+	// SetupToken enables the setup pages beneath SetupPath, which require
+	// it, until the store has a verified association.  If empty setup is
+	// disabled.  On App Engine it is read from GOPHERPATH_SETUP_TOKEN.
+	SetupToken string
+
+	// SessionKey signs console session cookies.  If empty a random key is
+	// used and sessions end when the server restarts.
+	SessionKey []byte
+
+	adminOnce      sync.Once
+	adminMux       http.Handler
+	consoleOnce    sync.Once
+	consoleMux     http.Handler
+	sessionKeyOnce sync.Once
+	setupMut       sync.Mutex
+	setupDone      bool
+	setupChecked   time.Time // when the store last needed setup
+}
+
+// VerifyHandlerPath is the path to which a POST request runs verification of
+// the host's association.
+const VerifyHandlerPath = "/_gopherpath/verify"
+
+// ServeHTTP routes req to the handler for its path.  The host of req is
+// normalized first (see NormalizeHost) and requests for invalid hosts are
+// rejected.
+func (s *Server) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	authority := s.requestAuthority(req)
+	host, err := NormalizeHost(authority)
 	if err != nil {
-		c.Errorf("error retrieving host association: %v", host)
-		return meta, err
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if host != req.Host {
+		r := *req
+		r.Host = host
+		req = &r
+	}
+	if strings.HasPrefix(req.URL.Path, AdminAPIPath+"/") {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			// the port of the host is needed, which req no longer has.
+			if err := checkAPIWrite(req, authority); err != nil {
+				s.NewContext(req).Warningf("admin api request denied: %v", err)
+				writeAPIError(resp, http.StatusForbidden, err)
+				return
+			}
+		}
+		s.adminAPI().ServeHTTP(resp, req)
+		return
+	}
+	if req.URL.Path == ConsolePath || strings.HasPrefix(req.URL.Path, ConsolePath+"/") {
+		if req.URL.Path == ConsolePath {
+			http.Redirect(resp, req, ConsolePath+"/", http.StatusMovedPermanently)
+			return
+		}
+		s.console().ServeHTTP(resp, req)
+		return
+	}
+	// the pages below are served to anyone.
+	c := s.NewContext(req)
+	if s.throttle(c, resp, req) {
+		return
 	}
-	if len(assocs) == 0 {
+	if req.URL.Path == SetupPath || strings.HasPrefix(req.URL.Path, SetupPath+"/") {
+		s.HandleSetup(resp, req)
+		return
+	}
+	// the sitemap and verification of associations with a path prefix are
+	// served beneath the prefix.
+	switch {
+	case path.Base(req.URL.Path) == "sitemap.xml":
+		s.HandleSitemap(resp, req)
+	case req.URL.Path == "/robots.txt":
+		s.HandleRobots(resp, req)
+	case strings.HasSuffix(req.URL.Path, VerifyHandlerPath):
+		s.HandleVerify(resp, req)
+	case req.URL.Path == VerifyPath:
+		// serving the token would let anyone verify a domain pointed here.
+		http.NotFound(resp, req)
+	default:
+		s.HandleRoot(resp, req)
+	}
+}
+
+// ImportMeta returns the first entry of ImportMetas.
+func (s *Server) ImportMeta(req *http.Request) (importmeta.ImportMeta, error) {
+	return importmeta.MultiCodecFunc(s.ImportMetas).ImportMeta(req)
+}
+
+// ImportMetas serves the repository of the requested package.  If the domain
+// has a module proxy a "mod" entry naming it precedes the repository entry.
+// Access to packages requiring credentials is checked by Authorize, which
+// importmeta.Handler calls first.
+func (s *Server) ImportMetas(req *http.Request) ([]importmeta.ImportMeta, error) {
+	c := s.NewContext(req)
+	host := req.Host
+	assoc, err := lookupDomainAssoc(c, s.Store, host, req.URL.Path)
+	if err == nil {
+		assoc, err = s.serving(c, assoc, host)
+	}
+	if err == ErrNoSuchAssoc || (err == nil && !assoc.IsActive()) {
 		c.Warningf("request for unknown host: %v", host)
-		return meta, importmeta.ErrNotFound
+		return nil, importmeta.ErrNotFound
+	}
+	if err != nil {
+		c.Errorf("error retrieving host association: %v", err)
+		return nil, err
 	}
-	pkgRootBase := topLevelDir(req.URL.Path)
-	meta.Pkg = path.Join(host, req.URL.Path)
-	meta.RootPkg = path.Join(host, pkgRootBase)
-	meta.VCS = "git"
-	meta.Repo = fmt.Sprintf("https://github.com/%v/%v", assocs[0].GitHubLogin, pkgRootBase)
-	return meta, nil
-})
-var MetaHandler = importmeta.Handler(MetaCodec)
+	pkg, err := assoc.servedPackage(req.URL.Path)
+	if err == importmeta.ErrNotFound {
+		c.Infof("request for disabled package: %v", req.URL.Path)
+		return nil, err
+	}
+	if pkg.Private && !assoc.RequireToken && !s.allowed(c, req, assoc, pkg) {
+		// not found like an unknown package, so clients without access can't
+		// tell that it exists.
+		return nil, importmeta.ErrNotFound
+	}
+	metas, err := packageImportMetas(assoc, pkg, host, req.URL.Path)
+	if err != nil {
+		c.Errorf("association %v: %v", assoc.Key, err)
+		return nil, err
+	}
+	if s.RepoChecker != nil && !pkg.Private && !assoc.RequireToken {
+		// private repositories are hidden from the anonymous api.
+		exists, err := s.RepoChecker.Exists(c, assoc.repoAPI(pkg))
+		if err != nil {
+			// metadata is served while the provider can't be asked.
+			c.Warningf("unable to check the repository of %v: %v", metas[0].RootPkg, err)
+		}
+		if !exists {
+			c.Infof("request for missing repository: %v", req.URL.Path)
+			return nil, importmeta.ErrNoRepo
+		}
+	}
+	return metas, nil
+}
 
-func topLevelDir(reqpath string) string {
-	dir, file := path.Split(reqpath)
-	if dir == "" || dir == "/" {
-		return file
+// assocImportMetas returns the go-import entries served by assoc for reqpath
+// on host.  The root package is the first element of reqpath following the
+// prefix of assoc.  The settings of a registered package take precedence
+// over those of assoc.  Disabled packages are not found.  Entries served by
+// an alias name the canonical import path of the package.
+func assocImportMetas(assoc *DomainAssoc, host, reqpath string) ([]importmeta.ImportMeta, error) {
+	pkg, err := assoc.servedPackage(reqpath)
+	if err != nil {
+		return nil, err
+	}
+	return packageImportMetas(assoc, pkg, host, reqpath)
+}
+
+// packageImportMetas returns the go-import entries served by assoc for
+// reqpath, in the root package pkg, on host.
+func packageImportMetas(assoc *DomainAssoc, pkg *Package, host, reqpath string) ([]importmeta.ImportMeta, error) {
+	var meta importmeta.ImportMeta
+	meta.Pkg = path.Join(host, reqpath)
+	meta.RootPkg = path.Join(host, assoc.Prefix, pkg.Root)
+	meta.Canonical = assoc.canonicalPath(reqpath)
+	p, base, err := assoc.packageProvider(pkg)
+	if err != nil {
+		return nil, err
+	}
+	repo := pkg.Root
+	if pkg.Repo != "" {
+		repo = pkg.Repo
+	}
+	meta.Subdir = pkg.Subdir
+	p.setRepo(&meta, base, assoc.packageOwner(pkg), repo, meta.Subdir)
+	if isRepoURL(repo) {
+		// the provider's templates don't describe the repository.
+		meta.Repo = repo
+		meta.Home, meta.Dir, meta.File = "", "", ""
+	}
+	if pkg.VCS != "" && pkg.VCS != meta.VCS {
+		// the provider's source links are for its own vcs.
+		meta.VCS = pkg.VCS
+		meta.Dir, meta.File = "", ""
 	}
-	return topLevelDir(dir)
+	if assoc.Proxy == "" {
+		return []importmeta.ImportMeta{meta}, nil
+	}
+	mod := importmeta.ImportMeta{
+		Pkg:       meta.Pkg,
+		RootPkg:   meta.RootPkg,
+		VCS:       "mod",
+		Repo:      assoc.Proxy,
+		Canonical: meta.Canonical,
+	}
+	return []importmeta.ImportMeta{mod, meta}, nil
 }
 
-func HandleRoot(resp http.ResponseWriter, req *http.Request) {
-	c := appengine.NewContext(req)
+// servedPackage returns the package of assoc containing reqpath.  If the
+// package isn't registered one with the default settings is returned.  If
+// reqpath names no package or a disabled one importmeta.ErrNotFound is
+// returned.
+func (assoc *DomainAssoc) servedPackage(reqpath string) (*Package, error) {
+	root := topLevelDir(assoc.relPath(reqpath))
+	if root == "" {
+		return nil, importmeta.ErrNotFound
+	}
+	pkg := assoc.Package(root)
+	if pkg == nil {
+		pkg = &Package{Root: root}
+	}
+	if pkg.Disabled {
+		return nil, importmeta.ErrNotFound
+	}
+	return pkg, nil
+}
 
-	if req.URL.Path != "/" {
-		MetaHandler.ServeHTTP(resp, req)
-		return
+// topLevelDir returns the first element of reqpath.
+func topLevelDir(reqpath string) string {
+	reqpath = strings.TrimPrefix(path.Clean("/"+reqpath), "/")
+	if i := strings.Index(reqpath, "/"); i >= 0 {
+		return reqpath[:i]
 	}
+	return reqpath
+}
+
+// HandleRoot serves import metadata for packages and a landing page at the
+// root of each association.  Nothing is stored for unknown hosts; they are
+// claimed in the console, the admin API or the setup pages.
+func (s *Server) HandleRoot(resp http.ResponseWriter, req *http.Request) {
+	c := s.NewContext(req)
 
 	host := req.Host
-	assocs, err := GetDomainAssocs(c, host)
-	if err != nil {
-		c.Errorf("unable to lookup hostname: %v", err)
-		http.Error(resp, "an error occurred", http.StatusInternalServerError)
+	found, err := lookupDomainAssoc(c, s.Store, host, req.URL.Path)
+	if rel := strings.Trim(req.URL.Path, "/"); rel != "" && (err != nil || found.Prefix != rel) {
+		// a package, or a path beneath no association.
+		if req.Header.Get("Authorization") != "" {
+			// metadata of a private package must not be cached for others.
+			resp.Header().Set("Cache-Control", "private, no-store")
+		}
+		importmeta.Handler(s).ServeHTTP(resp, req)
 		return
 	}
+
 	var assoc DomainAssoc
-	if len(assocs) == 0 {
-		assoc := DomainAssoc{Domain: host}
-		err := PutDomainAssoc(c, &assoc)
-		if err != nil {
-			c.Errorf("unable to create stub entity: %v", err)
-			http.Error(resp, "an error occurred. check the logs for more information", http.StatusInternalServerError)
+	switch err.(type) {
+	case nil:
+		assoc = *found
+	case *ConflictError:
+		writeConflict(resp, err.(*ConflictError))
+		return
+	default:
+		if err != ErrNoSuchAssoc {
+			c.Errorf("unable to lookup hostname: %v", err)
+			http.Error(resp, "an error occurred", http.StatusInternalServerError)
 			return
 		}
-	} else {
-		assoc = assocs[0]
+		c.Warningf("request for unknown host: %v", host)
+		resp.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(resp, "unrecognized host:", host)
+		if s.setupActive(c) {
+			fmt.Fprintln(resp)
+			fmt.Fprintf(resp, "complete the setup of gopherpath at http://%v%v\n", host, SetupPath)
+		}
+		return
 	}
 
-	if assoc.GitHubLogin == "" {
+	served, err := s.serving(c, &assoc, host)
+	if err == ErrNoSuchAssoc {
 		resp.WriteHeader(http.StatusNotFound)
 		fmt.Fprintln(resp, "unrecognized host: ", host)
 		fmt.Fprintln(resp)
-		fmt.Fprintf(resp, "associate a github login with datastore DomainAssocs entity %s using the GAE admin dashboard\n", assoc.Key)
+		fmt.Fprintf(resp, "%v is an alias of %v, which has no association\n", assoc.Path(), assoc.AliasOf)
+		return
+	}
+	if err != nil {
+		c.Errorf("unable to lookup the canonical association of %v: %v", assoc.Path(), err)
+		http.Error(resp, "an error occurred", http.StatusInternalServerError)
+		return
+	}
+	if served.GitHubLogin == "" {
+		c.Infof("association %v of %v has no repository owner", served.Key, served.Path())
+		resp.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(resp, "unrecognized host: ", host)
+		return
+	}
+
+	if !assoc.IsVerified() {
+		resp.WriteHeader(http.StatusNotFound)
+		if assoc.VerifyToken == "" {
+			// associations created by hand have none.  it is issued by a
+			// POST so reads never change the store.
+			fmt.Fprintf(resp, "ownership of %v has not been verified.\n\n", assoc.verifyDomain())
+			fmt.Fprintf(resp, "POST to http://%v%v for a verification token\n", path.Join(host, assoc.Prefix), VerifyHandlerPath)
+			return
+		}
+		writeVerifyInstructions(resp, &assoc, host)
 		return
 	}
 
-	fmt.Fprintf(resp, "%v directs clients to source repositories at https://github.com/%v", host, assoc.GitHubLogin)
+	if !served.IsActive() {
+		// the canonical association isn't verified.
+		resp.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(resp, "unrecognized host: ", host)
+		return
+	}
+	if served.canonical != "" {
+		fmt.Fprintf(resp, "%v is an alias of %v, which directs clients to source repositories at %v",
+			served.Path(), served.canonical, served.OwnerURL())
+		return
+	}
+	fmt.Fprintf(resp, "%v directs clients to source repositories at %v", served.Path(), served.OwnerURL())
 }
@@ -0,0 +1,184 @@
+package gipspot
+
+import (
+	"importmeta"
+
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testContext discards log messages.
+var testContext = LogContext(log.New(ioutil.Discard, "", 0))
+
+// testServer returns a Server for the given associations.
+func testServer(assocs ...DomainAssoc) *Server {
+	return &Server{
+		NewContext: func(req *http.Request) Context { return testContext },
+		Store:      NewMemStore(assocs...),
+	}
+}
+
+// verified returns assoc with its domain marked verified.
+func verified(assoc DomainAssoc) DomainAssoc {
+	assoc.VerifyToken = "token"
+	assoc.Verified = time.Now()
+	assoc.VerifiedDomain = assoc.Domain
+	return assoc
+}
+
+func TestImportMetas(t *testing.T) {
+	s := testServer(
+		verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo", Packages: []Package{
+			{Root: "foo", Repo: "mono", Subdir: "go/foo"},
+			{Root: "org", Owner: "foo-org", Repo: "lib"},
+			{Root: "lab", Provider: "gitlab", Owner: "group/sub"},
+			{Root: "hg", Repo: "https://hg.foo.io/hg", VCS: "hg"},
+			{Root: "old", Disabled: true},
+		}}),
+		verified(DomainAssoc{Domain: "bar.io", GitHubLogin: "mcbar", Proxy: "https://proxy.bar.io"}),
+		DomainAssoc{Domain: "qux.io", GitHubLogin: "mcqux"},
+	)
+	for i, test := range []struct {
+		URL    string
+		Expect []importmeta.ImportMeta
+		Err    error
+	}{
+		{"http://foo.io/bar/baz?go-get=1", []importmeta.ImportMeta{
+			{Pkg: "foo.io/bar/baz", RootPkg: "foo.io/bar", VCS: "git", Repo: "https://github.com/mcfoo/bar"},
+		}, nil},
+		{"http://foo.io/foo?go-get=1", []importmeta.ImportMeta{
+			{Pkg: "foo.io/foo", RootPkg: "foo.io/foo", VCS: "git", Repo: "https://github.com/mcfoo/mono", Subdir: "go/foo"},
+		}, nil},
+		{"http://foo.io/org/x?go-get=1", []importmeta.ImportMeta{
+			{Pkg: "foo.io/org/x", RootPkg: "foo.io/org", VCS: "git", Repo: "https://github.com/foo-org/lib"},
+		}, nil},
+		{"http://foo.io/lab?go-get=1", []importmeta.ImportMeta{
+			{Pkg: "foo.io/lab", RootPkg: "foo.io/lab", VCS: "git", Repo: "https://gitlab.com/group/sub/lab.git"},
+		}, nil},
+		{"http://foo.io/hg?go-get=1", []importmeta.ImportMeta{
+			{Pkg: "foo.io/hg", RootPkg: "foo.io/hg", VCS: "hg", Repo: "https://hg.foo.io/hg"},
+		}, nil},
+		{"http://foo.io/old?go-get=1", nil, importmeta.ErrNotFound},
+		{"http://bar.io/qux?go-get=1", []importmeta.ImportMeta{
+			{Pkg: "bar.io/qux", RootPkg: "bar.io/qux", VCS: "mod", Repo: "https://proxy.bar.io"},
+			{Pkg: "bar.io/qux", RootPkg: "bar.io/qux", VCS: "git", Repo: "https://github.com/mcbar/qux"},
+		}, nil},
+		{"http://qux.io/qux?go-get=1", nil, importmeta.ErrNotFound},
+	} {
+		req, _ := http.NewRequest("GET", test.URL, nil)
+		metas, err := s.ImportMetas(req)
+		if err != test.Err {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if len(metas) != len(test.Expect) {
+			t.Errorf("test %d: unexpected metadata: %v", i, metas)
+			continue
+		}
+		for j := range metas {
+			// go-source templates are checked by TestProviders.
+			m := metas[j]
+			m.Home, m.Dir, m.File = "", "", ""
+			if m != test.Expect[j] {
+				t.Errorf("test %d: entry %d is %v not %v", i, j, metas[j], test.Expect[j])
+			}
+		}
+	}
+}
+
+func TestHandleRoot(t *testing.T) {
+	s := testServer(verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo"}))
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://foo.io/", nil)
+	s.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "https://github.com/mcfoo") {
+		t.Errorf("unexpected response for known host: %d %q", resp.Code, resp.Body.String())
+	}
+
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://bar.io/", nil)
+	s.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("unexpected status for unknown host: %d", resp.Code)
+	}
+	if assocs, _ := s.Store.ListDomainAssocs(testContext); len(assocs) != 1 {
+		t.Errorf("association stored for unknown host: %#v", assocs)
+	}
+
+	// the store key of an association without an owner is not revealed.
+	ownerless := DomainAssoc{Domain: "baz.io"}
+	if err := s.Store.PutDomainAssoc(testContext, &ownerless); err != nil {
+		t.Fatal(err)
+	}
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://baz.io/", nil)
+	s.ServeHTTP(resp, req)
+	if body := resp.Body.String(); resp.Code != http.StatusNotFound || strings.Contains(body, ownerless.Key) || strings.Contains(body, "entity") {
+		t.Errorf("unexpected response for a host without an owner: %d %q", resp.Code, body)
+	}
+
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://foo.io/bar?go-get=1", nil)
+	s.ServeHTTP(resp, req)
+	tag := `<meta name="go-import" content="foo.io/bar git https://github.com/mcfoo/bar">`
+	if !strings.Contains(resp.Body.String(), tag) {
+		t.Errorf("package response missing meta tag: %q", resp.Body.String())
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	s := testServer(
+		verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo"}),
+		verified(DomainAssoc{Domain: "foo.io", Prefix: "go", GitHubLogin: "mcgo", Packages: []Package{{Root: "bar"}}}),
+		verified(DomainAssoc{Domain: "foo.io", Prefix: "go/x", GitHubLogin: "mcx"}),
+	)
+	for i, test := range []struct {
+		URL  string
+		Root string
+		Repo string
+	}{
+		{"http://foo.io/bar", "foo.io/bar", "https://github.com/mcfoo/bar"},
+		{"http://foo.io/gopher", "foo.io/gopher", "https://github.com/mcfoo/gopher"},
+		{"http://foo.io/go/bar/baz", "foo.io/go/bar", "https://github.com/mcgo/bar"},
+		{"http://foo.io/go/x/y", "foo.io/go/x/y", "https://github.com/mcx/y"},
+		{"http://foo.io/go", "", ""},
+	} {
+		req, _ := http.NewRequest("GET", test.URL+"?go-get=1", nil)
+		metas, err := s.ImportMetas(req)
+		if test.Root == "" {
+			if err != importmeta.ErrNotFound {
+				t.Errorf("test %d: unexpected metadata: %v %v", i, metas, err)
+			}
+			continue
+		}
+		if err != nil || len(metas) != 1 || metas[0].RootPkg != test.Root || metas[0].Repo != test.Repo {
+			t.Errorf("test %d: unexpected metadata: %v %v", i, metas, err)
+		}
+	}
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://foo.io/go/", nil)
+	s.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "foo.io/go directs clients to source repositories at https://github.com/mcgo") {
+		t.Errorf("unexpected prefix landing page: %d %q", resp.Code, resp.Body.String())
+	}
+
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://foo.io/go/sitemap.xml", nil)
+	s.ServeHTTP(resp, req)
+	if !strings.Contains(resp.Body.String(), "<loc>http://foo.io/go/bar</loc>") {
+		t.Errorf("unexpected prefix sitemap: %d %q", resp.Code, resp.Body.String())
+	}
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://foo.io/bar/sitemap.xml", nil)
+	s.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("sitemap served beneath a package: %d %q", resp.Code, resp.Body.String())
+	}
+}
@@ -0,0 +1,254 @@
+package gipspot
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// NormalizeHost returns host in the form domains are stored in: without a
+// port or a trailing dot, in lower case and with internationalized labels in
+// their ASCII (punycode) form.  An error is returned if host is not a valid
+// domain name or IP address.
+func NormalizeHost(host string) (string, error) {
+	h := strings.TrimSpace(host)
+	if hostOnly, _, err := net.SplitHostPort(h); err == nil {
+		h = hostOnly
+	} else if strings.HasPrefix(h, "[") && strings.HasSuffix(h, "]") {
+		h = h[1 : len(h)-1]
+	}
+	if ip := net.ParseIP(h); ip != nil {
+		return ip.String(), nil
+	}
+	h = strings.TrimSuffix(strings.ToLower(h), ".")
+	if h == "" || len(h) > 253 {
+		return "", fmt.Errorf("invalid host %q", host)
+	}
+	labels := strings.Split(h, ".")
+	for i, label := range labels {
+		if !isASCII(label) {
+			label = "xn--" + punycode(label)
+			labels[i] = label
+		}
+		if !isLabel(label) {
+			return "", fmt.Errorf("invalid host %q", host)
+		}
+	}
+	h = strings.Join(labels, ".")
+	if len(h) > 253 {
+		return "", fmt.Errorf("invalid host %q", host)
+	}
+	return h, nil
+}
+
+// normalizeDomain is like NormalizeHost for the domain of an association,
+// which may be a wildcard.
+func normalizeDomain(domain string) (string, error) {
+	if strings.HasPrefix(domain, "*.") {
+		parent, err := NormalizeHost(domain[2:])
+		return "*." + parent, err
+	}
+	return NormalizeHost(domain)
+}
+
+// canonicalDomain returns the normalized form of domain, or domain itself if
+// it is invalid, leaving the error to validation.
+func canonicalDomain(domain string) string {
+	if d, err := normalizeDomain(strings.TrimSpace(domain)); err == nil {
+		return d
+	}
+	return domain
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// requestHost returns the normalized host requested by req.  The
+// X-Forwarded-Host header is honored only in requests from TrustedProxies,
+// and then its last value, the one set by the nearest proxy, is used.
+func (s *Server) requestHost(req *http.Request) (string, error) {
+	return NormalizeHost(s.requestAuthority(req))
+}
+
+// requestAuthority returns the host requested by req as it was given, with
+// its port if it has one.  See requestHost.
+func (s *Server) requestAuthority(req *http.Request) string {
+	if fwd := req.Header.Get("X-Forwarded-Host"); fwd != "" && s.trustedProxy(req.RemoteAddr) {
+		values := strings.Split(fwd, ",")
+		return strings.TrimSpace(values[len(values)-1])
+	}
+	return req.Host
+}
+
+// trustedProxy returns true if addr is the address of a trusted proxy.
+func (s *Server) trustedProxy(addr string) bool {
+	ip := parseAddr(addr)
+	return ip != nil && inNetworks(ip, s.TrustedProxies)
+}
+
+// clientIP returns the address of the client making req, or nil if it is
+// unknown.  The X-Forwarded-For header of requests from TrustedProxies is
+// followed back to the first address which is not a trusted proxy.
+func (s *Server) clientIP(req *http.Request) net.IP {
+	ip := parseAddr(req.RemoteAddr)
+	if ip == nil || !inNetworks(ip, s.TrustedProxies) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseAddr(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !inNetworks(ip, s.TrustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// parseAddr parses an IP address, with or without a port.
+func parseAddr(addr string) net.IP {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		addr = h
+	}
+	return net.ParseIP(addr)
+}
+
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNetworks parses a comma separated list of CIDR networks and IP
+// addresses, the latter standing for networks of a single address.
+func ParseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, elem := range strings.Split(s, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem == "" {
+			continue
+		}
+		if !strings.Contains(elem, "/") {
+			ip := net.ParseIP(elem)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", elem)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(elem)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Parameters of punycode (RFC 3492).
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// punycode returns the punycode encoding of label, without the "xn--"
+// prefix.
+func punycode(label string) string {
+	runes := []rune(label)
+	var out []byte
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	b := len(out)
+	h := b
+	if b > 0 {
+		out = append(out, '-')
+	}
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for h < len(runes) {
+		m := rune(utf8.MaxRune)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (h + 1)
+		n = m
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
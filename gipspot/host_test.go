@@ -0,0 +1,84 @@
+package gipspot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	for i, test := range []struct {
+		host   string
+		expect string
+	}{
+		{"foo.io", "foo.io"},
+		{"Foo.IO:8080", "foo.io"},
+		{"foo.io.", "foo.io"},
+		{"go.münchen.de", "go.xn--mnchen-3ya.de"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"例え.jp", "xn--r8jz45g.jp"},
+		{"127.0.0.1:80", "127.0.0.1"},
+		{"[::1]:8080", "::1"},
+		{"", ""},
+		{"foo..io", ""},
+		{"foo_bar.io", ""},
+		{"-foo.io", ""},
+		{"foo.io/bar", ""},
+	} {
+		host, err := NormalizeHost(test.host)
+		if test.expect == "" {
+			if err == nil {
+				t.Errorf("test %d: invalid host %q accepted as %q", i, test.host, host)
+			}
+			continue
+		}
+		if err != nil || host != test.expect {
+			t.Errorf("test %d: %q normalized to %q (%v), not %q", i, test.host, host, err, test.expect)
+		}
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	s := testServer(verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo"}))
+	s.TrustedProxies, _ = ParseNetworks("10.0.0.0/8, 192.168.1.1")
+	for i, test := range []struct {
+		host   string
+		remote string
+		fwd    string
+		code   int
+	}{
+		{"FOO.io:8080", "1.2.3.4:1234", "", http.StatusOK},
+		{"foo.io.", "1.2.3.4:1234", "", http.StatusOK},
+		{"proxy.internal", "10.1.2.3:1234", "Foo.io", http.StatusOK},
+		{"proxy.internal", "192.168.1.1:1234", "evil.io, foo.io", http.StatusOK},
+		{"proxy.internal", "192.168.1.2:1234", "foo.io", http.StatusNotFound},
+		{"proxy.internal", "10.1.2.3:1234", "foo.io, evil.io", http.StatusNotFound},
+		{"bar.io", "1.2.3.4:1234", "", http.StatusNotFound},
+		{"foo..io", "1.2.3.4:1234", "", http.StatusBadRequest},
+	} {
+		req, _ := http.NewRequest("GET", "http://foo.io/", nil)
+		req.Host = test.host
+		req.RemoteAddr = test.remote
+		if test.fwd != "" {
+			req.Header.Set("X-Forwarded-Host", test.fwd)
+		}
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		if resp.Code != test.code {
+			t.Errorf("test %d: unexpected response: %d %q", i, resp.Code, resp.Body.String())
+		}
+	}
+
+	// unregistered hosts are rejected everywhere.
+	for i, p := range []string{"/", "/bar?go-get=1", "/sitemap.xml", "/robots.txt", VerifyHandlerPath} {
+		req, _ := http.NewRequest("GET", "http://bar.io"+p, nil)
+		if p == VerifyHandlerPath {
+			req.Method = "POST"
+		}
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("test %d: unregistered host served: %d %q", i, resp.Code, resp.Body.String())
+		}
+	}
+}
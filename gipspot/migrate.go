@@ -0,0 +1,145 @@
+package gipspot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SchemaVersion is the version of the schema of associations written by this
+// version of gopherpath.  Stores set the Schema of every association they
+// write to it.
+const SchemaVersion = 1
+
+// migration upgrades associations stored with an older schema to version.
+// Associations are upgraded every time they are read until they are written
+// back, so upgrade must leave an association it has already upgraded alone.
+type migration struct {
+	version int
+	upgrade func(assoc *DomainAssoc)
+}
+
+// migrations hold a migration for every schema version, oldest first.
+var migrations = []migration{
+	{1, normalizeAssocDomains},
+}
+
+// upgradeAssoc applies the migrations newer than assoc.Schema to assoc, as
+// stores do when reading associations.  assoc.Schema is left alone so it
+// keeps naming the version stored until assoc is written.  upgradeAssoc
+// returns true if assoc was stored with an older schema.
+func upgradeAssoc(assoc *DomainAssoc) bool {
+	if assoc.Schema >= SchemaVersion {
+		return false
+	}
+	for _, m := range migrations {
+		if m.version > assoc.Schema {
+			m.upgrade(assoc)
+		}
+	}
+	return true
+}
+
+// normalizeAssocDomains normalizes the domains of associations stored before
+// requested hosts were normalized, which would no longer be found.  Domains
+// which can't be normalized are left to validation.
+func normalizeAssocDomains(assoc *DomainAssoc) {
+	assoc.Domain = canonicalDomain(assoc.Domain)
+	assoc.VerifiedDomain = canonicalDomain(assoc.VerifiedDomain)
+	assoc.AliasOf = canonicalAssocPath(assoc.AliasOf)
+	for i := range assoc.Labels {
+		assoc.Labels[i] = strings.ToLower(assoc.Labels[i])
+	}
+}
+
+// MigrateOptions control Migrate.
+type MigrateOptions struct {
+	From   string // key of the first association to check (see MigrateProgress.Next); the first of the store if empty
+	Limit  int    // most associations written; every outdated association if not positive
+	DryRun bool   // count the associations to migrate without writing them
+
+	// Progress is called with the progress made after each association
+	// checked, if not nil.
+	Progress func(p *MigrateProgress)
+}
+
+// MigrateProgress reports the progress of Migrate.
+type MigrateProgress struct {
+	Total    int      `json:"total"`            // associations in the store
+	Checked  int      `json:"checked"`          // associations checked, including those of earlier runs
+	Migrated int      `json:"migrated"`         // associations written by this run, or which would be by a dry run
+	Failed   []string `json:"failed,omitempty"` // associations which could not be written, with the reason
+	Next     string   `json:"next,omitempty"`   // value of MigrateOptions.From continuing the migration; empty when done
+	Error    string   `json:"error,omitempty"`  // error which stopped the migration, as reported by the admin API
+}
+
+// Migrate writes every association of store stored with a schema older than
+// SchemaVersion, upgrading it.  Associations are visited in the order of
+// their keys, so a migration stopped by opts.Limit, an error or a deadline is
+// resumed by passing the key of the first association left, reported as
+// Next, as opts.From.  An association whose write failed with an error is
+// left, so resuming retries it.  Running Migrate again is harmless, as
+// upgraded associations are not written again.  An association which is
+// invalid after the upgrade, or whose upgraded domain and prefix are taken,
+// is listed in the progress as failed and left alone.
+func Migrate(c Context, store AssocStore, opts MigrateOptions) (*MigrateProgress, error) {
+	assocs, err := store.ListDomainAssocs(c)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byKey(assocs))
+	p := &MigrateProgress{Total: len(assocs)}
+	for i := range assocs {
+		assoc := &assocs[i]
+		if opts.From != "" && keyLess(assoc.Key, opts.From) {
+			p.Checked++
+			continue
+		}
+		if opts.Limit > 0 && p.Migrated >= opts.Limit {
+			p.Next = assoc.Key
+			break
+		}
+		if assoc.Schema < SchemaVersion {
+			var err error
+			if !opts.DryRun {
+				err = migrateAssoc(c, store, assoc)
+			}
+			if _, invalid := err.(*ValidationError); invalid || err == ErrDomainTaken {
+				p.Failed = append(p.Failed, fmt.Sprintf("%v (%v): %v", assoc.Key, assoc.Path(), err))
+			} else if err != nil {
+				p.Next = assoc.Key
+				return p, fmt.Errorf("%v: %v", assoc.Key, err)
+			} else {
+				p.Migrated++
+			}
+		}
+		p.Checked++
+		if opts.Progress != nil {
+			opts.Progress(p)
+		}
+	}
+	return p, nil
+}
+
+// migrateAssoc writes assoc, read from store, to store.  If assoc is changed
+// concurrently it is read again and written unless it was upgraded meanwhile.
+func migrateAssoc(c Context, store AssocStore, assoc *DomainAssoc) error {
+	for attempt := 0; ; attempt++ {
+		upgraded := copyDomainAssoc(*assoc)
+		err := store.PutDomainAssoc(c, &upgraded)
+		if err != ErrConflict || attempt >= 3 {
+			return err
+		}
+		current, err := store.GetDomainAssoc(c, assoc.Key)
+		if err == ErrNoSuchAssoc {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if current.Schema >= SchemaVersion {
+			return nil
+		}
+		assoc = current
+	}
+}
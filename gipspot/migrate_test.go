@@ -0,0 +1,174 @@
+package gipspot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// legacyStore is the content of a store file written before associations
+// carried a schema version.
+const legacyStore = `{
+	"nextKey": 4,
+	"assocs": [
+		{"key": "1", "domain": "Foo.IO.", "githubLogin": "mcfoo", "verified": "2015-01-01T00:00:00Z", "verifiedDomain": "Foo.IO."},
+		{"key": "2", "domain": "bar.io", "aliasOf": "FOO.io", "verified": "2015-01-01T00:00:00Z", "verifiedDomain": "bar.io"},
+		{"key": "3", "domain": "qux.io", "githubLogin": "mcqux", "schema": 1}
+	]
+}`
+
+func openLegacyStore(t *testing.T) (*FileStore, func()) {
+	dir, err := ioutil.TempDir("", "gipspot-migrate-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "store.json")
+	err = ioutil.WriteFile(name, []byte(legacyStore), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenFileStore(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, func() { os.RemoveAll(dir) }
+}
+
+func TestUpgradeAssoc(t *testing.T) {
+	store, cleanup := openLegacyStore(t)
+	defer cleanup()
+	assocs, err := store.GetDomainAssocs(testContext, "foo.io")
+	if err != nil || len(assocs) != 1 {
+		t.Fatalf("legacy association not found: %#v %v", assocs, err)
+	}
+	if assoc := assocs[0]; assoc.Schema != 0 || !assoc.IsActive() {
+		t.Errorf("unexpected upgrade: %#v", assoc)
+	}
+	alias, _ := store.GetDomainAssoc(testContext, "2")
+	if alias.AliasOf != "foo.io" {
+		t.Errorf("alias target not upgraded: %q", alias.AliasOf)
+	}
+	// upgrading twice changes nothing.
+	upgraded := copyDomainAssoc(assocs[0])
+	upgradeAssoc(&upgraded)
+	if string(auditJSON(upgraded)) != string(auditJSON(assocs[0])) {
+		t.Errorf("upgrade is not idempotent: %#v", upgraded)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	store, cleanup := openLegacyStore(t)
+	defer cleanup()
+
+	p, err := Migrate(testContext, store, MigrateOptions{DryRun: true})
+	if err != nil || p.Total != 3 || p.Checked != 3 || p.Migrated != 2 || p.Next != "" {
+		t.Fatalf("unexpected dry run: %#v %v", p, err)
+	}
+	if assoc, _ := store.GetDomainAssoc(testContext, "1"); assoc.Schema != 0 {
+		t.Errorf("dry run wrote an association")
+	}
+
+	var reported []int
+	p, err = Migrate(testContext, store, MigrateOptions{Limit: 1, Progress: func(p *MigrateProgress) {
+		reported = append(reported, p.Checked)
+	}})
+	if err != nil || p.Migrated != 1 || p.Next != "2" || len(reported) != 1 {
+		t.Fatalf("unexpected limited run: %#v %v %v", p, reported, err)
+	}
+	p, err = Migrate(testContext, store, MigrateOptions{From: p.Next})
+	if err != nil || p.Migrated != 1 || p.Checked != 3 || p.Next != "" {
+		t.Fatalf("unexpected resumed run: %#v %v", p, err)
+	}
+	p, err = Migrate(testContext, store, MigrateOptions{})
+	if err != nil || p.Migrated != 0 {
+		t.Errorf("repeated migration made changes: %#v %v", p, err)
+	}
+
+	reopened, err := OpenFileStore(store.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assocs, _ := reopened.ListDomainAssocs(testContext)
+	for _, assoc := range assocs {
+		if assoc.Schema != SchemaVersion {
+			t.Errorf("association %v not migrated: %#v", assoc.Key, assoc)
+		}
+	}
+	if assocs[0].Domain != "foo.io" || !assocs[0].IsVerified() {
+		t.Errorf("unexpected migrated association: %#v", assocs[0])
+	}
+}
+
+// failingStore is a FileStore whose writes of the association with key fail
+// until the error is cleared.
+type failingStore struct {
+	*FileStore
+	key string
+	err error
+}
+
+func (s *failingStore) PutDomainAssoc(c Context, assoc *DomainAssoc) error {
+	if assoc.Key == s.key && s.err != nil {
+		return s.err
+	}
+	return s.FileStore.PutDomainAssoc(c, assoc)
+}
+
+func TestMigrateResumesFailure(t *testing.T) {
+	legacy, cleanup := openLegacyStore(t)
+	defer cleanup()
+	store := &failingStore{legacy, "1", fmt.Errorf("deadline exceeded")}
+
+	p, err := Migrate(testContext, store, MigrateOptions{})
+	if err == nil || p.Migrated != 0 || p.Next != "1" {
+		t.Fatalf("unexpected failed run: %#v %v", p, err)
+	}
+	store.err = nil
+	p, err = Migrate(testContext, store, MigrateOptions{From: p.Next})
+	if err != nil || p.Migrated != 2 || p.Next != "" {
+		t.Errorf("failed association not retried: %#v %v", p, err)
+	}
+
+}
+
+func TestAdminMigrateFailure(t *testing.T) {
+	legacy, cleanup := openLegacyStore(t)
+	defer cleanup()
+	s := testServer()
+	s.Store = &failingStore{legacy, "2", fmt.Errorf("deadline exceeded")}
+	s.Authenticate = BearerTokens(map[string]string{"s3cret": "admin"})
+
+	resp := apiRequest(s, "POST", "/migrate", "")
+	var p MigrateProgress
+	decodeAPI(t, resp, &p)
+	if resp.Code != http.StatusInternalServerError || p.Migrated != 1 || p.Next != "2" || p.Error == "" {
+		t.Errorf("unexpected progress: %d %q", resp.Code, resp.Body.String())
+	}
+}
+
+func TestAdminMigrate(t *testing.T) {
+	store, cleanup := openLegacyStore(t)
+	defer cleanup()
+	s := testServer()
+	s.Store = store
+	s.Authenticate = BearerTokens(map[string]string{"s3cret": "admin"})
+
+	resp := apiRequest(s, "POST", "/migrate?limit=1", "")
+	var p MigrateProgress
+	decodeAPI(t, resp, &p)
+	if resp.Code != http.StatusOK || p.Migrated != 1 || p.Next != "2" {
+		t.Fatalf("unexpected progress: %q", resp.Body.String())
+	}
+	resp = apiRequest(s, "POST", "/migrate?from="+p.Next, "")
+	p = MigrateProgress{}
+	decodeAPI(t, resp, &p)
+	if p.Migrated != 1 || p.Next != "" {
+		t.Errorf("unexpected progress: %q", resp.Body.String())
+	}
+	if resp := apiRequest(s, "POST", "/migrate?limit=some", ""); resp.Code != http.StatusBadRequest {
+		t.Errorf("invalid limit accepted: %d", resp.Code)
+	}
+}
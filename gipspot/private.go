@@ -0,0 +1,34 @@
+package gipspot
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// Private packages are served only to clients with credentials, see
+// Server.Authorize.  Any other request for a private package gets the 404
+// served for a package beneath no association, so the existence of private
+// packages is not revealed.  The repository URL of a private package is
+// usually an ssh URL (e.g. "ssh://git@github.com/org/repo.git") or an https
+// URL for which clients have credentials.
+
+// ClientTokens returns an Authenticator accepting requests with a token of
+// tokens as either an "Authorization: Bearer <token>" header or the password
+// of basic authentication, as the go command sends for hosts listed in
+// .netrc.  The value of a token is the identity of the client.  If basic
+// authentication names a user it must be the token's.
+func ClientTokens(tokens map[string]string) Authenticator {
+	bearer := BearerTokens(tokens)
+	return func(req *http.Request) (string, error) {
+		name, password, ok := req.BasicAuth()
+		if !ok {
+			return bearer(req)
+		}
+		for token, user := range tokens {
+			if subtle.ConstantTimeCompare([]byte(password), []byte(token)) == 1 && (name == "" || name == user) {
+				return user, nil
+			}
+		}
+		return "", ErrUnauthorized
+	}
+}
@@ -0,0 +1,277 @@
+package gipspot
+
+import (
+	"importmeta"
+
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Provider describes a code hosting service.  Its templates expand the
+// placeholders {base} (the service's base URL), {owner}, {repo}, {path} (the
+// owner and repository with the slashes escaped) and {subdir} (the repository
+// subdirectory holding a package, with a leading slash, or nothing).  The
+// go-source placeholders {dir}, {/dir}, {file} and {line} are left for
+// clients to expand.
+type Provider struct {
+	Name    string // name recorded by associations (e.g. "github")
+	BaseURL string // default base URL; associations must give one if empty
+	VCS     string // version control system of repositories
+
+	// Nested is true if owners may be nested groups (e.g. "org/team").
+	Nested bool
+
+	Owner string // template of the owner's page
+	Repo  string // template of the repository's clone URL
+
+	// go-source templates.  If Home is empty no go-source tag is served.
+	Home string
+	Dir  string
+	File string
+
+	// API is the template of the repository's resource in the service's API,
+	// which exists only if the repository does.  If it is empty, or does not
+	// contain {base} and the association names another base URL, the
+	// existence of repositories is not checked.
+	API string
+}
+
+// DefaultProvider is used by associations which do not name a provider.
+const DefaultProvider = "github"
+
+// Providers holds the known providers by name.
+var Providers = map[string]*Provider{
+	"github": {
+		Name:    "github",
+		BaseURL: "https://github.com",
+		VCS:     "git",
+		Owner:   "{base}/{owner}",
+		Repo:    "{base}/{owner}/{repo}",
+		Home:    "{base}/{owner}/{repo}",
+		Dir:     "{base}/{owner}/{repo}/tree/HEAD{subdir}{/dir}",
+		File:    "{base}/{owner}/{repo}/blob/HEAD{subdir}{/dir}/{file}#L{line}",
+		API:     "https://api.github.com/repos/{owner}/{repo}",
+	},
+	"gitlab": {
+		Name:    "gitlab",
+		BaseURL: "https://gitlab.com",
+		VCS:     "git",
+		Nested:  true,
+		Owner:   "{base}/{owner}",
+		Repo:    "{base}/{owner}/{repo}.git",
+		Home:    "{base}/{owner}/{repo}",
+		Dir:     "{base}/{owner}/{repo}/-/tree/HEAD{subdir}{/dir}",
+		File:    "{base}/{owner}/{repo}/-/blob/HEAD{subdir}{/dir}/{file}#L{line}",
+		API:     "{base}/api/v4/projects/{path}",
+	},
+	"bitbucket": {
+		Name:    "bitbucket",
+		BaseURL: "https://bitbucket.org",
+		VCS:     "git",
+		Owner:   "{base}/{owner}",
+		Repo:    "{base}/{owner}/{repo}",
+		Home:    "{base}/{owner}/{repo}",
+		Dir:     "{base}/{owner}/{repo}/src/HEAD{subdir}{/dir}",
+		File:    "{base}/{owner}/{repo}/src/HEAD{subdir}{/dir}/{file}#lines-{line}",
+		API:     "https://api.bitbucket.org/2.0/repositories/{owner}/{repo}",
+	},
+	"gitea": {
+		// also serves Forgejo and Codeberg (https://codeberg.org).  Source
+		// urls name a branch and there is no alias for the default branch,
+		// so only the home page is linked.
+		Name:  "gitea",
+		VCS:   "git",
+		Owner: "{base}/{owner}",
+		Repo:  "{base}/{owner}/{repo}.git",
+		Home:  "{base}/{owner}/{repo}",
+		API:   "{base}/api/v1/repos/{owner}/{repo}",
+	},
+	"sourcehut": {
+		Name:    "sourcehut",
+		BaseURL: "https://git.sr.ht",
+		VCS:     "git",
+		Owner:   "{base}/~{owner}",
+		Repo:    "{base}/~{owner}/{repo}",
+		Home:    "{base}/~{owner}/{repo}",
+		Dir:     "{base}/~{owner}/{repo}/tree/HEAD/item{subdir}{/dir}",
+		File:    "{base}/~{owner}/{repo}/tree/HEAD/item{subdir}{/dir}/{file}#L{line}",
+	},
+	"git": {
+		// any git server, e.g. https://git.example.com/{owner}/{repo}.git
+		Name:   "git",
+		VCS:    "git",
+		Nested: true,
+		Owner:  "{base}/{owner}",
+		Repo:   "{base}/{owner}/{repo}.git",
+	},
+}
+
+// ProviderNames returns the names of the known providers in sorted order.
+func ProviderNames() []string {
+	var names []string
+	for name := range Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// provider returns the Provider of assoc and the base URL of its
+// repositories.
+func (assoc *DomainAssoc) provider() (*Provider, string, error) {
+	return lookupProvider(assoc.Provider, assoc.ProviderURL)
+}
+
+// packageProvider returns the Provider of pkg and the base URL of its
+// repository.  Settings of pkg take precedence over those of assoc.
+func (assoc *DomainAssoc) packageProvider(pkg *Package) (*Provider, string, error) {
+	name, base := assoc.packageProviderName(pkg)
+	return lookupProvider(name, base)
+}
+
+// packageProviderName returns the names of the provider and its base URL
+// which apply to pkg.  The base URL of assoc only applies to packages of the
+// same provider.
+func (assoc *DomainAssoc) packageProviderName(pkg *Package) (string, string) {
+	name, base := providerName(pkg.Provider), pkg.ProviderURL
+	if pkg.Provider == "" || name == providerName(assoc.Provider) {
+		name = providerName(assoc.Provider)
+		if base == "" {
+			base = assoc.ProviderURL
+		}
+	}
+	return name, base
+}
+
+// packageOwner returns the owner of the repository of pkg.
+func (assoc *DomainAssoc) packageOwner(pkg *Package) string {
+	if pkg.Owner != "" {
+		return pkg.Owner
+	}
+	return assoc.GitHubLogin
+}
+
+func providerName(name string) string {
+	if name == "" {
+		return DefaultProvider
+	}
+	return name
+}
+
+// lookupProvider returns the named Provider and the base URL of its
+// repositories, which is providerURL if it is not empty.
+func lookupProvider(name, providerURL string) (*Provider, string, error) {
+	name = providerName(name)
+	p := Providers[name]
+	if p == nil {
+		return nil, "", fmt.Errorf("unknown provider %q", name)
+	}
+	base := strings.TrimSuffix(providerURL, "/")
+	if base == "" {
+		base = p.BaseURL
+	}
+	if base == "" {
+		return nil, "", fmt.Errorf("provider %q requires a base url", name)
+	}
+	return p, base, nil
+}
+
+// OwnerURL returns the page listing the repositories of assoc's owner.
+func (assoc *DomainAssoc) OwnerURL() string {
+	p, base, err := assoc.provider()
+	if err != nil {
+		return ""
+	}
+	return p.expand(p.Owner, base, assoc.GitHubLogin, "", "")
+}
+
+// expand returns tmpl with the placeholders of the provider replaced.
+func (p *Provider) expand(tmpl, base, owner, repo, subdir string) string {
+	if tmpl == "" {
+		return ""
+	}
+	if subdir != "" {
+		subdir = "/" + subdir
+	}
+	return strings.NewReplacer(
+		"{base}", base,
+		"{owner}", owner,
+		"{repo}", repo,
+		"{path}", url.PathEscape(owner+"/"+repo),
+		"{subdir}", subdir,
+	).Replace(tmpl)
+}
+
+// repoAPI returns the API resource of the repository of pkg, or an empty
+// string if its existence cannot be checked.
+func (assoc *DomainAssoc) repoAPI(pkg *Package) string {
+	p, base, err := assoc.packageProvider(pkg)
+	if err != nil || p.API == "" {
+		return ""
+	}
+	if !strings.Contains(p.API, "{base}") && base != p.BaseURL {
+		return ""
+	}
+	repo := pkg.Root
+	if pkg.Repo != "" {
+		repo = pkg.Repo
+	}
+	if isRepoURL(repo) || (pkg.VCS != "" && pkg.VCS != p.VCS) {
+		return ""
+	}
+	return p.expand(p.API, base, assoc.packageOwner(pkg), repo, "")
+}
+
+// setRepo fills in the VCS, repository and go-source fields of meta for a
+// repository of owner.
+func (p *Provider) setRepo(meta *importmeta.ImportMeta, base, owner, repo, subdir string) {
+	meta.VCS = p.VCS
+	meta.Repo = p.expand(p.Repo, base, owner, repo, "")
+	meta.Home = p.expand(p.Home, base, owner, repo, "")
+	meta.Dir = p.expand(p.Dir, base, owner, repo, subdir)
+	meta.File = p.expand(p.File, base, owner, repo, subdir)
+}
+
+// validateProvider returns a *ValidationError if the provider settings of
+// assoc are invalid.
+func validateProvider(assoc *DomainAssoc) error {
+	return checkProvider(providerName(assoc.Provider), assoc.ProviderURL, assoc.GitHubLogin, "githubLogin")
+}
+
+// validatePackageProvider returns a *ValidationError if the provider settings
+// which apply to pkg are invalid.
+func validatePackageProvider(assoc *DomainAssoc, pkg *Package) error {
+	name, base := assoc.packageProviderName(pkg)
+	return checkProvider(name, base, assoc.packageOwner(pkg), "owner")
+}
+
+// checkProvider returns a *ValidationError if the named provider is unknown,
+// if providerURL is invalid or if owner is not a valid owner on the provider.
+func checkProvider(name, providerURL, owner, ownerField string) error {
+	p := Providers[name]
+	if p == nil {
+		return &ValidationError{"provider", fmt.Sprintf("unknown provider %q (expected one of %s)",
+			name, strings.Join(ProviderNames(), ", "))}
+	}
+	if providerURL != "" {
+		u, err := url.Parse(providerURL)
+		if err != nil || u.Host == "" || u.RawQuery != "" || u.Fragment != "" ||
+			(u.Scheme != "https" && u.Scheme != "http" && u.Scheme != "ssh") {
+			return &ValidationError{"providerURL", fmt.Sprintf("invalid provider url %q", providerURL)}
+		}
+	} else if p.BaseURL == "" {
+		return &ValidationError{"providerURL", fmt.Sprintf("provider %q requires a base url", name)}
+	}
+	if strings.ContainsAny(owner, " \t\n") || strings.HasPrefix(owner, "/") || strings.HasSuffix(owner, "/") ||
+		strings.Contains(owner, "//") || (!p.Nested && strings.Contains(owner, "/")) {
+		return &ValidationError{ownerField, fmt.Sprintf("invalid %s owner %q", name, owner)}
+	}
+	for _, elem := range strings.Split(owner, "/") {
+		if elem == "." || elem == ".." {
+			return &ValidationError{ownerField, fmt.Sprintf("invalid %s owner %q", name, owner)}
+		}
+	}
+	return nil
+}
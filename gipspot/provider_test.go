@@ -0,0 +1,118 @@
+package gipspot
+
+import (
+	"importmeta"
+
+	"testing"
+)
+
+func TestProviders(t *testing.T) {
+	for i, test := range []struct {
+		assoc  DomainAssoc
+		expect importmeta.ImportMeta
+	}{
+		{
+			DomainAssoc{GitHubLogin: "mcfoo", Packages: []Package{{Root: "bar", Subdir: "go"}}},
+			importmeta.ImportMeta{
+				VCS:    "git",
+				Repo:   "https://github.com/mcfoo/bar",
+				Subdir: "go",
+				Home:   "https://github.com/mcfoo/bar",
+				Dir:    "https://github.com/mcfoo/bar/tree/HEAD/go{/dir}",
+				File:   "https://github.com/mcfoo/bar/blob/HEAD/go{/dir}/{file}#L{line}",
+			},
+		},
+		{
+			DomainAssoc{Provider: "gitlab", GitHubLogin: "org/team/sub"},
+			importmeta.ImportMeta{
+				VCS:  "git",
+				Repo: "https://gitlab.com/org/team/sub/bar.git",
+				Home: "https://gitlab.com/org/team/sub/bar",
+				Dir:  "https://gitlab.com/org/team/sub/bar/-/tree/HEAD{/dir}",
+				File: "https://gitlab.com/org/team/sub/bar/-/blob/HEAD{/dir}/{file}#L{line}",
+			},
+		},
+		{
+			DomainAssoc{Provider: "gitlab", ProviderURL: "https://git.foo.io/", GitHubLogin: "mcfoo"},
+			importmeta.ImportMeta{
+				VCS:  "git",
+				Repo: "https://git.foo.io/mcfoo/bar.git",
+				Home: "https://git.foo.io/mcfoo/bar",
+				Dir:  "https://git.foo.io/mcfoo/bar/-/tree/HEAD{/dir}",
+				File: "https://git.foo.io/mcfoo/bar/-/blob/HEAD{/dir}/{file}#L{line}",
+			},
+		},
+		{
+			DomainAssoc{Provider: "bitbucket", GitHubLogin: "mcfoo"},
+			importmeta.ImportMeta{
+				VCS:  "git",
+				Repo: "https://bitbucket.org/mcfoo/bar",
+				Home: "https://bitbucket.org/mcfoo/bar",
+				Dir:  "https://bitbucket.org/mcfoo/bar/src/HEAD{/dir}",
+				File: "https://bitbucket.org/mcfoo/bar/src/HEAD{/dir}/{file}#lines-{line}",
+			},
+		},
+		{
+			DomainAssoc{Provider: "gitea", ProviderURL: "https://codeberg.org", GitHubLogin: "mcfoo"},
+			importmeta.ImportMeta{
+				VCS:  "git",
+				Repo: "https://codeberg.org/mcfoo/bar.git",
+				Home: "https://codeberg.org/mcfoo/bar",
+			},
+		},
+		{
+			DomainAssoc{Provider: "sourcehut", GitHubLogin: "mcfoo"},
+			importmeta.ImportMeta{
+				VCS:  "git",
+				Repo: "https://git.sr.ht/~mcfoo/bar",
+				Home: "https://git.sr.ht/~mcfoo/bar",
+				Dir:  "https://git.sr.ht/~mcfoo/bar/tree/HEAD/item{/dir}",
+				File: "https://git.sr.ht/~mcfoo/bar/tree/HEAD/item{/dir}/{file}#L{line}",
+			},
+		},
+		{
+			DomainAssoc{Provider: "git", ProviderURL: "ssh://git@git.foo.io", GitHubLogin: "src"},
+			importmeta.ImportMeta{
+				VCS:  "git",
+				Repo: "ssh://git@git.foo.io/src/bar.git",
+			},
+		},
+	} {
+		test.assoc.Domain = "foo.io"
+		err := validateDomainAssoc(&test.assoc)
+		if err != nil {
+			t.Errorf("test %d: %v", i, err)
+			continue
+		}
+		metas, err := assocImportMetas(&test.assoc, "foo.io", "/bar/baz")
+		if err != nil {
+			t.Errorf("test %d: %v", i, err)
+			continue
+		}
+		test.expect.Pkg = "foo.io/bar/baz"
+		test.expect.RootPkg = "foo.io/bar"
+		if len(metas) != 1 || metas[0] != test.expect {
+			t.Errorf("test %d: unexpected metadata %v", i, metas)
+		}
+	}
+}
+
+func TestValidateProvider(t *testing.T) {
+	for i, test := range []struct {
+		assoc DomainAssoc
+		field string
+	}{
+		{DomainAssoc{Provider: "darcshub", GitHubLogin: "mcfoo"}, "provider"},
+		{DomainAssoc{Provider: "gitea", GitHubLogin: "mcfoo"}, "providerURL"},
+		{DomainAssoc{Provider: "git", ProviderURL: "git.foo.io", GitHubLogin: "mcfoo"}, "providerURL"},
+		{DomainAssoc{GitHubLogin: "org/team"}, "githubLogin"},
+		{DomainAssoc{Provider: "gitlab", GitHubLogin: "org/../team"}, "githubLogin"},
+		{DomainAssoc{Provider: "gitlab", GitHubLogin: "org/"}, "githubLogin"},
+	} {
+		test.assoc.Domain = "foo.io"
+		err := validateDomainAssoc(&test.assoc)
+		if verr, ok := err.(*ValidationError); !ok || verr.Field != test.field {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+		}
+	}
+}
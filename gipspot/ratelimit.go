@@ -0,0 +1,284 @@
+package gipspot
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate is the rate of a token bucket: Burst requests may be made at once,
+// and PerSecond more every second after that.  A zero Rate is unlimited.
+type Rate struct {
+	PerSecond float64 `json:"perSecond"`
+	Burst     int     `json:"burst"` // the next integer above PerSecond if not positive
+}
+
+func (r Rate) unlimited() bool {
+	return r.PerSecond <= 0
+}
+
+func (r Rate) burst() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+	return math.Max(1, math.Ceil(r.PerSecond))
+}
+
+// RateLimiter throttles requests by the address of the client and by the
+// requested host, each with a token bucket, so a misbehaving client can't
+// run up the cost of serving every other.  Throttled requests get a 429 Too
+// Many Requests with a Retry-After header.  Clients with IPv6 addresses
+// share the bucket of their /64 network.  Buckets are kept in memory, so
+// servers running several instances limit each instance separately.  The
+// zero value limits nothing.
+type RateLimiter struct {
+	PerIP     Rate         // requests of a client address
+	PerHost   Rate         // requests for a host, from any client
+	Allowlist []*net.IPNet // networks of clients which are never throttled (e.g. CI runners)
+
+	// MaxBuckets bounds the buckets tracked per kind.  When it is reached
+	// the least recently used bucket is dropped, so a client or host not
+	// seen for a while starts again with a full bucket.  If zero, 10000.
+	MaxBuckets int
+
+	mut   sync.Mutex
+	ips   buckets
+	hosts buckets
+	now   func() time.Time // time.Now if nil
+	stats RateLimitStats
+}
+
+// RateLimitStats counts the requests seen by a RateLimiter.
+type RateLimitStats struct {
+	Allowed       int64 `json:"allowed"`       // requests served within the limits
+	Allowlisted   int64 `json:"allowlisted"`   // requests of clients in the allowlist
+	ThrottledIP   int64 `json:"throttledIP"`   // requests rejected for their client address
+	ThrottledHost int64 `json:"throttledHost"` // requests rejected for their host
+	Clients       int   `json:"clients"`       // client addresses tracked
+	Hosts         int   `json:"hosts"`         // hosts tracked
+}
+
+// Stats returns the counts of requests seen by l since it was created.
+func (l *RateLimiter) Stats() RateLimitStats {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	stats := l.stats
+	stats.Clients, stats.Hosts = l.ips.lru.Len(), l.hosts.lru.Len()
+	return stats
+}
+
+// bucket is a token bucket holding tokens at time last.
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since b was last used to b.
+func (b *bucket) refill(r Rate, now time.Time) {
+	b.tokens = math.Min(r.burst(), b.tokens+now.Sub(b.last).Seconds()*r.PerSecond)
+	b.last = now
+}
+
+// wait returns the time until b holds a token.
+func (b *bucket) wait(r Rate) time.Duration {
+	return time.Duration((1 - b.tokens) / r.PerSecond * float64(time.Second))
+}
+
+// buckets holds the token buckets of one kind by key, in the order they
+// were used.
+type buckets struct {
+	m   map[string]*list.Element
+	lru list.List // of *bucket, most recently used first
+}
+
+// get returns the bucket for key, creating a full one if there is none.
+// Least recently used buckets are dropped so there are at most max.
+func (bs *buckets) get(key string, r Rate, now time.Time, max int) *bucket {
+	if e, ok := bs.m[key]; ok {
+		bs.lru.MoveToFront(e)
+		return e.Value.(*bucket)
+	}
+	if bs.m == nil {
+		bs.m = make(map[string]*list.Element)
+	}
+	for bs.lru.Len() > 0 && bs.lru.Len() >= max {
+		e := bs.lru.Back()
+		bs.lru.Remove(e)
+		delete(bs.m, e.Value.(*bucket).key)
+	}
+	b := &bucket{key: key, tokens: r.burst(), last: now}
+	bs.m[key] = bs.lru.PushFront(b)
+	return b
+}
+
+// clientKey returns the key of the bucket of a client with address ip.
+// IPv6 clients are told apart by their /64 network, as anyone given one
+// holds every address in it.
+func clientKey(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// Allow takes a token for a request of a client with address ip for host
+// from the bucket of each.  No token is taken unless both have one.  If the
+// request is throttled, the time after which it may be retried is returned
+// with false.  A nil ip is only limited by host, and an empty host only by
+// ip.
+func (l *RateLimiter) Allow(ip net.IP, host string) (bool, time.Duration) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if ip != nil && inNetworks(ip, l.Allowlist) {
+		l.stats.Allowlisted++
+		return true, 0
+	}
+	now := l.time()
+	var ipBucket, hostBucket *bucket
+	if ip != nil && !l.PerIP.unlimited() {
+		ipBucket = l.ips.get(clientKey(ip), l.PerIP, now, l.maxBuckets())
+		ipBucket.refill(l.PerIP, now)
+		if ipBucket.tokens < 1 {
+			l.stats.ThrottledIP++
+			return false, ipBucket.wait(l.PerIP)
+		}
+	}
+	if host != "" && !l.PerHost.unlimited() {
+		hostBucket = l.hosts.get(host, l.PerHost, now, l.maxBuckets())
+		hostBucket.refill(l.PerHost, now)
+		if hostBucket.tokens < 1 {
+			l.stats.ThrottledHost++
+			return false, hostBucket.wait(l.PerHost)
+		}
+	}
+	if ipBucket != nil {
+		ipBucket.tokens--
+	}
+	if hostBucket != nil {
+		hostBucket.tokens--
+	}
+	l.stats.Allowed++
+	return true, 0
+}
+
+// waitIP returns the time until a client with address ip may make a request
+// if it is throttled now, and false otherwise.  No token is taken.
+func (l *RateLimiter) waitIP(ip net.IP) (time.Duration, bool) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if ip == nil || l.PerIP.unlimited() || inNetworks(ip, l.Allowlist) {
+		return 0, false
+	}
+	e, ok := l.ips.m[clientKey(ip)]
+	if !ok {
+		return 0, false
+	}
+	b := e.Value.(*bucket)
+	b.refill(l.PerIP, l.time())
+	if b.tokens >= 1 {
+		return 0, false
+	}
+	l.stats.ThrottledIP++
+	return b.wait(l.PerIP), true
+}
+
+func (l *RateLimiter) time() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+func (l *RateLimiter) maxBuckets() int {
+	if l.MaxBuckets <= 0 {
+		return 10000
+	}
+	return l.MaxBuckets
+}
+
+// configure sets the limits of l given by the variables read with getenv,
+// the environment variables of the flags of gopherpath serve:
+// GOPHERPATH_IP_RATE, GOPHERPATH_IP_BURST, GOPHERPATH_HOST_RATE,
+// GOPHERPATH_HOST_BURST and GOPHERPATH_RATE_ALLOWLIST.  Limits whose
+// variables are empty are left alone.
+func (l *RateLimiter) configure(getenv func(string) string) error {
+	for _, v := range []struct {
+		name string
+		rate *float64
+		n    *int
+	}{
+		{"GOPHERPATH_IP_RATE", &l.PerIP.PerSecond, nil},
+		{"GOPHERPATH_IP_BURST", nil, &l.PerIP.Burst},
+		{"GOPHERPATH_HOST_RATE", &l.PerHost.PerSecond, nil},
+		{"GOPHERPATH_HOST_BURST", nil, &l.PerHost.Burst},
+	} {
+		value := getenv(v.name)
+		if value == "" {
+			continue
+		}
+		var err error
+		if v.rate != nil {
+			*v.rate, err = strconv.ParseFloat(value, 64)
+		} else {
+			*v.n, err = strconv.Atoi(value)
+		}
+		if err != nil {
+			return fmt.Errorf("$%s: %v", v.name, err)
+		}
+	}
+	if value := getenv("GOPHERPATH_RATE_ALLOWLIST"); value != "" {
+		nets, err := ParseNetworks(value)
+		if err != nil {
+			return fmt.Errorf("$GOPHERPATH_RATE_ALLOWLIST: %v", err)
+		}
+		l.Allowlist = nets
+	}
+	return nil
+}
+
+// throttle returns true after writing a 429 response if the rate limit of s
+// rejects req.  Requests are only limited by host if it has an association,
+// which is looked up once the client is known to be within its own limit,
+// so requests for made up hosts can't crowd out the buckets of real ones.
+func (s *Server) throttle(c Context, resp http.ResponseWriter, req *http.Request) bool {
+	if s.RateLimit == nil {
+		return false
+	}
+	ip := s.clientIP(req)
+	wait, throttled := s.RateLimit.waitIP(ip)
+	if !throttled {
+		var ok bool
+		ok, wait = s.RateLimit.Allow(ip, s.limitedHost(c, req))
+		throttled = !ok
+	}
+	if !throttled {
+		return false
+	}
+	retry := int(math.Ceil(wait.Seconds()))
+	if retry < 1 {
+		retry = 1
+	}
+	c.Infof("throttled request from %v for %v", ip, req.Host)
+	resp.Header().Set("Retry-After", strconv.Itoa(retry))
+	http.Error(resp, fmt.Sprintf("too many requests; retry in %d seconds", retry), http.StatusTooManyRequests)
+	return true
+}
+
+// limitedHost returns the host of req if requests for it are limited, or
+// the empty string.
+func (s *Server) limitedHost(c Context, req *http.Request) string {
+	if s.RateLimit.PerHost.unlimited() {
+		return ""
+	}
+	_, err := lookupDomainAssoc(c, s.Store, req.Host, req.URL.Path)
+	if _, conflict := err.(*ConflictError); err != nil && !conflict {
+		return ""
+	}
+	return req.Host
+}
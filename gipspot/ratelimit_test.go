@@ -0,0 +1,205 @@
+package gipspot
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := &RateLimiter{
+		PerIP:   Rate{PerSecond: 1, Burst: 2},
+		PerHost: Rate{PerSecond: 1, Burst: 3},
+		now:     func() time.Time { return now },
+	}
+	l.Allowlist, _ = ParseNetworks("10.0.0.0/8")
+	alice, bob, carol, ci := net.ParseIP("1.2.3.4"), net.ParseIP("5.6.7.8"), net.ParseIP("9.8.7.6"), net.ParseIP("10.1.2.3")
+
+	for i, test := range []struct {
+		ip    net.IP
+		host  string
+		ok    bool
+		wait  time.Duration
+		after time.Duration // time passed after the request
+	}{
+		{alice, "foo.io", true, 0, 0},
+		{alice, "foo.io", true, 0, 0},
+		{alice, "foo.io", false, time.Second, 500 * time.Millisecond},
+		{alice, "foo.io", false, 500 * time.Millisecond, 500 * time.Millisecond},
+		{alice, "foo.io", true, 0, 0},
+		{bob, "foo.io", true, 0, 0},
+		{carol, "foo.io", false, time.Second, 0},
+		{bob, "bar.io", true, 0, 0},
+		{ci, "foo.io", true, 0, 0},
+		{ci, "foo.io", true, 0, 0},
+		{nil, "bar.io", true, 0, 0},
+	} {
+		ok, wait := l.Allow(test.ip, test.host)
+		if ok != test.ok || wait != test.wait {
+			t.Errorf("test %d: unexpected result %v %v", i, ok, wait)
+		}
+		now = now.Add(test.after)
+	}
+	stats := l.Stats()
+	if stats.Allowed != 6 || stats.Allowlisted != 2 || stats.ThrottledIP != 2 || stats.ThrottledHost != 1 ||
+		stats.Clients != 3 || stats.Hosts != 2 {
+		t.Errorf("unexpected stats: %#v", stats)
+	}
+
+	// the least recently used buckets are dropped: alice's and carol's.
+	l.MaxBuckets = 2
+	l.Allow(net.ParseIP("9.9.9.9"), "foo.io")
+	if stats := l.Stats(); stats.Clients != 2 || l.ips.m["5.6.7.8"] == nil || l.ips.m["1.2.3.4"] != nil {
+		t.Errorf("unexpected buckets: %#v", stats)
+	}
+	l.MaxBuckets = 1
+	for i := 0; i < 100; i++ {
+		l.Allow(net.IPv4(11, 0, 0, byte(i)), "qux.io")
+	}
+	if stats := l.Stats(); stats.Clients != 1 || stats.Hosts != 1 {
+		t.Errorf("bucket limit exceeded: %#v", stats)
+	}
+}
+
+func TestRateLimiterTakesBoth(t *testing.T) {
+	l := &RateLimiter{
+		PerIP:   Rate{PerSecond: 1, Burst: 1},
+		PerHost: Rate{PerSecond: 1, Burst: 1},
+		now:     func() time.Time { return time.Unix(0, 0) },
+	}
+	alice, bob := net.ParseIP("1.2.3.4"), net.ParseIP("5.6.7.8")
+	if ok, _ := l.Allow(alice, "foo.io"); !ok {
+		t.Fatalf("first request throttled")
+	}
+	if ok, _ := l.Allow(bob, "foo.io"); ok {
+		t.Errorf("host limit not enforced")
+	}
+	// the request throttled for its host cost bob nothing.
+	if ok, _ := l.Allow(bob, "bar.io"); !ok {
+		t.Errorf("client charged for a throttled request")
+	}
+}
+
+func TestRateLimiterIPv6(t *testing.T) {
+	l := &RateLimiter{
+		PerIP: Rate{PerSecond: 1, Burst: 1},
+		now:   func() time.Time { return time.Unix(0, 0) },
+	}
+	if ok, _ := l.Allow(net.ParseIP("2001:db8::1"), "foo.io"); !ok {
+		t.Fatalf("first request throttled")
+	}
+	// another address of the same /64 is the same client.
+	if ok, _ := l.Allow(net.ParseIP("2001:db8::ffff:1234"), "foo.io"); ok {
+		t.Errorf("client not limited by network")
+	}
+	if ok, _ := l.Allow(net.ParseIP("2001:db8:0:1::1"), "foo.io"); !ok {
+		t.Errorf("other network throttled")
+	}
+	if stats := l.Stats(); stats.Clients != 2 {
+		t.Errorf("unexpected stats: %#v", stats)
+	}
+}
+
+func TestRateLimiterConfigure(t *testing.T) {
+	l := &RateLimiter{PerIP: Rate{PerSecond: 10, Burst: 100}, PerHost: Rate{PerSecond: 100, Burst: 1000}}
+	env := map[string]string{
+		"GOPHERPATH_IP_RATE":        "0.5",
+		"GOPHERPATH_HOST_BURST":     "20",
+		"GOPHERPATH_RATE_ALLOWLIST": "10.0.0.0/8,192.168.1.1/32",
+	}
+	err := l.configure(func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.PerIP != (Rate{0.5, 100}) || l.PerHost != (Rate{100, 20}) || len(l.Allowlist) != 2 {
+		t.Errorf("unexpected limits: %v %v %v", l.PerIP, l.PerHost, l.Allowlist)
+	}
+	env["GOPHERPATH_IP_BURST"] = "many"
+	if err := l.configure(func(name string) string { return env[name] }); err == nil {
+		t.Errorf("invalid burst accepted")
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	s := testServer(verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo"}))
+	s.Authenticate = BearerTokens(map[string]string{"s3cret": "admin"})
+	s.TrustedProxies, _ = ParseNetworks("10.0.0.0/8")
+	s.RateLimit = &RateLimiter{PerIP: Rate{PerSecond: 0.1, Burst: 1}}
+
+	get := func(remote, fwd string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://foo.io/bar?go-get=1", nil)
+		req.RemoteAddr = remote
+		if fwd != "" {
+			req.Header.Set("X-Forwarded-For", fwd)
+		}
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		return resp
+	}
+	if resp := get("1.2.3.4:1234", ""); resp.Code != http.StatusOK {
+		t.Fatalf("unexpected response: %d %q", resp.Code, resp.Body.String())
+	}
+	resp := get("1.2.3.4:1234", "")
+	if resp.Code != http.StatusTooManyRequests || resp.Header().Get("Retry-After") != "10" {
+		t.Errorf("request not throttled: %d %q", resp.Code, resp.Header().Get("Retry-After"))
+	}
+	// clients behind trusted proxies are told apart.
+	if resp := get("10.0.0.1:1234", "5.6.7.8, 10.0.0.2"); resp.Code != http.StatusOK {
+		t.Errorf("unexpected response: %d", resp.Code)
+	}
+	if resp := get("10.0.0.1:1234", "1.2.3.4"); resp.Code != http.StatusTooManyRequests {
+		t.Errorf("forwarded request not throttled: %d", resp.Code)
+	}
+	// a client can't pick its address through an untrusted header.
+	if resp := get("1.2.3.4:1234", "9.9.9.9"); resp.Code != http.StatusTooManyRequests {
+		t.Errorf("spoofed request not throttled: %d", resp.Code)
+	}
+	// nor can it turn to the other public pages.
+	for _, p := range []string{"/sitemap.xml", "/robots.txt", VerifyHandlerPath, SetupPath} {
+		req, _ := http.NewRequest("POST", "http://foo.io"+p, nil)
+		req.RemoteAddr = "1.2.3.4:1234"
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		if resp.Code != http.StatusTooManyRequests {
+			t.Errorf("%s: request not throttled: %d", p, resp.Code)
+		}
+	}
+
+	resp = apiRequest(s, "GET", "/metrics", "")
+	var m struct{ RateLimit RateLimitStats }
+	decodeAPI(t, resp, &m)
+	if m.RateLimit.Allowed != 2 || m.RateLimit.ThrottledIP != 7 {
+		t.Errorf("unexpected metrics: %q", resp.Body.String())
+	}
+}
+
+func TestThrottleUnknownHosts(t *testing.T) {
+	s := testServer(verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo"}))
+	s.RateLimit = &RateLimiter{PerHost: Rate{PerSecond: 1, Burst: 1}, MaxBuckets: 10}
+	get := func(host string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://"+host+"/bar?go-get=1", nil)
+		req.RemoteAddr = "1.2.3.4:1234"
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		return resp
+	}
+	if resp := get("foo.io"); resp.Code != http.StatusOK {
+		t.Fatalf("unexpected response: %d", resp.Code)
+	}
+	// made up hosts get no bucket, so they can't evict the bucket of foo.io.
+	for i := 0; i < 100; i++ {
+		if resp := get(fmt.Sprintf("h%d.io", i)); resp.Code != http.StatusNotFound {
+			t.Fatalf("unexpected response for unknown host: %d", resp.Code)
+		}
+	}
+	if stats := s.RateLimit.Stats(); stats.Hosts != 1 {
+		t.Errorf("buckets kept for unknown hosts: %#v", stats)
+	}
+	if resp := get("foo.io"); resp.Code != http.StatusTooManyRequests {
+		t.Errorf("host limit lost: %d", resp.Code)
+	}
+}
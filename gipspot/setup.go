@@ -0,0 +1,231 @@
+package gipspot
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SetupPath is the path of the first-run setup pages.  Setup claims a domain,
+// walks through its verification and then disables itself.  It is only
+// served while the Server has a SetupToken and its store has no verified
+// association, and every step requires the token.
+const SetupPath = "/_gopherpath/setup"
+
+var setupTemplates = template.Must(consoleTemplates.New("setup").Parse(`
+{{define "setup"}}{{template "header" .}}
+		<h1>set up gopherpath</h1>
+		<p>enter the setup token printed when the server started and the domain to serve.</p>
+		<form method="POST" action="{{.SetupPath}}">
+			<p><label>setup token <input type="password" name="token" value="{{.SetupToken}}"></label></p>
+			<p><label>domain <input type="text" name="domain" value="{{.Assoc.Domain}}"></label></p>
+			<p><label>path prefix (optional) <input type="text" name="prefix" value="{{.Assoc.Prefix}}"></label></p>
+			{{template "provider" .Assoc}}
+			<p><input type="submit" value="continue"></p>
+		</form>
+{{template "footer" .}}{{end}}
+
+{{define "setupVerify"}}{{template "header" .}}
+		{{$assoc := .Assoc}}
+		<h1>verify {{.VerifyDomain}}</h1>
+		<p>publish the DNS TXT record</p>
+		<pre>{{.TXTName}}. TXT "{{.TXTValue}}"</pre>
+		<p>or serve the following content at http://{{.VerifyDomain}}{{.VerifyPath}}</p>
+		<pre>{{$assoc.VerifyToken}}</pre>
+		<form method="POST" action="{{.SetupPath}}/verify">
+			<input type="hidden" name="token" value="{{.SetupToken}}">
+			<input type="hidden" name="key" value="{{$assoc.Key}}">
+			<p><input type="submit" value="check verification"></p>
+		</form>
+{{template "footer" .}}{{end}}
+
+{{define "setupDone"}}{{template "header" .}}
+		<h1>setup complete</h1>
+		<p>{{.Assoc.Path}} is verified and directs clients to {{.Assoc.OwnerURL}}.
+		setup is now disabled.  manage associations in the <a href="{{console}}">console</a>
+		or through the admin api.</p>
+{{template "footer" .}}{{end}}
+`))
+
+// NeedsSetup returns true if store has no verified association, in which
+// case a Server with a SetupToken serves the setup pages.
+func NeedsSetup(c Context, store AssocStore) (bool, error) {
+	assocs, err := store.ListDomainAssocs(c)
+	if err != nil {
+		return false, err
+	}
+	for i := range assocs {
+		if assocs[i].IsVerified() {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// setupCheckInterval is how long the answer of NeedsSetup is reused while
+// setup is needed.  Once it isn't setup stays disabled.
+const setupCheckInterval = time.Minute
+
+// setupActive returns true if the setup pages are served.  The store is read
+// at most once every setupCheckInterval, as every request for an unknown host
+// asks.
+func (s *Server) setupActive(c Context) bool {
+	if s.SetupToken == "" {
+		return false
+	}
+	s.setupMut.Lock()
+	defer s.setupMut.Unlock()
+	if s.setupDone {
+		return false
+	}
+	now := time.Now()
+	if now.Sub(s.setupChecked) < setupCheckInterval {
+		return true
+	}
+	needed, err := NeedsSetup(c, s.Store)
+	if err != nil {
+		c.Errorf("setup: %v", err)
+		return false
+	}
+	if !needed {
+		s.setupDone = true
+		return false
+	}
+	s.setupChecked = now
+	return true
+}
+
+// HandleSetup serves the setup pages beneath SetupPath.
+func (s *Server) HandleSetup(resp http.ResponseWriter, req *http.Request) {
+	c := s.NewContext(req)
+	if !s.setupActive(c) {
+		http.Error(resp, "setup is disabled", http.StatusNotFound)
+		return
+	}
+	page := &consolePage{SetupPath: SetupPath, Assoc: &DomainAssoc{Domain: req.Host}}
+	switch {
+	case req.URL.Path == SetupPath && req.Method == "GET":
+		s.renderConsole(resp, http.StatusOK, "setup", page)
+	case req.URL.Path == SetupPath && req.Method == "POST":
+		s.setupClaim(c, page, resp, req)
+	case req.URL.Path == SetupPath+"/verify" && req.Method == "POST":
+		s.setupVerify(c, page, resp, req)
+	default:
+		http.NotFound(resp, req)
+	}
+}
+
+// setupAuth returns true if req carries the setup token.  Otherwise the
+// setup form is rendered with an error.
+func (s *Server) setupAuth(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request) bool {
+	token := req.PostFormValue("token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.SetupToken)) == 1 {
+		page.SetupToken = token
+		return true
+	}
+	c.Warningf("setup request from %v with a bad setup token", req.RemoteAddr)
+	page.Error = "invalid setup token"
+	s.renderConsole(resp, http.StatusForbidden, "setup", page)
+	return false
+}
+
+// setupClaim creates the association being set up, or updates it if an
+// earlier attempt created it, and shows how to verify it.
+func (s *Server) setupClaim(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request) {
+	page.Assoc.Domain = canonicalDomain(req.PostFormValue("domain"))
+	page.Assoc.Prefix = strings.Trim(strings.TrimSpace(req.PostFormValue("prefix")), "/")
+	setProviderForm(page.Assoc, req)
+	if !s.setupAuth(c, page, resp, req) {
+		return
+	}
+	assoc := page.Assoc
+	assocs, err := s.Store.GetDomainAssocs(c, assoc.Domain)
+	if err != nil {
+		s.setupError(c, page, resp, "setup", err)
+		return
+	}
+	for i := range assocs {
+		if assocs[i].Prefix == assoc.Prefix {
+			// an unverified association left by an earlier attempt.
+			existing := assocs[i]
+			existing.Provider, existing.ProviderURL = assoc.Provider, assoc.ProviderURL
+			existing.GitHubLogin = assoc.GitHubLogin
+			assoc = &existing
+		}
+	}
+	if assoc.VerifyToken == "" {
+		assoc.VerifyToken, err = NewVerifyToken()
+	}
+	if err == nil {
+		err = s.storeFor(SetupActor).PutDomainAssoc(c, assoc)
+	}
+	if err != nil {
+		s.setupError(c, page, resp, "setup", err)
+		return
+	}
+	c.Infof("setup claimed %v as association %v", assoc.Path(), assoc.Key)
+	s.renderSetupVerify(resp, http.StatusOK, page, assoc)
+}
+
+// setupVerify verifies the association being set up.  Once it is verified
+// setup is disabled.
+func (s *Server) setupVerify(c Context, page *consolePage, resp http.ResponseWriter, req *http.Request) {
+	if !s.setupAuth(c, page, resp, req) {
+		return
+	}
+	assoc, err := s.Store.GetDomainAssoc(c, req.PostFormValue("key"))
+	if err == nil {
+		err = s.verifier().Verify(c, assoc)
+	}
+	if err == ErrNotVerified {
+		page.Error = fmt.Sprintf("%v. publish the token and try again", err)
+		s.renderSetupVerify(resp, http.StatusUnprocessableEntity, page, assoc)
+		return
+	}
+	if err == nil {
+		err = s.storeFor(SetupActor).PutDomainAssoc(c, assoc)
+	}
+	if err != nil {
+		s.setupError(c, page, resp, "setup", err)
+		return
+	}
+	s.setupMut.Lock()
+	s.setupDone = true
+	s.setupMut.Unlock()
+	c.Infof("setup verified %v; setup is disabled", assoc.Path())
+	page.Assoc = assoc
+	s.renderConsole(resp, http.StatusOK, "setupDone", page)
+}
+
+func (s *Server) renderSetupVerify(resp http.ResponseWriter, code int, page *consolePage, assoc *DomainAssoc) {
+	page.Assoc = assoc
+	page.VerifyDomain = assoc.verifyDomain()
+	page.TXTName = VerifyTXTPrefix + page.VerifyDomain
+	page.TXTValue = VerifyTXTValue(assoc.VerifyToken)
+	page.VerifyPath = VerifyPath
+	s.renderConsole(resp, code, "setupVerify", page)
+}
+
+// setupError renders the named setup page with err.
+func (s *Server) setupError(c Context, page *consolePage, resp http.ResponseWriter, name string, err error) {
+	code := http.StatusUnprocessableEntity
+	switch err.(type) {
+	case *ValidationError:
+	default:
+		switch err {
+		case ErrDomainTaken:
+			code = http.StatusConflict
+		case ErrNoSuchAssoc:
+			code = http.StatusNotFound
+		default:
+			c.Errorf("setup: %v", err)
+			http.Error(resp, "an error occurred", http.StatusInternalServerError)
+			return
+		}
+	}
+	page.Error = err.Error()
+	s.renderConsole(resp, code, name, page)
+}
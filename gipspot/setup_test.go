@@ -0,0 +1,116 @@
+package gipspot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetup(t *testing.T) {
+	s := testServer()
+	s.Verifier = &Verifier{Resolver: fakeDNS{}, Client: func(Context) *http.Client { return &http.Client{Transport: failTransport{}} }}
+	do := func(method, path string, form url.Values) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://foo.io"+path, strings.NewReader(form.Encode()))
+		if form != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		return resp
+	}
+
+	if resp := do("GET", SetupPath, nil); resp.Code != http.StatusNotFound {
+		t.Errorf("setup served without a token: %d", resp.Code)
+	}
+	s.SetupToken = "s3cret"
+	if resp := do("GET", "/", nil); resp.Code != http.StatusNotFound || !strings.Contains(resp.Body.String(), SetupPath) {
+		t.Errorf("unknown host doesn't point to setup: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp := do("GET", SetupPath, nil); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), `value="foo.io"`) {
+		t.Errorf("unexpected setup form: %d %q", resp.Code, resp.Body.String())
+	}
+
+	claim := url.Values{"token": {"guess"}, "domain": {"foo.io"}, "githubLogin": {"mcfoo"}}
+	if resp := do("POST", SetupPath, claim); resp.Code != http.StatusForbidden {
+		t.Errorf("claim with a bad token: %d", resp.Code)
+	}
+	if assocs, _ := s.Store.ListDomainAssocs(testContext); len(assocs) != 0 {
+		t.Fatalf("association stored with a bad token: %#v", assocs)
+	}
+	claim.Set("token", "s3cret")
+	resp := do("POST", SetupPath, claim)
+	assocs, _ := s.Store.ListDomainAssocs(testContext)
+	if resp.Code != http.StatusOK || len(assocs) != 1 || !strings.Contains(resp.Body.String(), VerifyTXTValue(assocs[0].VerifyToken)) {
+		t.Fatalf("unexpected claim: %d %q %#v", resp.Code, resp.Body.String(), assocs)
+	}
+	// claiming again updates the same association.
+	claim.Set("githubLogin", "mcbar")
+	if resp := do("POST", SetupPath, claim); resp.Code != http.StatusOK {
+		t.Errorf("second claim: %d %q", resp.Code, resp.Body.String())
+	}
+	assocs, _ = s.Store.ListDomainAssocs(testContext)
+	if len(assocs) != 1 || assocs[0].GitHubLogin != "mcbar" {
+		t.Fatalf("unexpected associations after a second claim: %#v", assocs)
+	}
+
+	verify := url.Values{"token": {"s3cret"}, "key": {assocs[0].Key}}
+	if resp := do("POST", SetupPath+"/verify", verify); resp.Code != http.StatusUnprocessableEntity {
+		t.Errorf("verified without a published token: %d", resp.Code)
+	}
+	s.Verifier.Resolver = fakeDNS{VerifyTXTPrefix + "foo.io": {VerifyTXTValue(assocs[0].VerifyToken)}}
+	if resp := do("POST", SetupPath+"/verify", verify); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "setup complete") {
+		t.Errorf("verify: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp := do("GET", SetupPath, nil); resp.Code != http.StatusNotFound {
+		t.Errorf("setup served after completion: %d", resp.Code)
+	}
+	if resp := do("GET", "/", nil); resp.Code != http.StatusOK {
+		t.Errorf("set up domain not served: %d %q", resp.Code, resp.Body.String())
+	}
+
+	// setup stays disabled for a new server with the same store.
+	s = &Server{NewContext: s.NewContext, Store: s.Store, SetupToken: "0ther"}
+	if resp := do("GET", SetupPath, nil); resp.Code != http.StatusNotFound {
+		t.Errorf("setup served for a store with a verified association: %d", resp.Code)
+	}
+}
+
+// countingStore counts the associations listed from a MemStore.
+type countingStore struct {
+	*MemStore
+	lists int
+}
+
+func (s *countingStore) ListDomainAssocs(c Context) ([]DomainAssoc, error) {
+	s.lists++
+	return s.MemStore.ListDomainAssocs(c)
+}
+
+func TestSetupActiveCached(t *testing.T) {
+	store := &countingStore{MemStore: NewMemStore()}
+	s := testServer()
+	s.Store = store
+	s.SetupToken = "s3cret"
+	for i := 0; i < 10; i++ {
+		if !s.setupActive(testContext) {
+			t.Fatalf("setup inactive")
+		}
+	}
+	if store.lists != 1 {
+		t.Errorf("store listed %d times", store.lists)
+	}
+
+	store.PutDomainAssoc(testContext, &DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo", Verified: time.Now(), VerifiedDomain: "foo.io"})
+	s.setupChecked = s.setupChecked.Add(-setupCheckInterval)
+	for i := 0; i < 10; i++ {
+		if s.setupActive(testContext) {
+			t.Fatalf("setup active with a verified association")
+		}
+	}
+	if store.lists != 2 {
+		t.Errorf("store listed %d times", store.lists)
+	}
+}
@@ -0,0 +1,148 @@
+package gipspot
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// sitemapURLSet is the root element of a sitemap.xml document.
+// See http://www.sitemaps.org/protocol.html
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// Sitemap returns the sitemap for the landing pages of the domain index and
+// the packages registered with assoc, except those hidden, private or
+// disabled.  No package of an association requiring a token is listed.  URLs
+// are formed with the given scheme.  The sitemap of an association with a
+// path prefix is served beneath the prefix.
+func Sitemap(scheme string, assoc *DomainAssoc) *sitemapURLSet {
+	base := scheme + "://" + assoc.Path()
+	urlset := new(sitemapURLSet)
+	urlset.URLs = append(urlset.URLs, sitemapURL{
+		Loc:     base + "/",
+		LastMod: sitemapDate(assoc.Modified),
+	})
+	if assoc.RequireToken {
+		return urlset
+	}
+	for _, pkg := range assoc.Packages {
+		if pkg.Hidden || pkg.Private || pkg.Disabled {
+			continue
+		}
+		lastmod := pkg.Modified
+		if lastmod.IsZero() {
+			lastmod = assoc.Modified
+		}
+		urlset.URLs = append(urlset.URLs, sitemapURL{
+			Loc:     base + path.Join("/", pkg.Root),
+			LastMod: sitemapDate(lastmod),
+		})
+	}
+	return urlset
+}
+
+func sitemapDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02")
+}
+
+// DefaultRobots is the robots.txt served for domains without a custom Robots
+// value.  Landing pages may be crawled but go-get queries may not.  It is
+// formatted with the sitemap URL of the domain.
+const DefaultRobots = `User-agent: *
+Disallow: /*?go-get=
+Disallow: /*&go-get=
+Allow: /
+
+Sitemap: %s
+`
+
+// Robots returns the content of robots.txt for assoc.  robots.txt is only
+// served for associations without a path prefix.
+func Robots(scheme string, assoc *DomainAssoc) string {
+	if assoc.Robots != "" {
+		return assoc.Robots
+	}
+	return fmt.Sprintf(DefaultRobots, scheme+"://"+assoc.Domain+"/sitemap.xml")
+}
+
+func requestScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func (s *Server) HandleSitemap(resp http.ResponseWriter, req *http.Request) {
+	c := s.NewContext(req)
+	assoc, ok := s.requestDomainAssoc(c, resp, req)
+	if !ok {
+		return
+	}
+	p, err := xml.MarshalIndent(Sitemap(requestScheme(req), assoc), "", "\t")
+	if err != nil {
+		c.Errorf("unable to render sitemap: %v", err)
+		http.Error(resp, "an error occurred", http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	resp.Write([]byte(xml.Header))
+	resp.Write(p)
+}
+
+func (s *Server) HandleRobots(resp http.ResponseWriter, req *http.Request) {
+	c := s.NewContext(req)
+	assoc, ok := s.requestDomainAssoc(c, resp, req)
+	if !ok {
+		return
+	}
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	robots := Robots(requestScheme(req), assoc)
+	if !strings.HasSuffix(robots, "\n") {
+		robots += "\n"
+	}
+	fmt.Fprint(resp, robots)
+}
+
+// requestDomainAssoc looks up the association for the host of req whose
+// prefix is the directory of the request path.  If there is no usable
+// association an error response is written and ok is false.
+func (s *Server) requestDomainAssoc(c Context, resp http.ResponseWriter, req *http.Request) (assoc *DomainAssoc, ok bool) {
+	host := req.Host
+	dir := path.Dir(req.URL.Path)
+	assoc, err := lookupDomainAssoc(c, s.Store, host, dir)
+	if err == nil && assoc.Prefix != strings.Trim(dir, "/") {
+		err = ErrNoSuchAssoc
+	}
+	if err == nil {
+		assoc, err = s.serving(c, assoc, host)
+	}
+	if err == ErrNoSuchAssoc || (err == nil && !assoc.IsActive()) {
+		c.Warningf("request for unknown host: %v", host)
+		http.NotFound(resp, req)
+		return nil, false
+	}
+	if cerr, ok := err.(*ConflictError); ok {
+		writeConflict(resp, cerr)
+		return nil, false
+	}
+	if err != nil {
+		c.Errorf("unable to lookup hostname: %v", err)
+		http.Error(resp, "an error occurred", http.StatusInternalServerError)
+		return nil, false
+	}
+	return assoc, true
+}
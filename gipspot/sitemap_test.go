@@ -0,0 +1,101 @@
+package gipspot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSitemapRobots(t *testing.T) {
+	s := testServer(verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo", Packages: []Package{
+		{Root: "bar"},
+		{Root: "secret", Hidden: true},
+		{Root: "old", Disabled: true},
+	}}))
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://foo.io/sitemap.xml", nil)
+	s.ServeHTTP(resp, req)
+	for _, loc := range []string{"<loc>http://foo.io/</loc>", "<loc>http://foo.io/bar</loc>"} {
+		if !strings.Contains(resp.Body.String(), loc) {
+			t.Errorf("sitemap missing %s: %q", loc, resp.Body.String())
+		}
+	}
+	for _, loc := range []string{"<loc>http://foo.io/secret</loc>", "<loc>http://foo.io/old</loc>"} {
+		if strings.Contains(resp.Body.String(), loc) {
+			t.Errorf("sitemap contains %s: %q", loc, resp.Body.String())
+		}
+	}
+
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://foo.io/robots.txt", nil)
+	s.ServeHTTP(resp, req)
+	for _, line := range []string{"Disallow: /*?go-get=", "Sitemap: http://foo.io/sitemap.xml"} {
+		if !strings.Contains(resp.Body.String(), line) {
+			t.Errorf("robots.txt missing %q: %q", line, resp.Body.String())
+		}
+	}
+}
+
+func TestSitemap(t *testing.T) {
+	modified := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	assoc := &DomainAssoc{Domain: "foo.io", Prefix: "go", Modified: modified, Packages: []Package{
+		{Root: "bar", Modified: time.Date(2015, 4, 2, 0, 0, 0, 0, time.UTC)},
+		{Root: "baz"},
+		{Root: "hidden", Hidden: true},
+		{Root: "secret", Private: true},
+		{Root: "old", Disabled: true},
+	}}
+	var urls []string
+	for _, u := range Sitemap("https", assoc).URLs {
+		urls = append(urls, u.Loc+" "+u.LastMod)
+	}
+	expect := []string{
+		"https://foo.io/go/ 2015-03-01",
+		"https://foo.io/go/bar 2015-04-02",
+		"https://foo.io/go/baz 2015-03-01",
+	}
+	if strings.Join(urls, ", ") != strings.Join(expect, ", ") {
+		t.Errorf("unexpected sitemap: %q", urls)
+	}
+
+	assoc.RequireToken = true
+	if urls := Sitemap("https", assoc).URLs; len(urls) != 1 || urls[0].Loc != "https://foo.io/go/" {
+		t.Errorf("packages requiring a token listed: %#v", urls)
+	}
+}
+
+func TestSitemapRequireToken(t *testing.T) {
+	s := testServer(verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo", RequireToken: true, Packages: []Package{
+		{Root: "bar"},
+	}}))
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://foo.io/sitemap.xml", nil)
+	s.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK || strings.Contains(resp.Body.String(), "foo.io/bar") {
+		t.Errorf("unexpected sitemap: %d %q", resp.Code, resp.Body.String())
+	}
+}
+
+func TestRobots(t *testing.T) {
+	assoc := &DomainAssoc{Domain: "foo.io"}
+	if robots := Robots("https", assoc); !strings.Contains(robots, "Sitemap: https://foo.io/sitemap.xml\n") {
+		t.Errorf("unexpected default robots.txt: %q", robots)
+	}
+
+	s := testServer(verified(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo", Robots: "User-agent: *\nDisallow: /"}))
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://foo.io/robots.txt", nil)
+	s.ServeHTTP(resp, req)
+	if resp.Body.String() != "User-agent: *\nDisallow: /\n" {
+		t.Errorf("unexpected custom robots.txt: %q", resp.Body.String())
+	}
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://bar.io/robots.txt", nil)
+	s.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("robots.txt served for unknown host: %d", resp.Code)
+	}
+}
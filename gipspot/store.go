@@ -0,0 +1,450 @@
+package gipspot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrNoSuchAssoc is returned by an AssocStore when a key does not identify a
+// stored association.
+var ErrNoSuchAssoc = fmt.Errorf("no such association")
+
+// ErrConflict is returned by an AssocStore when an association being updated
+// was changed since it was read.
+var ErrConflict = fmt.Errorf("association was modified concurrently")
+
+// AssocStore is the storage backend for DomainAssoc values.  Implementations
+// set the Key, Modified, Revision and Schema fields of associations they
+// store, and upgrade associations stored with an older schema as they are
+// read (see Migrate).
+type AssocStore interface {
+	// GetDomainAssoc returns the association identified by key.
+	GetDomainAssoc(c Context, key string) (*DomainAssoc, error)
+
+	// GetDomainAssocs returns the associations for domain.
+	GetDomainAssocs(c Context, domain string) ([]DomainAssoc, error)
+
+	// GetDomainAssocsGitHubLogin returns the associations for a GitHub login.
+	GetDomainAssocsGitHubLogin(c Context, login string) ([]DomainAssoc, error)
+
+	// GetDomainAssocsAliasOf returns the aliases of the association whose
+	// import path is p.
+	GetDomainAssocsAliasOf(c Context, p string) ([]DomainAssoc, error)
+
+	// ListDomainAssocs returns every stored association.
+	ListDomainAssocs(c Context) ([]DomainAssoc, error)
+
+	// PutDomainAssoc creates assoc if its Key is empty or unknown and
+	// updates the association identified by its Key otherwise.  An update
+	// fails with ErrConflict unless assoc.Revision equals the revision
+	// stored, so changes made between reading and writing an association
+	// are never lost.  Creating an association, or changing its domain or
+	// prefix, fails with ErrDomainTaken if another association has the
+	// same domain and prefix.
+	PutDomainAssoc(c Context, assoc *DomainAssoc) error
+
+	// DeleteDomainAssoc removes the association identified by key.
+	DeleteDomainAssoc(c Context, key string) error
+}
+
+// MemStore is an AssocStore holding associations in memory.  The zero value
+// is an empty store ready to use.
+type MemStore struct {
+	mut     sync.Mutex
+	assocs  map[string]DomainAssoc
+	nextKey int64
+}
+
+// NewMemStore returns a MemStore containing copies of assocs.
+func NewMemStore(assocs ...DomainAssoc) *MemStore {
+	s := new(MemStore)
+	for i := range assocs {
+		assoc := assocs[i]
+		err := s.PutDomainAssoc(nil, &assoc)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return s
+}
+
+func (s *MemStore) GetDomainAssoc(c Context, key string) (*DomainAssoc, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	assoc, ok := s.assocs[key]
+	if !ok {
+		return nil, ErrNoSuchAssoc
+	}
+	assoc = copyDomainAssoc(assoc)
+	return &assoc, nil
+}
+
+func (s *MemStore) GetDomainAssocs(c Context, domain string) ([]DomainAssoc, error) {
+	return s.filter(func(assoc *DomainAssoc) bool { return assoc.Domain == domain }), nil
+}
+
+func (s *MemStore) GetDomainAssocsGitHubLogin(c Context, login string) ([]DomainAssoc, error) {
+	return s.filter(func(assoc *DomainAssoc) bool { return assoc.GitHubLogin == login }), nil
+}
+
+func (s *MemStore) GetDomainAssocsAliasOf(c Context, p string) ([]DomainAssoc, error) {
+	return s.filter(func(assoc *DomainAssoc) bool { return assoc.AliasOf == p }), nil
+}
+
+func (s *MemStore) ListDomainAssocs(c Context) ([]DomainAssoc, error) {
+	return s.filter(func(assoc *DomainAssoc) bool { return true }), nil
+}
+
+// filter returns copies of the associations matching fn, ordered by key.
+func (s *MemStore) filter(fn func(*DomainAssoc) bool) []DomainAssoc {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	var assocs []DomainAssoc
+	for _, assoc := range s.assocs {
+		if fn(&assoc) {
+			assocs = append(assocs, copyDomainAssoc(assoc))
+		}
+	}
+	sort.Sort(byKey(assocs))
+	return assocs
+}
+
+func (s *MemStore) PutDomainAssoc(c Context, assoc *DomainAssoc) error {
+	err := validateDomainAssoc(assoc)
+	if err != nil {
+		return err
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.put(assoc)
+}
+
+// put stores assoc.  The caller must hold s.mut.
+func (s *MemStore) put(assoc *DomainAssoc) error {
+	if s.assocs == nil {
+		s.assocs = make(map[string]DomainAssoc)
+	}
+	stored, exists := s.assocs[assoc.Key]
+	if exists && stored.Revision != assoc.Revision {
+		return ErrConflict
+	}
+	if !exists || stored.Domain != assoc.Domain || stored.Prefix != assoc.Prefix {
+		for key, other := range s.assocs {
+			if other.Domain == assoc.Domain && other.Prefix == assoc.Prefix && key != assoc.Key {
+				return ErrDomainTaken
+			}
+		}
+	}
+	revision := int64(1)
+	if assoc.Key == "" {
+		s.nextKey++
+		assoc.Key = strconv.FormatInt(s.nextKey, 10)
+	} else if exists {
+		revision = stored.Revision + 1
+	} else if n, err := strconv.ParseInt(assoc.Key, 10, 64); err == nil && n > s.nextKey {
+		s.nextKey = n
+	}
+	assoc.Revision = revision
+	assoc.Modified = time.Now()
+	assoc.Schema = SchemaVersion
+	s.assocs[assoc.Key] = copyDomainAssoc(*assoc)
+	return nil
+}
+
+func (s *MemStore) DeleteDomainAssoc(c Context, key string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if _, ok := s.assocs[key]; !ok {
+		return ErrNoSuchAssoc
+	}
+	delete(s.assocs, key)
+	return nil
+}
+
+// clone returns a deep copy of s.  The caller must hold s.mut.
+func (s *MemStore) clone() *MemStore {
+	c := &MemStore{assocs: make(map[string]DomainAssoc, len(s.assocs)), nextKey: s.nextKey}
+	for k, assoc := range s.assocs {
+		c.assocs[k] = copyDomainAssoc(assoc)
+	}
+	return c
+}
+
+// copyDomainAssoc returns a copy of assoc which shares no memory with it.
+func copyDomainAssoc(assoc DomainAssoc) DomainAssoc {
+	if assoc.Packages != nil {
+		assoc.Packages = append([]Package(nil), assoc.Packages...)
+	}
+	if assoc.Tokens != nil {
+		assoc.Tokens = append([]AccessToken(nil), assoc.Tokens...)
+	}
+	if assoc.Labels != nil {
+		assoc.Labels = append([]string(nil), assoc.Labels...)
+	}
+	return assoc
+}
+
+type byKey []DomainAssoc
+
+func (s byKey) Len() int           { return len(s) }
+func (s byKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byKey) Less(i, j int) bool { return keyLess(s[i].Key, s[j].Key) }
+
+// keyLess orders keys so numeric keys sort by value.
+func keyLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// FileStore is an AssocStore keeping associations in a single JSON file,
+// suitable for small deployments.  Every change rewrites the file through a
+// temporary file which is synced and renamed over the original, so a crash
+// leaves either the old or the new content.
+//
+// Several processes, such as a server and the gopherpath commands, may use
+// the same file.  Changes are made while holding a lock on the directory of
+// the file, after rereading it if another process has replaced it, so no
+// process overwrites the changes of another and an association changed by
+// another process since it was read can't be updated (see ErrConflict).
+// Reads also reread a replaced file.
+type FileStore struct {
+	path string
+	mut  sync.Mutex
+	mem  *MemStore
+	info os.FileInfo // of the file mem was read from or written to; nil if none
+}
+
+// fileStoreContent is the content of a FileStore file.
+type fileStoreContent struct {
+	NextKey int64         `json:"nextKey"`
+	Assocs  []DomainAssoc `json:"assocs"`
+}
+
+// OpenFileStore returns a FileStore for the file at path.  If the file does
+// not exist it is created with the first change to the store.
+func OpenFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path, mem: new(MemStore)}
+	err := s.refresh()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// refresh reads the file of s if it has been replaced since s last read or
+// wrote it.  The caller must hold s.mut unless s is new.
+func (s *FileStore) refresh() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if s.info != nil && os.SameFile(info, s.info) && info.ModTime().Equal(s.info.ModTime()) && info.Size() == s.info.Size() {
+		return nil
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// the file read is the one opened, whatever has replaced it since.
+	info, err = f.Stat()
+	if err != nil {
+		return err
+	}
+	p, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	var content fileStoreContent
+	err = json.Unmarshal(p, &content)
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.path, err)
+	}
+	mem := &MemStore{assocs: make(map[string]DomainAssoc, len(content.Assocs)), nextKey: content.NextKey}
+	for _, assoc := range content.Assocs {
+		if assoc.Key == "" {
+			return fmt.Errorf("%s: association for %q has no key", s.path, assoc.Domain)
+		}
+		upgradeAssoc(&assoc)
+		mem.assocs[assoc.Key] = assoc
+	}
+	s.mem, s.info = mem, info
+	return nil
+}
+
+// Path returns the path of the file backing s.
+func (s *FileStore) Path() string {
+	return s.path
+}
+
+// read returns the content of s, reread if the file was replaced.  The
+// caller must hold s.mut.
+func (s *FileStore) read() (*MemStore, error) {
+	err := s.refresh()
+	if err != nil {
+		return nil, err
+	}
+	return s.mem, nil
+}
+
+func (s *FileStore) GetDomainAssoc(c Context, key string) (*DomainAssoc, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	mem, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	return mem.GetDomainAssoc(c, key)
+}
+
+func (s *FileStore) GetDomainAssocs(c Context, domain string) ([]DomainAssoc, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	mem, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	return mem.GetDomainAssocs(c, domain)
+}
+
+func (s *FileStore) GetDomainAssocsGitHubLogin(c Context, login string) ([]DomainAssoc, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	mem, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	return mem.GetDomainAssocsGitHubLogin(c, login)
+}
+
+func (s *FileStore) GetDomainAssocsAliasOf(c Context, p string) ([]DomainAssoc, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	mem, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	return mem.GetDomainAssocsAliasOf(c, p)
+}
+
+func (s *FileStore) ListDomainAssocs(c Context) ([]DomainAssoc, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	mem, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	return mem.ListDomainAssocs(c)
+}
+
+func (s *FileStore) PutDomainAssoc(c Context, assoc *DomainAssoc) error {
+	err := validateDomainAssoc(assoc)
+	if err != nil {
+		return err
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	stored := *assoc
+	return s.update(func(mem *MemStore) error {
+		return mem.put(&stored)
+	}, func() {
+		*assoc = stored
+	})
+}
+
+func (s *FileStore) DeleteDomainAssoc(c Context, key string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.update(func(mem *MemStore) error {
+		return mem.DeleteDomainAssoc(c, key)
+	}, nil)
+}
+
+// update applies fn to a copy of the current store content and writes the
+// result, holding the lock shared with other processes.  The copy replaces
+// the content of s, and commit is called, only if the write succeeds.  The
+// caller must hold s.mut.
+func (s *FileStore) update(fn func(*MemStore) error, commit func()) error {
+	unlock, err := lockDir(filepath.Dir(s.path))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = s.refresh()
+	if err != nil {
+		return err
+	}
+	mem := s.mem.clone()
+	err = fn(mem)
+	if err != nil {
+		return err
+	}
+	content := fileStoreContent{NextKey: mem.nextKey}
+	for _, assoc := range mem.assocs {
+		content.Assocs = append(content.Assocs, assoc)
+	}
+	sort.Sort(byKey(content.Assocs))
+	p, err := json.MarshalIndent(content, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(s.path, append(p, '\n'))
+	if err != nil {
+		return err
+	}
+	// no other process replaces the file while the lock is held.
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.mem, s.info = mem, info
+	if commit != nil {
+		commit()
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the content of the file at path with p so that a
+// crash at any point leaves either the old or the new content in place.
+func writeFileAtomic(path string, p []byte) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(p)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// sync the directory so the rename itself is durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	d.Sync()
+	return nil
+}
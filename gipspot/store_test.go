@@ -0,0 +1,207 @@
+package gipspot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testAssocStore exercises the AssocStore methods of an empty store.
+func testAssocStore(t *testing.T, s AssocStore) {
+	foo := &DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo"}
+	bar := &DomainAssoc{Domain: "bar.io", GitHubLogin: "mcfoo", Packages: []Package{{Root: "bar"}}}
+	for _, assoc := range []*DomainAssoc{foo, bar} {
+		err := s.PutDomainAssoc(nil, assoc)
+		if err != nil {
+			t.Fatalf("put %s: %v", assoc.Domain, err)
+		}
+		if assoc.Key == "" || assoc.Modified.IsZero() {
+			t.Errorf("put %s: key and modification time not set: %#v", assoc.Domain, assoc)
+		}
+	}
+	if foo.Key == bar.Key {
+		t.Errorf("associations share key %q", foo.Key)
+	}
+
+	err := s.PutDomainAssoc(nil, &DomainAssoc{GitHubLogin: "mcfoo"})
+	if err == nil {
+		t.Errorf("put an association without a domain")
+	}
+	err = s.PutDomainAssoc(nil, &DomainAssoc{Domain: "foo.io", GitHubLogin: "mcbar"})
+	if err != ErrDomainTaken {
+		t.Errorf("put a second association for a domain: %v", err)
+	}
+	prefixed := &DomainAssoc{Domain: "foo.io", Prefix: "go", GitHubLogin: "mcbar"}
+	err = s.PutDomainAssoc(nil, prefixed)
+	if err != nil {
+		t.Fatalf("put an association for a prefix of a taken domain: %v", err)
+	}
+	assocs, err := s.GetDomainAssocs(nil, "foo.io")
+	if err != nil || len(assocs) != 2 {
+		t.Errorf("get by domain with a prefix: %v %#v", err, assocs)
+	}
+	s.DeleteDomainAssoc(nil, prefixed.Key)
+	moved := *bar
+	moved.Domain = "foo.io"
+	err = s.PutDomainAssoc(nil, &moved)
+	if err != ErrDomainTaken {
+		t.Errorf("moved an association to a taken domain: %v", err)
+	}
+
+	assoc, err := s.GetDomainAssoc(nil, bar.Key)
+	if err != nil {
+		t.Fatalf("get %s: %v", bar.Key, err)
+	}
+	if assoc.Domain != "bar.io" || len(assoc.Packages) != 1 {
+		t.Errorf("get %s: unexpected association %#v", bar.Key, assoc)
+	}
+	assoc.Packages[0].Root = "mutated"
+	if assoc, _ := s.GetDomainAssoc(nil, bar.Key); assoc.Packages[0].Root != "bar" {
+		t.Errorf("stored association shares memory with returned values")
+	}
+
+	assocs, err = s.GetDomainAssocs(nil, "foo.io")
+	if err != nil || len(assocs) != 1 || assocs[0].Key != foo.Key {
+		t.Errorf("get by domain: %v %#v", err, assocs)
+	}
+	assocs, err = s.GetDomainAssocsGitHubLogin(nil, "mcfoo")
+	if err != nil || len(assocs) != 2 {
+		t.Errorf("get by login: %v %#v", err, assocs)
+	}
+
+	foo.GitHubLogin = "mcbar"
+	err = s.PutDomainAssoc(nil, foo)
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	assocs, _ = s.GetDomainAssocsGitHubLogin(nil, "mcbar")
+	if len(assocs) != 1 || assocs[0].Key != foo.Key {
+		t.Errorf("updated association not found by login: %#v", assocs)
+	}
+
+	err = s.DeleteDomainAssoc(nil, foo.Key)
+	if err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	_, err = s.GetDomainAssoc(nil, foo.Key)
+	if err != ErrNoSuchAssoc {
+		t.Errorf("get deleted association: %v", err)
+	}
+	err = s.DeleteDomainAssoc(nil, foo.Key)
+	if err != ErrNoSuchAssoc {
+		t.Errorf("delete deleted association: %v", err)
+	}
+	assocs, _ = s.ListDomainAssocs(nil)
+	if len(assocs) != 1 || assocs[0].Key != bar.Key {
+		t.Errorf("unexpected associations listed: %#v", assocs)
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	testAssocStore(t, NewMemStore())
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gipspot-filestore-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "assocs.json")
+
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testAssocStore(t, s)
+
+	// the content must survive reopening the file.
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assocs, err := s.ListDomainAssocs(nil)
+	if err != nil || len(assocs) != 1 || assocs[0].Domain != "bar.io" {
+		t.Fatalf("reopened store: %v %#v", err, assocs)
+	}
+	assoc := &DomainAssoc{Domain: "qux.io"}
+	err = s.PutDomainAssoc(nil, assoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assoc.Key == assocs[0].Key || assoc.Key == "1" {
+		t.Errorf("reopened store reused key %q", assoc.Key)
+	}
+
+	// no temporary files are left behind.
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	hidden, _ := filepath.Glob(filepath.Join(dir, ".*"))
+	if len(names) != 1 || len(hidden) != 0 {
+		t.Errorf("unexpected files in store directory: %q %q", names, hidden)
+	}
+}
+
+func TestFileStoreShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gipspot-filestore-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "assocs.json")
+
+	a, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foo := &DomainAssoc{Domain: "foo.io"}
+	if err := a.PutDomainAssoc(nil, foo); err != nil {
+		t.Fatal(err)
+	}
+
+	// b sees the change of a and doesn't reuse its key.
+	stale, err := b.GetDomainAssoc(nil, foo.Key)
+	if err != nil {
+		t.Fatalf("change of another store not read: %v", err)
+	}
+	bar := &DomainAssoc{Domain: "bar.io"}
+	if err := b.PutDomainAssoc(nil, bar); err != nil {
+		t.Fatal(err)
+	}
+	if bar.Key == foo.Key {
+		t.Errorf("stores sharing a file both used key %q", bar.Key)
+	}
+
+	// an update of a stale association fails rather than overwriting.
+	foo.GitHubLogin = "mcfoo"
+	if err := a.PutDomainAssoc(nil, foo); err != nil {
+		t.Fatal(err)
+	}
+	stale.GitHubLogin = "mcbar"
+	if err := b.PutDomainAssoc(nil, stale); err != ErrConflict {
+		t.Errorf("stale update: got %v, want ErrConflict", err)
+	}
+	assocs, err := a.ListDomainAssocs(nil)
+	if err != nil || len(assocs) != 2 || assocs[0].GitHubLogin != "mcfoo" {
+		t.Errorf("unexpected content: %v %#v", err, assocs)
+	}
+}
+
+func TestFileStoreWriteFailure(t *testing.T) {
+	s, err := OpenFileStore(filepath.Join(os.TempDir(), "gipspot-no-such-dir", "assocs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.PutDomainAssoc(nil, &DomainAssoc{Domain: "foo.io"})
+	if err == nil {
+		t.Fatalf("put succeeded without a writable file")
+	}
+	assocs, _ := s.ListDomainAssocs(nil)
+	if len(assocs) != 0 {
+		t.Errorf("failed write changed the store content: %#v", assocs)
+	}
+}
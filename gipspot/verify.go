@@ -0,0 +1,226 @@
+package gipspot
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Domain ownership is verified by publishing the VerifyToken of an
+// association in either of two places controlled by the domain owner.
+const (
+	// VerifyTXTPrefix is prepended to the domain to form the name of the DNS
+	// TXT record holding the record VerifyTXTValue.
+	VerifyTXTPrefix = "_gopherpath-challenge."
+
+	// VerifyPath is the path on the domain at which the token may be served
+	// over http instead.  The path is never served by Server itself.
+	VerifyPath = "/.well-known/gopherpath-verify.txt"
+)
+
+// VerifyTXTValue returns the TXT record value verifying token.
+func VerifyTXTValue(token string) string {
+	return "gopherpath-verify=" + token
+}
+
+// ErrNotVerified is returned by Verifier.Verify when neither challenge
+// contains the verification token.
+var ErrNotVerified = fmt.Errorf("domain ownership could not be verified")
+
+// Resolver looks up DNS TXT records.  A *net.Resolver satisfies the
+// interface with LookupTXT wrapped by ResolverFunc.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+}
+
+type ResolverFunc func(name string) ([]string, error)
+
+func (fn ResolverFunc) LookupTXT(name string) ([]string, error) {
+	return fn(name)
+}
+
+// Verifier checks the DNS and http challenges for domain ownership.
+type Verifier struct {
+	// Resolver looks up TXT records.  If nil net.LookupTXT is used.
+	Resolver Resolver
+
+	// Client returns the http client for the http challenge.  If nil
+	// http.DefaultClient is used.
+	Client func(c Context) *http.Client
+}
+
+// NewVerifyToken returns a random verification token.
+func NewVerifyToken() (string, error) {
+	p := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, p)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(p), nil
+}
+
+// IsVerified returns true if ownership of assoc.Domain has been verified.
+func (assoc *DomainAssoc) IsVerified() bool {
+	return !assoc.Verified.IsZero() && assoc.VerifiedDomain == assoc.Domain
+}
+
+// IsActive returns true if metadata is served for assoc.  An alias also
+// requires its canonical association to be active.
+func (assoc *DomainAssoc) IsActive() bool {
+	return (assoc.GitHubLogin != "" || assoc.isWildcard() || assoc.isAlias()) && assoc.IsVerified()
+}
+
+// Verify checks the challenges for assoc and marks it verified if either
+// holds its VerifyToken.  The caller is responsible for storing assoc.
+func (v *Verifier) Verify(c Context, assoc *DomainAssoc) error {
+	if assoc.VerifyToken == "" {
+		return fmt.Errorf("no verification token issued for %v", assoc.Domain)
+	}
+	ok, err := v.verifyTXT(assoc)
+	if err != nil {
+		c.Infof("dns verification of %v failed: %v", assoc.Domain, err)
+	}
+	if !ok {
+		ok, err = v.verifyHTTP(c, assoc)
+		if err != nil {
+			c.Infof("http verification of %v failed: %v", assoc.Domain, err)
+		}
+	}
+	if !ok {
+		return ErrNotVerified
+	}
+	assoc.Verified = time.Now()
+	assoc.VerifiedDomain = assoc.Domain
+	return nil
+}
+
+func (v *Verifier) verifyTXT(assoc *DomainAssoc) (bool, error) {
+	lookup := net.LookupTXT
+	if v.Resolver != nil {
+		lookup = v.Resolver.LookupTXT
+	}
+	records, err := lookup(VerifyTXTPrefix + assoc.verifyDomain())
+	if err != nil {
+		return false, err
+	}
+	expect := VerifyTXTValue(assoc.VerifyToken)
+	for _, record := range records {
+		if strings.TrimSpace(record) == expect {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (v *Verifier) verifyHTTP(c Context, assoc *DomainAssoc) (bool, error) {
+	client := http.DefaultClient
+	if v.Client != nil {
+		client = v.Client(c)
+	}
+	resp, err := client.Get("http://" + assoc.verifyDomain() + VerifyPath)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("http status %v", resp.Status)
+	}
+	p, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(p)) == assoc.VerifyToken, nil
+}
+
+// HandleVerify runs verification for the pending association of the request
+// host.
+func (s *Server) HandleVerify(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		resp.Header().Set("Allow", "POST")
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c := s.NewContext(req)
+	host := req.Host
+	found, err := lookupDomainAssoc(c, s.Store, host, strings.TrimSuffix(req.URL.Path, VerifyHandlerPath))
+	if err == ErrNoSuchAssoc {
+		http.NotFound(resp, req)
+		return
+	}
+	if cerr, ok := err.(*ConflictError); ok {
+		writeConflict(resp, cerr)
+		return
+	}
+	if err != nil {
+		c.Errorf("unable to lookup hostname: %v", err)
+		http.Error(resp, "an error occurred", http.StatusInternalServerError)
+		return
+	}
+	assoc := *found
+	if assoc.IsVerified() {
+		fmt.Fprintf(resp, "%v is verified\n", host)
+		return
+	}
+	err = s.issueVerifyToken(c, ServerActor, &assoc)
+	if err == nil {
+		err = s.verifier().Verify(c, &assoc)
+	}
+	if err == ErrNotVerified {
+		resp.WriteHeader(http.StatusForbidden)
+		writeVerifyInstructions(resp, &assoc, host)
+		return
+	}
+	if err != nil {
+		c.Errorf("unable to verify %v: %v", host, err)
+		http.Error(resp, "an error occurred", http.StatusInternalServerError)
+		return
+	}
+	err = s.storeFor(ServerActor).PutDomainAssoc(c, &assoc)
+	if err != nil {
+		c.Errorf("unable to store verification of %v: %v", host, err)
+		http.Error(resp, "an error occurred", http.StatusInternalServerError)
+		return
+	}
+	c.Infof("verified ownership of %v", host)
+	fmt.Fprintf(resp, "%v is verified\n", host)
+}
+
+// issueVerifyToken gives assoc a verification token if it has none.  The
+// change is audited as made by actor.
+func (s *Server) issueVerifyToken(c Context, actor string, assoc *DomainAssoc) error {
+	if assoc.VerifyToken != "" {
+		return nil
+	}
+	token, err := NewVerifyToken()
+	if err != nil {
+		return err
+	}
+	assoc.VerifyToken = token
+	return s.storeFor(actor).PutDomainAssoc(c, assoc)
+}
+
+func (s *Server) verifier() *Verifier {
+	if s.Verifier != nil {
+		return s.Verifier
+	}
+	return new(Verifier)
+}
+
+// writeVerifyInstructions describes how to verify ownership of the domain of
+// assoc.  Verification is run through host.
+func writeVerifyInstructions(w io.Writer, assoc *DomainAssoc, host string) {
+	domain := assoc.verifyDomain()
+	fmt.Fprintf(w, "ownership of %v has not been verified.\n\n", domain)
+	fmt.Fprintf(w, "publish the DNS TXT record\n\n\t%v%v. TXT %q\n\n",
+		VerifyTXTPrefix, domain, VerifyTXTValue(assoc.VerifyToken))
+	fmt.Fprintf(w, "or serve the following content at http://%v%v\n\n\t%v\n\n",
+		domain, VerifyPath, assoc.VerifyToken)
+	fmt.Fprintf(w, "then POST to http://%v%v\n", path.Join(host, assoc.Prefix), VerifyHandlerPath)
+}
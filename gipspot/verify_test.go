@@ -0,0 +1,148 @@
+package gipspot
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// fakeDNS is a Resolver serving TXT records from a map.
+type fakeDNS map[string][]string
+
+func (dns fakeDNS) LookupTXT(name string) ([]string, error) {
+	records, ok := dns[name]
+	if !ok {
+		return nil, fmt.Errorf("no such host %v", name)
+	}
+	return records, nil
+}
+
+// redirectClient returns a Verifier client which sends every request to srv.
+func redirectClient(srv *httptest.Server) func(Context) *http.Client {
+	target, _ := url.Parse(srv.URL)
+	return func(c Context) *http.Client {
+		return &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			return http.DefaultTransport.RoundTrip(req)
+		})}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+func TestVerifierDNS(t *testing.T) {
+	v := &Verifier{
+		Resolver: fakeDNS{"_gopherpath-challenge.foo.io": {"v=spf1 -all", "gopherpath-verify=s3cret"}},
+		Client:   func(Context) *http.Client { return &http.Client{Transport: failTransport{}} },
+	}
+	assoc := &DomainAssoc{Domain: "foo.io", VerifyToken: "s3cret"}
+	err := v.Verify(testContext, assoc)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if !assoc.IsVerified() {
+		t.Errorf("association not marked verified")
+	}
+	assoc.Domain = "bar.io"
+	if assoc.IsVerified() {
+		t.Errorf("association verified after changing its domain")
+	}
+
+	assoc = &DomainAssoc{Domain: "foo.io", VerifyToken: "wrong"}
+	err = v.Verify(testContext, assoc)
+	if err != ErrNotVerified || assoc.IsVerified() {
+		t.Errorf("verified with the wrong token: %v", err)
+	}
+}
+
+type failTransport struct{}
+
+func (failTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("no network")
+}
+
+func TestVerifierHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Host != "foo.io" || req.URL.Path != VerifyPath {
+			http.NotFound(resp, req)
+			return
+		}
+		fmt.Fprintln(resp, "s3cret")
+	}))
+	defer srv.Close()
+	v := &Verifier{Resolver: fakeDNS{}, Client: redirectClient(srv)}
+
+	assoc := &DomainAssoc{Domain: "foo.io", VerifyToken: "s3cret"}
+	err := v.Verify(testContext, assoc)
+	if err != nil || !assoc.IsVerified() {
+		t.Errorf("verify: %v", err)
+	}
+	assoc = &DomainAssoc{Domain: "bar.io", VerifyToken: "s3cret"}
+	err = v.Verify(testContext, assoc)
+	if err != ErrNotVerified {
+		t.Errorf("verified a domain not serving the token: %v", err)
+	}
+}
+
+func TestHandleVerify(t *testing.T) {
+	dns := fakeDNS{}
+	s := testServer(DomainAssoc{Domain: "foo.io", GitHubLogin: "mcfoo"})
+	s.Verifier = &Verifier{Resolver: dns, Client: func(Context) *http.Client { return &http.Client{Transport: failTransport{}} }}
+
+	get := func(rawurl string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", rawurl, nil)
+		s.ServeHTTP(resp, req)
+		return resp
+	}
+	verify := func() *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://foo.io"+VerifyHandlerPath, nil)
+		s.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// unverified associations serve nothing but instructions.
+	if resp := get("http://foo.io/bar?go-get=1"); resp.Code != http.StatusNotFound {
+		t.Errorf("metadata served before verification: %d", resp.Code)
+	}
+	// a token is issued by a POST, never by a read.
+	resp := get("http://foo.io/")
+	if resp.Code != http.StatusNotFound || !strings.Contains(resp.Body.String(), "POST to http://foo.io"+VerifyHandlerPath) {
+		t.Errorf("unexpected root response before verification: %d %q", resp.Code, resp.Body.String())
+	}
+	if assocs, _ := s.Store.GetDomainAssocs(nil, "foo.io"); assocs[0].VerifyToken != "" || assocs[0].Revision != 1 {
+		t.Errorf("read changed the association: %#v", assocs[0])
+	}
+	if resp := verify(); resp.Code != http.StatusForbidden {
+		t.Errorf("verified without a challenge: %d", resp.Code)
+	}
+	assocs, _ := s.Store.GetDomainAssocs(nil, "foo.io")
+	token := assocs[0].VerifyToken
+	if token == "" {
+		t.Fatalf("no verification token issued")
+	}
+	resp = get("http://foo.io/")
+	if resp.Code != http.StatusNotFound || !strings.Contains(resp.Body.String(), VerifyTXTValue(token)) {
+		t.Errorf("unexpected root response before verification: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp := get("http://foo.io" + VerifyPath); resp.Code != http.StatusNotFound {
+		t.Errorf("http challenge served by the server itself: %d", resp.Code)
+	}
+
+	dns["_gopherpath-challenge.foo.io"] = []string{VerifyTXTValue(token)}
+	if resp := verify(); resp.Code != http.StatusOK {
+		t.Errorf("verification failed: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp := get("http://foo.io/bar?go-get=1"); resp.Code != http.StatusOK {
+		t.Errorf("metadata not served after verification: %d", resp.Code)
+	}
+}
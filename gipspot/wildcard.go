@@ -0,0 +1,137 @@
+package gipspot
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Wildcard associations serve every subdomain one level beneath a domain.
+// The Domain of a wildcard association is the parent domain prefixed with
+// "*." (e.g. "*.go.example.com") and the owner of the repositories served
+// for a subdomain is derived from its first label with the association's
+// OwnerTemplate.  A host with an association of its own is never served by
+// a wildcard.
+
+// WildcardLabel is the placeholder replaced by the subdomain label in the
+// OwnerTemplate of a wildcard association.
+const WildcardLabel = "{label}"
+
+// isWildcard returns true if assoc serves the subdomains of a domain.
+func (assoc *DomainAssoc) isWildcard() bool {
+	return strings.HasPrefix(assoc.Domain, "*.")
+}
+
+// verifyDomain returns the domain whose ownership is verified for assoc.  A
+// wildcard association is verified for its parent domain.
+func (assoc *DomainAssoc) verifyDomain() string {
+	return strings.TrimPrefix(assoc.Domain, "*.")
+}
+
+// wildcardDomain returns the wildcard domain which may serve host and the
+// subdomain label of host.  If host has no parent domain ok is false.
+func wildcardDomain(host string) (wildcard, label string, ok bool) {
+	i := strings.Index(host, ".")
+	if i <= 0 || i == len(host)-1 || strings.HasPrefix(host, "*.") {
+		return "", "", false
+	}
+	return "*" + host[i:], host[:i], true
+}
+
+// allowsLabel returns true if the wildcard association assoc serves the
+// subdomain label.  Any label is allowed if assoc.Labels is empty.
+func (assoc *DomainAssoc) allowsLabel(label string) bool {
+	if !isLabel(label) {
+		return false
+	}
+	return len(assoc.Labels) == 0 || containsString(assoc.Labels, label)
+}
+
+// ownerTemplate returns the OwnerTemplate of assoc or its default.
+func (assoc *DomainAssoc) ownerTemplate() string {
+	if assoc.OwnerTemplate == "" {
+		return WildcardLabel
+	}
+	return assoc.OwnerTemplate
+}
+
+// forHost returns the association serving host.  A wildcard association is
+// copied, naming host as its domain and the owner derived from the label of
+// host.  The copy must not be stored.  Other associations are returned as
+// they are.
+func (assoc *DomainAssoc) forHost(host string) *DomainAssoc {
+	if !assoc.isWildcard() {
+		return assoc
+	}
+	_, label, _ := wildcardDomain(host)
+	served := *assoc
+	served.Domain = host
+	served.GitHubLogin = strings.Replace(assoc.ownerTemplate(), WildcardLabel, label, -1)
+	if assoc.IsVerified() {
+		served.VerifiedDomain = host
+	}
+	return &served
+}
+
+// sampleHost returns a host served by assoc, which for a wildcard association
+// is a subdomain with the first of its labels.
+func (assoc *DomainAssoc) sampleHost() string {
+	if !assoc.isWildcard() {
+		return assoc.Domain
+	}
+	label := "example"
+	if len(assoc.Labels) > 0 {
+		label = assoc.Labels[0]
+	}
+	return label + assoc.Domain[1:]
+}
+
+// isLabel returns true if label is a valid DNS label in lower case.
+func isLabel(label string) bool {
+	if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, r := range label {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// validateWildcard returns a *ValidationError if the wildcard settings of
+// assoc are invalid.
+func validateWildcard(assoc *DomainAssoc) error {
+	if !assoc.isWildcard() {
+		if strings.Contains(assoc.Domain, "*") {
+			return &ValidationError{"domain", fmt.Sprintf("invalid domain %q (wildcards must be of the form *.example.com)", assoc.Domain)}
+		}
+		if assoc.OwnerTemplate != "" {
+			return &ValidationError{"ownerTemplate", "an owner template requires a wildcard domain"}
+		}
+		if len(assoc.Labels) > 0 {
+			return &ValidationError{"labels", "labels require a wildcard domain"}
+		}
+		return nil
+	}
+	parent := assoc.verifyDomain()
+	if strings.Contains(parent, "*") || !strings.Contains(parent, ".") || strings.HasPrefix(parent, ".") || strings.HasSuffix(parent, ".") {
+		return &ValidationError{"domain", fmt.Sprintf("invalid wildcard domain %q", assoc.Domain)}
+	}
+	if assoc.GitHubLogin != "" {
+		return &ValidationError{"githubLogin", "wildcard associations derive the owner from ownerTemplate"}
+	}
+	if tmpl := assoc.OwnerTemplate; tmpl != "" && !strings.Contains(tmpl, WildcardLabel) {
+		return &ValidationError{"ownerTemplate", fmt.Sprintf("owner template %q does not contain %s", tmpl, WildcardLabel)}
+	}
+	owner := strings.Replace(assoc.ownerTemplate(), WildcardLabel, "label", -1)
+	err := checkProvider(providerName(assoc.Provider), assoc.ProviderURL, owner, "ownerTemplate")
+	if err != nil {
+		return err
+	}
+	for i, label := range assoc.Labels {
+		if !isLabel(label) {
+			return &ValidationError{fmt.Sprintf("labels[%d]", i), fmt.Sprintf("invalid subdomain label %q", label)}
+		}
+	}
+	return nil
+}
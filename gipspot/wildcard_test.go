@@ -0,0 +1,93 @@
+package gipspot
+
+import (
+	"importmeta"
+
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWildcard(t *testing.T) {
+	s := testServer(
+		verified(DomainAssoc{Domain: "*.go.foo.io", OwnerTemplate: "{label}", Labels: []string{"alice", "bob", "carol"}}),
+		verified(DomainAssoc{Domain: "*.gl.foo.io", Provider: "gitlab", OwnerTemplate: "team/{label}"}),
+		verified(DomainAssoc{Domain: "bob.go.foo.io", GitHubLogin: "robert"}),
+		DomainAssoc{Domain: "*.new.foo.io", VerifyToken: "token"},
+	)
+	for i, test := range []struct {
+		URL  string
+		Root string
+		Repo string
+	}{
+		{"http://alice.go.foo.io/bar/baz", "alice.go.foo.io/bar", "https://github.com/alice/bar"},
+		{"http://bob.go.foo.io/bar", "bob.go.foo.io/bar", "https://github.com/robert/bar"},
+		{"http://mallory.go.foo.io/bar", "", ""},
+		{"http://x.alice.go.foo.io/bar", "", ""},
+		{"http://go.foo.io/bar", "", ""},
+		{"http://dave.gl.foo.io/bar", "dave.gl.foo.io/bar", "https://gitlab.com/team/dave/bar.git"},
+		{"http://dave.new.foo.io/bar", "", ""},
+	} {
+		req, _ := http.NewRequest("GET", test.URL+"?go-get=1", nil)
+		req.Host = req.URL.Host
+		metas, err := s.ImportMetas(req)
+		if test.Root == "" {
+			if err != importmeta.ErrNotFound {
+				t.Errorf("test %d: unexpected metadata: %v %v", i, metas, err)
+			}
+			continue
+		}
+		if err != nil || len(metas) != 1 || metas[0].RootPkg != test.Root || metas[0].Repo != test.Repo {
+			t.Errorf("test %d: unexpected metadata: %v %v", i, metas, err)
+		}
+	}
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://carol.go.foo.io/", nil)
+	s.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "carol.go.foo.io directs clients to source repositories at https://github.com/carol") {
+		t.Errorf("unexpected wildcard landing page: %d %q", resp.Code, resp.Body.String())
+	}
+
+	// an unverified wildcard is verified for its parent domain.
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://dave.new.foo.io/", nil)
+	s.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotFound || !strings.Contains(resp.Body.String(), VerifyTXTPrefix+"new.foo.io. TXT") {
+		t.Errorf("unexpected unverified wildcard page: %d %q", resp.Code, resp.Body.String())
+	}
+	assocs, _ := s.Store.GetDomainAssocs(testContext, "dave.new.foo.io")
+	if len(assocs) != 0 {
+		t.Errorf("subdomain of a wildcard stored: %#v", assocs)
+	}
+}
+
+func TestValidateWildcard(t *testing.T) {
+	for i, test := range []struct {
+		assoc DomainAssoc
+		field string
+	}{
+		{DomainAssoc{Domain: "*.foo.io"}, ""},
+		{DomainAssoc{Domain: "*.foo.io", OwnerTemplate: "go-{label}", Labels: []string{"alice", "b0b"}}, ""},
+		{DomainAssoc{Domain: "*.foo.io", GitHubLogin: "mcfoo"}, "githubLogin"},
+		{DomainAssoc{Domain: "*.foo.io", OwnerTemplate: "mcfoo"}, "ownerTemplate"},
+		{DomainAssoc{Domain: "*.foo.io", OwnerTemplate: "org/{label}"}, "ownerTemplate"},
+		{DomainAssoc{Domain: "*.foo.io", Labels: []string{"alice", "Bob"}}, "labels[1]"},
+		{DomainAssoc{Domain: "*.io"}, "domain"},
+		{DomainAssoc{Domain: "a.*.foo.io"}, "domain"},
+		{DomainAssoc{Domain: "foo.io", Labels: []string{"alice"}}, "labels"},
+		{DomainAssoc{Domain: "foo.io", OwnerTemplate: "{label}"}, "ownerTemplate"},
+	} {
+		err := validateDomainAssoc(&test.assoc)
+		if test.field == "" {
+			if err != nil {
+				t.Errorf("test %d: unexpected error: %v", i, err)
+			}
+			continue
+		}
+		if verr, ok := err.(*ValidationError); !ok || verr.Field != test.field {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package importmeta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// IndexTemplate describes the index page of a domain.  It is invoked with an
+// Index type as its context.
+var IndexTemplate = template.Must(template.New("index").Parse(`
+<html>
+	<head>
+		<title>{{.Host}}</title>
+	</head>
+	<body>
+		<h1>{{.Host}}</h1>
+		<ul>
+		{{range .Roots}}
+			<li><a href="{{.GodocURL}}">{{.Pkg}}</a> ({{.Repo}})</li>
+		{{end}}
+		</ul>
+	</body>
+</html>
+`))
+
+// NotFoundTemplate describes the page served for unknown packages of a
+// domain.  It is invoked with an Index type as its context.
+var NotFoundTemplate = template.Must(template.New("notfound").Parse(`
+<html>
+	<head>
+		<title>unrecognized package</title>
+	</head>
+	<body>
+		unrecognized package. see <a href="/">{{.Host}}</a> for a list of packages.
+	</body>
+</html>
+`))
+
+// Index contains the root packages served for a single domain.
+type Index struct {
+	Host  string
+	Roots []ImportMeta
+}
+
+// ManifestName is the name of the file in which Export records the content
+// it has written.  It is written to the export directory and so published
+// with the pages, which is harmless as it holds only their names and sums.
+const ManifestName = "manifest.json"
+
+// Manifest maps slash separated file paths, relative to an export directory,
+// to the hex encoded SHA-256 sum of their content.
+type Manifest map[string]string
+
+// ExportStats summarizes the changes made by a call to Export.
+type ExportStats struct {
+	Written   []string // files created or rewritten
+	Unchanged []string // files whose content was already current
+	Removed   []string // files from a previous export which are now unknown
+}
+
+// Export writes the static pages for every package known to e beneath dir,
+// one directory per domain.  Each root and subpackage gets an index.html
+// rendered with MetasTemplate, holding the entries for the package in the
+// order they were enumerated, and each domain gets an index.html rendered
+// with IndexTemplate as well as a 404.html rendered with NotFoundTemplate.
+//
+// A Manifest of the exported files is kept in dir so repeated exports only
+// rewrite files whose content changed and remove files for packages which are
+// no longer known.  Export fails without changing anything if the manifest
+// lists a file outside of dir.
+func Export(dir string, e Enumerator) (*ExportStats, error) {
+	files, err := exportFiles(e)
+	if err != nil {
+		return nil, err
+	}
+
+	old, err := readManifest(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+	for name := range old {
+		if checkExportPath(name) != nil || name == ManifestName {
+			return nil, fmt.Errorf("%s: invalid file name %q", filepath.Join(dir, ManifestName), name)
+		}
+	}
+
+	stats := new(ExportStats)
+	manifest := make(Manifest, len(files))
+	for _, name := range sortedKeys(files) {
+		content := files[name]
+		sum := sha256.Sum256(content)
+		manifest[name] = hex.EncodeToString(sum[:])
+		fullpath := filepath.Join(dir, filepath.FromSlash(name))
+		if old[name] == manifest[name] && fileExists(fullpath) {
+			stats.Unchanged = append(stats.Unchanged, name)
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(fullpath), 0755)
+		if err != nil {
+			return stats, err
+		}
+		err = ioutil.WriteFile(fullpath, content, 0644)
+		if err != nil {
+			return stats, err
+		}
+		stats.Written = append(stats.Written, name)
+	}
+
+	var stale []string
+	for name := range old {
+		if _, ok := manifest[name]; !ok {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	for _, name := range stale {
+		fullpath := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.Remove(fullpath)
+		if err != nil && !os.IsNotExist(err) {
+			return stats, err
+		}
+		// only succeeds when the package directory is left empty.
+		os.Remove(filepath.Dir(fullpath))
+		stats.Removed = append(stats.Removed, name)
+	}
+
+	err = writeManifest(filepath.Join(dir, ManifestName), manifest)
+	if err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// exportFiles renders the content of every exported file.
+func exportFiles(e Enumerator) (map[string][]byte, error) {
+	metas, err := e.Enumerate()
+	if err != nil {
+		return nil, err
+	}
+
+	// pages holds the entries of each listed package, in order.  roots holds
+	// the entries derived for root packages which may not be listed.
+	pages := make(map[string]Metas)
+	roots := make(map[string]Metas)
+	indexes := make(map[string]*Index)
+	for _, m := range metas {
+		if m.RootPkg == "" {
+			return nil, fmt.Errorf("package %q has no root package", m.Pkg)
+		}
+		if m.Pkg == "" {
+			m.Pkg = m.RootPkg
+		}
+		if !hasPathPrefix(m.Pkg, m.RootPkg) {
+			return nil, fmt.Errorf("package %q is not beneath its root %q", m.Pkg, m.RootPkg)
+		}
+		err := checkExportPath(m.Pkg)
+		if err != nil {
+			return nil, err
+		}
+		if !containsImport(pages[m.Pkg], m) {
+			pages[m.Pkg] = append(pages[m.Pkg], m)
+		}
+		root := m
+		root.Pkg = m.RootPkg
+		if !containsImport(roots[root.Pkg], root) {
+			roots[root.Pkg] = append(roots[root.Pkg], root)
+		}
+
+		host := strings.SplitN(m.RootPkg, "/", 2)[0]
+		index := indexes[host]
+		if index == nil {
+			index = &Index{Host: host}
+			indexes[host] = index
+		}
+		index.addRoot(root)
+	}
+	for pkg, metas := range roots {
+		if _, ok := pages[pkg]; !ok {
+			pages[pkg] = metas
+		}
+	}
+
+	files := make(map[string][]byte)
+	for pkg, metas := range pages {
+		if !strings.Contains(pkg, "/") {
+			// the domain itself is a package. its page is the domain index.
+			return nil, fmt.Errorf("package %q has no path beneath its domain", pkg)
+		}
+		buf := new(bytes.Buffer)
+		err := MetasTemplate.Execute(buf, metas)
+		if err != nil {
+			return nil, err
+		}
+		files[path.Join(pkg, "index.html")] = buf.Bytes()
+	}
+	for host, index := range indexes {
+		sort.Sort(byPkg(index.Roots))
+		buf := new(bytes.Buffer)
+		err := IndexTemplate.Execute(buf, index)
+		if err != nil {
+			return nil, err
+		}
+		files[path.Join(host, "index.html")] = buf.Bytes()
+
+		buf = new(bytes.Buffer)
+		err = NotFoundTemplate.Execute(buf, index)
+		if err != nil {
+			return nil, err
+		}
+		files[path.Join(host, "404.html")] = buf.Bytes()
+	}
+	return files, nil
+}
+
+// addRoot lists root in index unless its package is listed already.  The
+// repository entry of a root is listed in preference to a "mod" entry, which
+// names a module proxy rather than the repository.
+func (index *Index) addRoot(root ImportMeta) {
+	for i, m := range index.Roots {
+		if m.Pkg == root.Pkg {
+			if m.VCS == "mod" && root.VCS != "mod" {
+				index.Roots[i] = root
+			}
+			return
+		}
+	}
+	index.Roots = append(index.Roots, root)
+}
+
+// checkExportPath returns an error if pkg, or the name of an exported file,
+// would not be written beneath the export directory.
+func checkExportPath(pkg string) error {
+	if path.IsAbs(pkg) || path.Clean(pkg) != pkg {
+		return fmt.Errorf("invalid package path %q", pkg)
+	}
+	for _, elem := range strings.Split(pkg, "/") {
+		if elem == ".." || elem == "." || elem == "" {
+			return fmt.Errorf("invalid package path %q", pkg)
+		}
+	}
+	return nil
+}
+
+func readManifest(filename string) (Manifest, error) {
+	p, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return Manifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	err = json.Unmarshal(p, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return manifest, nil
+}
+
+func writeManifest(filename string, manifest Manifest) error {
+	p, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(p, '\n'), 0644)
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+func sortedKeys(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type byPkg []ImportMeta
+
+func (s byPkg) Len() int           { return len(s) }
+func (s byPkg) Less(i, j int) bool { return s[i].Pkg < s[j].Pkg }
+func (s byPkg) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,155 @@
+package importmeta
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testStaticCodec = StaticCodec{
+	{Pkg: "foo.io/bar/baz", RootPkg: "foo.io/bar", VCS: "git", Repo: "https://github.com/mcfoo/bar"},
+	{Pkg: "foo.io/qux", RootPkg: "foo.io/qux", VCS: "hg", Repo: "https://bitbucket.org/mcfoo/qux"},
+}
+
+func TestStaticCodec(t *testing.T) {
+	for i, test := range []struct {
+		URL  string
+		Root string
+		Err  error
+	}{
+		{"http://foo.io/bar", "foo.io/bar", nil},
+		{"http://foo.io/bar/baz/quux?go-get=1", "foo.io/bar", nil},
+		{"http://foo.io/qux", "foo.io/qux", nil},
+		{"http://foo.io/barn", "", ErrNotFound},
+		{"http://bar.io/bar", "", ErrNotFound},
+	} {
+		req, _ := http.NewRequest("GET", test.URL, nil)
+		meta, err := testStaticCodec.ImportMeta(req)
+		if err != test.Err {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if meta.RootPkg != test.Root {
+			t.Errorf("test %d: unexpected root package: %q", i, meta.RootPkg)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "importmeta-export-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stats, err := Export(dir, testStaticCodec)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	expect := []string{
+		"foo.io/404.html",
+		"foo.io/bar/baz/index.html",
+		"foo.io/bar/index.html",
+		"foo.io/index.html",
+		"foo.io/qux/index.html",
+	}
+	if !reflect.DeepEqual(stats.Written, expect) {
+		t.Errorf("unexpected files written: %q", stats.Written)
+	}
+	p, err := ioutil.ReadFile(filepath.Join(dir, "foo.io", "bar", "baz", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := `<meta name="go-import" content="foo.io/bar git https://github.com/mcfoo/bar">`
+	if !strings.Contains(string(p), tag) {
+		t.Errorf("exported page missing meta tag: %s", p)
+	}
+	p, err = ioutil.ReadFile(filepath.Join(dir, "foo.io", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(p), "foo.io/qux") {
+		t.Errorf("domain index missing root package: %s", p)
+	}
+
+	// a second export with one less package only removes its files.
+	stats, err = Export(dir, testStaticCodec[:1])
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if !reflect.DeepEqual(stats.Written, []string{"foo.io/index.html"}) {
+		t.Errorf("unexpected files rewritten: %q", stats.Written)
+	}
+	if !reflect.DeepEqual(stats.Removed, []string{"foo.io/qux/index.html"}) {
+		t.Errorf("unexpected files removed: %q", stats.Removed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo.io", "qux")); !os.IsNotExist(err) {
+		t.Errorf("stale package directory was not removed: %v", err)
+	}
+
+	// a file deleted out from under the manifest is rewritten.
+	os.Remove(filepath.Join(dir, "foo.io", "bar", "index.html"))
+	stats, err = Export(dir, testStaticCodec[:1])
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if !reflect.DeepEqual(stats.Written, []string{"foo.io/bar/index.html"}) {
+		t.Errorf("unexpected files rewritten: %q", stats.Written)
+	}
+}
+
+func TestExportInvalidPath(t *testing.T) {
+	codec := StaticCodec{{Pkg: "foo.io/../../etc", RootPkg: "foo.io/..", VCS: "git", Repo: "x"}}
+	_, err := Export(os.TempDir(), codec)
+	if err == nil {
+		t.Errorf("no error exporting an invalid package path")
+	}
+}
+
+func TestExportTamperedManifest(t *testing.T) {
+	parent, err := ioutil.TempDir("", "importmeta-export-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "site")
+	victim := filepath.Join(parent, "victim")
+	if err := ioutil.WriteFile(victim, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../victim", victim, "foo.io/../../victim"} {
+		err := writeManifest(filepath.Join(dir, ManifestName), Manifest{name: "0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Export(dir, testStaticCodec); err == nil {
+			t.Errorf("%q: manifest accepted", name)
+		}
+		if !fileExists(victim) {
+			t.Fatalf("%q: file outside the export directory removed", name)
+		}
+	}
+}
+
+func TestExportIndexSkipsProxy(t *testing.T) {
+	files, err := exportFiles(StaticCodec{
+		{Pkg: "foo.io/bar", RootPkg: "foo.io/bar", VCS: "mod", Repo: "https://proxy.foo.io"},
+		{Pkg: "foo.io/bar", RootPkg: "foo.io/bar", VCS: "git", Repo: "https://github.com/mcfoo/bar"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := string(files["foo.io/index.html"])
+	if !strings.Contains(index, "(https://github.com/mcfoo/bar)") || strings.Contains(index, "proxy.foo.io") {
+		t.Errorf("unexpected index: %s", index)
+	}
+	// the package page keeps both entries.
+	if page := string(files["foo.io/bar/index.html"]); !strings.Contains(page, "proxy.foo.io") {
+		t.Errorf("unexpected page: %s", page)
+	}
+}
@@ -6,17 +6,44 @@ import (
 	"net/http"
 )
 
-// PkgTemplate describes the content served by Handler and Middleware return
-// values.  It is invoked with an ImportMeta type as its context.
+// PkgTemplate describes the content of a page holding a single go-import
+// entry.  It is invoked with an ImportMeta type as its context.  See
+// MetasTemplate for pages holding several.
 var PkgTemplate = template.Must(template.New("pkg").Parse(`
 {{$godoc := .GodocURL}}
 <html>
 	<head>
 		<meta http-equiv="refresh" content="0; URL='{{$godoc}}'">
-		<meta name="go-import" content="{{.RootPkg}} {{.VCS}} {{.Repo}}">
+		{{with .Canonical}}<link rel="canonical" href="https://{{.}}">
+		{{end}}<meta name="go-import" content="{{.RootPkg}} {{.VCS}} {{.Repo}}{{with .Subdir}} {{.}}{{end}}">
+		{{if .Home}}<meta name="go-source" content="{{.RootPkg}} {{.Home}} {{or .Dir "_"}} {{or .File "_"}}">
+		{{end}}
 	</head>
 	<body>
-		You are being redirected to <a href="{{$godoc}}">{{$godoc}}</a>.
+		{{with .Canonical}}The canonical import path of this package is {{.}}.
+		{{end}}You are being redirected to <a href="{{$godoc}}">{{$godoc}}</a>.
+	</body>
+</html>
+`))
+
+// MetasTemplate describes the content served by Handler and Middleware
+// return values.  It is invoked with a Metas type as its context and renders
+// one go-import tag per element, in order.  Elements with a Home also render
+// a go-source tag.  A package served under an alias names its canonical
+// import path in a canonical link for human visitors.
+var MetasTemplate = template.Must(template.New("metas").Parse(`
+{{$godoc := .GodocURL}}{{$canonical := .Canonical}}
+<html>
+	<head>
+		<meta http-equiv="refresh" content="0; URL='{{$godoc}}'">
+		{{with $canonical}}<link rel="canonical" href="https://{{.}}">
+		{{end}}		{{range .}}<meta name="go-import" content="{{.RootPkg}} {{.VCS}} {{.Repo}}{{with .Subdir}} {{.}}{{end}}">
+		{{if .Home}}<meta name="go-source" content="{{.RootPkg}} {{.Home}} {{or .Dir "_"}} {{or .File "_"}}">
+		{{end}}{{end}}
+	</head>
+	<body>
+		{{with $canonical}}The canonical import path of this package is {{.}}.
+		{{end}}You are being redirected to <a href="{{$godoc}}">{{$godoc}}</a>.
 	</body>
 </html>
 `))
@@ -24,18 +51,23 @@ var PkgTemplate = template.Must(template.New("pkg").Parse(`
 // Handler creates an http.Handler that serves all requests as go-get requests.
 func Handler(codec Codec) http.Handler {
 	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
-		m, err := codec.ImportMeta(req)
+		metas, err := lookup(codec, req)
 		if err == ErrNotFound {
 			logf("no metadata for url %q: %v", req.URL, err)
 			http.Error(resp, "unrecognized package", http.StatusNotFound)
 			return
 		}
+		if err == ErrNoRepo {
+			logf("no repository for url %q: %v", req.URL, err)
+			http.Error(resp, "repository not found", http.StatusNotFound)
+			return
+		}
 		if err != nil {
 			logf("error locating metadata for url %q: %v", req.URL, err)
 			http.Error(resp, "something went wrong", http.StatusInternalServerError)
 			return
 		}
-		err = PkgTemplate.Execute(resp, m)
+		err = MetasTemplate.Execute(resp, metas)
 		if err != nil {
 			logf("error rendering/writing metadata response: %v", err)
 			resp.Write(nil)
@@ -57,9 +89,30 @@ func Middleware(codec Codec) http.Handler {
 	})
 }
 
-// Render executes PkgTemplate with meta as its context.
-func Render(resp http.ResponseWriter, meta ImportMeta) error {
-	return PkgTemplate.Execute(resp, meta)
+// lookup returns the metadata codec has for req.  A MultiCodec returning no
+// metadata is treated as returning ErrNotFound.  If codec is an Authorizer
+// req is authorized first.
+func lookup(codec Codec, req *http.Request) (Metas, error) {
+	if auth, ok := codec.(Authorizer); ok {
+		err := auth.Authorize(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if mc, ok := codec.(MultiCodec); ok {
+		metas, err := mc.ImportMetas(req)
+		if err == nil && len(metas) == 0 {
+			err = ErrNotFound
+		}
+		return metas, err
+	}
+	m, err := codec.ImportMeta(req)
+	return Metas{m}, err
+}
+
+// Render executes MetasTemplate with metas as its context.
+func Render(resp http.ResponseWriter, metas ...ImportMeta) error {
+	return MetasTemplate.Execute(resp, Metas(metas))
 }
 
 // IsGoGet returns true if req is a GET request with a "go-get" query parameter.
@@ -75,18 +128,70 @@ func IsGoGet(req *http.Request) bool {
 // corresponding to a request.
 var ErrNotFound = fmt.Errorf("not found")
 
+// Authorizer is implemented by a Codec restricting who may look up metadata.
+// Handler and Middleware call Authorize before looking up the metadata of a
+// request and respond to its error as to an error from the lookup.  An
+// Authorizer denying requests with ErrNotFound makes them indistinguishable
+// from requests for packages without metadata.
+type Authorizer interface {
+	Authorize(req *http.Request) error
+}
+
+// ErrNoRepo may be returned by a Codec if the repository holding the
+// requested package does not exist.  Handler serves it as a 404 like
+// ErrNotFound.
+var ErrNoRepo = fmt.Errorf("repository not found")
+
 // ImportMeta contains information needed for go-get to find a package.
 type ImportMeta struct {
 	Pkg     string // fully qualified package import path (e.g. foo.io/bar/baz)
 	RootPkg string // fully qualified root package import path (e.g. foo.io/bar)
 	VCS     string // repository VCS (e.g. git)
 	Repo    string // repository URL (e.g. https://github.com/someuser/bar)
+	Subdir  string // optional repository subdirectory containing RootPkg (e.g. go/bar)
+
+	// Optional go-source templates linking documentation to source code.
+	Home string // repository home page (e.g. https://github.com/someuser/bar)
+	Dir  string // directory URL template (e.g. https://github.com/someuser/bar/tree/HEAD{/dir})
+	File string // file URL template (e.g. https://github.com/someuser/bar/blob/HEAD{/dir}/{file}#L{line})
+
+	// Canonical is the import path humans should use for Pkg if it is served
+	// under an alias (e.g. go.foo.io/bar for foo.io/bar).  The go command
+	// ignores it.
+	Canonical string
 }
 
+// GodocURL returns the documentation URL of the package, at its canonical
+// import path if it has one.
 func (m ImportMeta) GodocURL() string {
+	if m.Canonical != "" {
+		return fmt.Sprintf("http://godoc.org/%s", m.Canonical)
+	}
 	return fmt.Sprintf("http://godoc.org/%s", m.Pkg)
 }
 
+// Metas is an ordered list of go-import entries served on a single page.
+type Metas []ImportMeta
+
+// GodocURL returns the documentation URL of the first entry in metas.
+func (metas Metas) GodocURL() string {
+	if len(metas) == 0 {
+		return ""
+	}
+	return metas[0].GodocURL()
+}
+
+// Canonical returns the canonical import path of the first entry in metas
+// which has one.
+func (metas Metas) Canonical() string {
+	for _, m := range metas {
+		if m.Canonical != "" {
+			return m.Canonical
+		}
+	}
+	return ""
+}
+
 // Codec defines the interface required of implementation specific backend stores.
 type Codec interface {
 	ImportMeta(*http.Request) (ImportMeta, error)
@@ -98,6 +203,33 @@ func (fn CodecFunc) ImportMeta(req *http.Request) (ImportMeta, error) {
 	return fn(req)
 }
 
+// MultiCodec is implemented by Codecs which serve more than one go-import
+// entry for a request, such as a "mod" entry naming a module proxy followed by
+// an entry naming the VCS repository.  Handler renders the entries in the
+// order they are returned.
+type MultiCodec interface {
+	Codec
+	ImportMetas(*http.Request) ([]ImportMeta, error)
+}
+
+type MultiCodecFunc func(*http.Request) ([]ImportMeta, error)
+
+// ImportMeta returns the first entry returned by fn.
+func (fn MultiCodecFunc) ImportMeta(req *http.Request) (ImportMeta, error) {
+	metas, err := fn(req)
+	if err != nil {
+		return ImportMeta{}, err
+	}
+	if len(metas) == 0 {
+		return ImportMeta{}, ErrNotFound
+	}
+	return metas[0], nil
+}
+
+func (fn MultiCodecFunc) ImportMetas(req *http.Request) ([]ImportMeta, error) {
+	return fn(req)
+}
+
 var Logger interface {
 	Log(string)
 }
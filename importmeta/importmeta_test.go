@@ -49,6 +49,12 @@ func TestMiddlewareBehavior(t *testing.T) {
 		{true, MockCodec{}, true, nil},
 		{true, MockCodec{err: ErrNotFound}, true, nil}, // TODO check error
 		{true, MockCodec{err: fmt.Errorf("boom")}, true, nil},
+		{true, MockCodec{err: ErrNoRepo}, true, func(resp *httptest.ResponseRecorder) error {
+			if resp.Code != http.StatusNotFound || !strings.Contains(resp.Body.String(), "repository not found") {
+				return fmt.Errorf("unexpected response for a missing repository: %d %q", resp.Code, resp.Body.String())
+			}
+			return nil
+		}},
 		{false, MockCodec{}, false, nil},
 		{false, MockCodec{err: ErrNotFound}, false, nil},
 		{false, MockCodec{err: fmt.Errorf("boom")}, false, nil},
@@ -72,12 +78,46 @@ func TestMiddlewareBehavior(t *testing.T) {
 		if test.check != nil {
 			err := test.check(resp)
 			if err != nil {
-				fmt.Errorf("test %d: %v", i, err)
+				t.Errorf("test %d: %v", i, err)
 			}
 		}
 	}
 }
 
+// authCodec denies requests without a token before looking up metadata.
+type authCodec struct {
+	MockCodec
+	lookups int
+}
+
+func (c *authCodec) Authorize(req *http.Request) error {
+	if req.Header.Get("Authorization") == "" {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (c *authCodec) ImportMeta(req *http.Request) (ImportMeta, error) {
+	c.lookups++
+	return c.MockCodec.ImportMeta(req)
+}
+
+func TestAuthorizer(t *testing.T) {
+	codec := &authCodec{MockCodec: MockCodec{meta: ImportMeta{RootPkg: "foo.io/bar", VCS: "git", Repo: "https://github.com/mcfoo/bar"}}}
+	req, _ := http.NewRequest("GET", "/bar?go-get=1", nil)
+	resp := httptest.NewRecorder()
+	Handler(codec).ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotFound || codec.lookups != 0 {
+		t.Errorf("unauthorized request served: %d (%d lookups)", resp.Code, codec.lookups)
+	}
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp = httptest.NewRecorder()
+	Handler(codec).ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK || codec.lookups != 1 {
+		t.Errorf("authorized request denied: %d (%d lookups)", resp.Code, codec.lookups)
+	}
+}
+
 type LogRecorder struct {
 	logs []string
 }
@@ -113,7 +153,7 @@ func TestTemplate(t *testing.T) {
 		Repo:    "https://github.com/mcfoo/bar",
 	}
 	buf := new(bytes.Buffer)
-	err := pkgTemplate.Execute(buf, meta)
+	err := PkgTemplate.Execute(buf, meta)
 	if err != nil {
 		t.Fatalf("error rendering template: %v", err)
 	}
@@ -130,3 +170,100 @@ func TestTemplate(t *testing.T) {
 		}
 	}
 }
+
+// make sure that Render and PkgTemplate render the optional subdir,
+// go-source and canonical tags of an entry.
+func TestRender(t *testing.T) {
+	for i, test := range []struct {
+		meta  ImportMeta
+		metas []string
+	}{
+		{
+			ImportMeta{
+				Pkg:     "foo.io/bar/baz",
+				RootPkg: "foo.io/bar",
+				VCS:     "git",
+				Repo:    "https://github.com/mcfoo/mono",
+				Subdir:  "go/bar",
+			},
+			[]string{
+				`<meta name="go-import" content="foo.io/bar git https://github.com/mcfoo/mono go/bar">`,
+			},
+		},
+		{
+			ImportMeta{
+				Pkg:     "foo.io/bar",
+				RootPkg: "foo.io/bar",
+				VCS:     "git",
+				Repo:    "https://gitlab.com/mcfoo/bar",
+				Home:    "https://gitlab.com/mcfoo/bar",
+				Dir:     "https://gitlab.com/mcfoo/bar/-/tree/HEAD{/dir}",
+			},
+			[]string{
+				`<meta name="go-source" content="foo.io/bar https://gitlab.com/mcfoo/bar https://gitlab.com/mcfoo/bar/-/tree/HEAD{/dir} _">`,
+			},
+		},
+		{
+			ImportMeta{
+				Pkg:       "go.foo.io/bar",
+				RootPkg:   "go.foo.io/bar",
+				VCS:       "git",
+				Repo:      "https://github.com/mcfoo/bar",
+				Canonical: "foo.io/bar",
+			},
+			[]string{
+				`<meta name="go-import" content="go.foo.io/bar git https://github.com/mcfoo/bar">`,
+				`<link rel="canonical" href="https://foo.io/bar">`,
+				`<meta http-equiv="refresh" content="0; URL='http://godoc.org/foo.io/bar'">`,
+			},
+		},
+	} {
+		buf := httptest.NewRecorder()
+		err := Render(buf, test.meta)
+		if err != nil {
+			t.Fatalf("test %d: error rendering template: %v", i, err)
+		}
+		single := new(bytes.Buffer)
+		err = PkgTemplate.Execute(single, test.meta)
+		if err != nil {
+			t.Fatalf("test %d: error rendering template: %v", i, err)
+		}
+		for _, html := range []string{buf.Body.String(), single.String()} {
+			t.Logf("test %d: template output: %q", i, html)
+			for _, meta := range test.metas {
+				ok := strings.Contains(html, meta)
+				if !ok {
+					t.Errorf("test %d: template output missing meta tag: %v", i, meta)
+				}
+			}
+		}
+	}
+}
+
+func TestHandlerMultiCodec(t *testing.T) {
+	codec := MultiCodecFunc(func(req *http.Request) ([]ImportMeta, error) {
+		return []ImportMeta{
+			{Pkg: "foo.io/bar", RootPkg: "foo.io/bar", VCS: "mod", Repo: "https://proxy.foo.io"},
+			{Pkg: "foo.io/bar", RootPkg: "foo.io/bar", VCS: "git", Repo: "https://github.com/mcfoo/bar"},
+		}, nil
+	})
+	req, _ := http.NewRequest("GET", "/bar?go-get=1", nil)
+	resp := httptest.NewRecorder()
+	Handler(codec).ServeHTTP(resp, req)
+	html := resp.Body.String()
+	mod := strings.Index(html, `<meta name="go-import" content="foo.io/bar mod https://proxy.foo.io">`)
+	git := strings.Index(html, `<meta name="go-import" content="foo.io/bar git https://github.com/mcfoo/bar">`)
+	if mod < 0 || git < 0 {
+		t.Fatalf("response missing meta tags: %q", html)
+	}
+	if mod > git {
+		t.Errorf("meta tags rendered out of order: %q", html)
+	}
+
+	empty := MultiCodecFunc(func(req *http.Request) ([]ImportMeta, error) { return nil, nil })
+	resp = httptest.NewRecorder()
+	Handler(empty).ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("unexpected status for codec without metadata: %d", resp.Code)
+	}
+}
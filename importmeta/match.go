@@ -0,0 +1,59 @@
+package importmeta
+
+import (
+	"fmt"
+)
+
+// ModMode determines how Match treats go-import entries with the "mod" VCS.
+type ModMode int
+
+const (
+	// IgnoreMod drops "mod" entries, as cmd/go does outside of module mode.
+	IgnoreMod ModMode = iota
+
+	// PreferMod moves "mod" entries ahead of all other entries and drops the
+	// entries superseded by a "mod" entry with the same root, as cmd/go does
+	// in module mode.
+	PreferMod
+)
+
+// Match selects the entry cmd/go uses for the import path pkg from the
+// go-import entries of a page, given in the order they appear.  An error is
+// returned if no entry is a prefix of pkg or if more than one entry matches
+// without a "mod" entry taking precedence.
+func Match(metas []ImportMeta, pkg string, mode ModMode) (ImportMeta, error) {
+	var list []ImportMeta
+	have := make(map[string]bool)
+	if mode == PreferMod {
+		for _, m := range metas {
+			if m.VCS == "mod" {
+				have[m.RootPkg] = true
+				list = append(list, m)
+			}
+		}
+	}
+	for _, m := range metas {
+		if m.VCS != "mod" && !have[m.RootPkg] {
+			list = append(list, m)
+		}
+	}
+
+	match := -1
+	for i, m := range list {
+		if !hasPathPrefix(pkg, m.RootPkg) {
+			continue
+		}
+		if match >= 0 {
+			if list[match].VCS == "mod" && m.VCS != "mod" {
+				// all mod entries precede the others. the first is used.
+				break
+			}
+			return ImportMeta{}, fmt.Errorf("multiple meta tags match import path %q", pkg)
+		}
+		match = i
+	}
+	if match < 0 {
+		return ImportMeta{}, fmt.Errorf("no meta tag matches import path %q", pkg)
+	}
+	return list[match], nil
+}
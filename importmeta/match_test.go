@@ -0,0 +1,67 @@
+package importmeta
+
+import (
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	var (
+		mod    = ImportMeta{RootPkg: "foo.io/bar", VCS: "mod", Repo: "https://proxy.foo.io"}
+		git    = ImportMeta{RootPkg: "foo.io/bar", VCS: "git", Repo: "https://github.com/mcfoo/bar"}
+		hg     = ImportMeta{RootPkg: "foo.io/bar", VCS: "hg", Repo: "https://bitbucket.org/mcfoo/bar"}
+		sub    = ImportMeta{RootPkg: "foo.io/bar/baz", VCS: "git", Repo: "https://github.com/mcfoo/baz"}
+		modsub = ImportMeta{RootPkg: "foo.io/bar/baz", VCS: "mod", Repo: "https://proxy.foo.io"}
+		other  = ImportMeta{RootPkg: "foo.io/qux", VCS: "git", Repo: "https://github.com/mcfoo/qux"}
+	)
+	for i, test := range []struct {
+		metas  []ImportMeta
+		pkg    string
+		mode   ModMode
+		expect ImportMeta
+		err    bool
+	}{
+		// a single matching entry is selected regardless of mode.
+		{[]ImportMeta{git}, "foo.io/bar", IgnoreMod, git, false},
+		{[]ImportMeta{git}, "foo.io/bar/baz", PreferMod, git, false},
+		{[]ImportMeta{other, git}, "foo.io/bar", IgnoreMod, git, false},
+
+		// the root must be a path prefix, not a string prefix.
+		{[]ImportMeta{git}, "foo.io/barn", IgnoreMod, ImportMeta{}, true},
+		{[]ImportMeta{other}, "foo.io/bar", PreferMod, ImportMeta{}, true},
+
+		// mod entries supersede other entries with the same root in module
+		// mode, wherever they appear on the page.
+		{[]ImportMeta{mod, git}, "foo.io/bar", PreferMod, mod, false},
+		{[]ImportMeta{git, mod}, "foo.io/bar", PreferMod, mod, false},
+
+		// outside of module mode mod entries are ignored.
+		{[]ImportMeta{mod, git}, "foo.io/bar", IgnoreMod, git, false},
+		{[]ImportMeta{mod}, "foo.io/bar", IgnoreMod, ImportMeta{}, true},
+
+		// multiple matching non-mod entries are an error.
+		{[]ImportMeta{git, hg}, "foo.io/bar", IgnoreMod, ImportMeta{}, true},
+		{[]ImportMeta{git, sub}, "foo.io/bar/baz", IgnoreMod, ImportMeta{}, true},
+
+		// a matching mod entry wins over matching entries for other roots.
+		{[]ImportMeta{git, modsub}, "foo.io/bar/baz", PreferMod, modsub, false},
+		{[]ImportMeta{mod, sub}, "foo.io/bar/baz", PreferMod, mod, false},
+
+		// but multiple matching mod entries are an error.
+		{[]ImportMeta{mod, modsub}, "foo.io/bar/baz", PreferMod, ImportMeta{}, true},
+	} {
+		m, err := Match(test.metas, test.pkg, test.mode)
+		if test.err {
+			if err == nil {
+				t.Errorf("test %d: expected an error but got %v", i, m)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: %v", i, err)
+			continue
+		}
+		if m != test.expect {
+			t.Errorf("test %d: selected %v instead of %v", i, m, test.expect)
+		}
+	}
+}
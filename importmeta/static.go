@@ -0,0 +1,82 @@
+package importmeta
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Enumerator is implemented by Codecs which are able to list every package
+// they serve.  Export requires an Enumerator.
+type Enumerator interface {
+	Enumerate() ([]ImportMeta, error)
+}
+
+// StaticCodec is a Codec serving a fixed set of packages.  Each element
+// describes one known package.  Packages beneath the RootPkg of an element are
+// served even if they are not listed themselves.
+type StaticCodec []ImportMeta
+
+// ImportMeta returns the first entry of ImportMetas.
+func (s StaticCodec) ImportMeta(req *http.Request) (ImportMeta, error) {
+	metas, err := s.ImportMetas(req)
+	if err != nil {
+		return ImportMeta{}, err
+	}
+	return metas[0], nil
+}
+
+// ImportMetas returns the distinct entries, in order, having the longest
+// RootPkg containing the request path.
+func (s StaticCodec) ImportMetas(req *http.Request) ([]ImportMeta, error) {
+	pkg := path.Join(req.Host, req.URL.Path)
+	var root string
+	for _, m := range s {
+		if hasPathPrefix(pkg, m.RootPkg) && len(m.RootPkg) > len(root) {
+			root = m.RootPkg
+		}
+	}
+	if root == "" {
+		return nil, ErrNotFound
+	}
+	var metas []ImportMeta
+	for _, m := range s {
+		if m.RootPkg != root {
+			continue
+		}
+		m.Pkg = pkg
+		if !containsImport(metas, m) {
+			metas = append(metas, m)
+		}
+	}
+	return metas, nil
+}
+
+// Enumerate returns a copy of s.
+func (s StaticCodec) Enumerate() ([]ImportMeta, error) {
+	metas := make([]ImportMeta, len(s))
+	copy(metas, s)
+	return metas, nil
+}
+
+// containsImport returns true if metas has an entry with the same go-import
+// content as m.
+func containsImport(metas []ImportMeta, m ImportMeta) bool {
+	for _, x := range metas {
+		if x.RootPkg == m.RootPkg && x.VCS == m.VCS && x.Repo == m.Repo && x.Subdir == m.Subdir {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPathPrefix returns true if pkg is prefix or a package beneath it.
+func hasPathPrefix(pkg, prefix string) bool {
+	if prefix == "" {
+		return false
+	}
+	if pkg == prefix {
+		return true
+	}
+	return strings.HasPrefix(pkg, prefix) && pkg[len(prefix)] == '/'
+}